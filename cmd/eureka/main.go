@@ -0,0 +1,278 @@
+// Command eureka inspects and edits the IPAM state of the probable-eureka
+// networks on this node. Changes to a store take the same lock as the
+// plugin, so the tool is safe to run while pods come and go.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/innfi/probable-eureka/pkg/admin"
+	"github.com/innfi/probable-eureka/pkg/ipam"
+	"github.com/innfi/probable-eureka/pkg/network"
+
+	"github.com/vishvananda/netlink"
+)
+
+const usage = `usage: eureka [-conf-dir dir] [-network name] <command> [args]
+
+commands:
+  list               allocations per network, with container and age
+  usage              pool utilization per range
+  reserve IP [note]  take IP out of the pool
+  release IP         free IP, whoever holds it
+  check              report allocations and interfaces that disagree
+  reconcile [-dry-run]
+                     free the allocations of pods whose veth and netns
+                     are gone from the node
+
+reserve and release pick the network whose ranges contain IP unless
+-network is given.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("eureka", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	confDir := fs.String("conf-dir", admin.DefaultConfDir, "CNI network config directory")
+	netName := fs.String("network", "", "network to operate on")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	nets, err := admin.Networks(*confDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: %v\n", err)
+	}
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		err = list(stdout, nets, *netName)
+	case "usage":
+		err = showUsage(stdout, nets, *netName)
+	case "reserve", "release":
+		if len(cmdArgs) == 0 {
+			fs.Usage()
+			return 2
+		}
+		err = editIP(stdout, nets, *netName, cmd, cmdArgs)
+	case "check":
+		var found bool
+		found, err = check(stdout, nets, *netName)
+		if err == nil && found {
+			return 1
+		}
+	case "reconcile":
+		rfs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+		rfs.SetOutput(stderr)
+		dryRun := rfs.Bool("dry-run", false, "only report what would be freed")
+		if err := rfs.Parse(cmdArgs); err != nil {
+			return 2
+		}
+		err = reconcile(stdout, nets, *netName, *dryRun)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "eureka %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// filter narrows nets to the one called name, if a name is given.
+func filter(nets []admin.Network, name string) ([]admin.Network, error) {
+	if name == "" {
+		return nets, nil
+	}
+	n, err := admin.Select(nets, name)
+	if err != nil {
+		return nil, err
+	}
+	return []admin.Network{n}, nil
+}
+
+func list(w io.Writer, nets []admin.Network, name string) error {
+	nets, err := filter(nets, name)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tIP\tCONTAINER\tIFNAME\tHOST VETH\tAGE")
+	for _, n := range nets {
+		allocs, err := n.IPAM().Allocations()
+		if err != nil {
+			return fmt.Errorf("network %s: %w", n.Name, err)
+		}
+		sortByIP(allocs)
+		for _, a := range allocs {
+			container := a.ContainerID
+			if a.Reserved {
+				container = "(reserved) " + a.Note
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				n.Name, a.IP, container, dash(a.IfName), dash(a.HostVeth), age(a.AllocatedAt))
+		}
+	}
+	return tw.Flush()
+}
+
+func showUsage(w io.Writer, nets []admin.Network, name string) error {
+	nets, err := filter(nets, name)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tRANGE\tSIZE\tALLOCATED\tFREE\tUSED")
+	for _, n := range nets {
+		usage, err := n.IPAM().Usage()
+		if err != nil {
+			return fmt.Errorf("network %s: %w", n.Name, err)
+		}
+		for _, u := range usage {
+			used := 0.0
+			if u.Size > 0 {
+				used = 100 * float64(u.Allocated) / u.Size
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.0f\t%d\t%.0f\t%.1f%%\n",
+				n.Name, u.Range, u.Size, u.Allocated, u.Size-float64(u.Allocated), used)
+		}
+	}
+	return tw.Flush()
+}
+
+func editIP(w io.Writer, nets []admin.Network, name, cmd string, args []string) error {
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", args[0])
+	}
+	n, err := admin.ForIP(nets, name, ip)
+	if err != nil {
+		return err
+	}
+
+	if cmd == "reserve" {
+		note := ""
+		if len(args) > 1 {
+			note = args[1]
+		}
+		if err := n.IPAM().ReserveIP(ip, note); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reserved %s in network %s\n", ip, n.Name)
+		return nil
+	}
+
+	released, err := n.IPAM().ReleaseIP(ip)
+	if err != nil {
+		return err
+	}
+	holder := "container " + released.ContainerID
+	if released.Reserved {
+		holder = "a reservation"
+	}
+	fmt.Fprintf(w, "released %s in network %s, held by %s\n", ip, n.Name, holder)
+	return nil
+}
+
+// check prints the inconsistencies it finds and reports whether there were any.
+func check(w io.Writer, nets []admin.Network, name string) (bool, error) {
+	nets, err := filter(nets, name)
+	if err != nil {
+		return false, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return false, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	problems, err := admin.Check(nets, links)
+	if err != nil {
+		return false, err
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "no inconsistencies found")
+		return false, nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tPROBLEM\tIP\tINTERFACE\tDETAIL")
+	for _, p := range problems {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Network, p.Kind, dash(p.IP), dash(p.Link), p.Detail)
+	}
+	return true, tw.Flush()
+}
+
+func reconcile(w io.Writer, nets []admin.Network, name string, dryRun bool) error {
+	nets, err := filter(nets, name)
+	if err != nil {
+		return err
+	}
+
+	action := "freed"
+	if dryRun {
+		action = "would free"
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NETWORK\tIP\tCONTAINER\tHOST VETH\tNETNS\tACTION")
+	for _, n := range nets {
+		orphans, err := network.New().Reconcile(n.Conf.IPAM, dryRun)
+		if err != nil {
+			return fmt.Errorf("network %s: %w", n.Name, err)
+		}
+		for _, a := range orphans {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				n.Name, a.IP, a.ContainerID, a.HostVeth, dash(a.Netns), action)
+		}
+	}
+	return tw.Flush()
+}
+
+func sortByIP(allocs []ipam.Allocation) {
+	sort.SliceStable(allocs, func(i, j int) bool {
+		a, b := net.ParseIP(allocs[i].IP).To16(), net.ParseIP(allocs[j].IP).To16()
+		return string(a) < string(b)
+	})
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -1,47 +1,37 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/innfi/probable-eureka/pkg/cnierr"
 	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/ipam"
 	"github.com/innfi/probable-eureka/pkg/logging"
+	"github.com/innfi/probable-eureka/pkg/metrics"
 	"github.com/innfi/probable-eureka/pkg/network"
+	"github.com/innfi/probable-eureka/pkg/tracing"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const (
-	vethPrefix           = "veth"
-	containerIDPrefixLen = 8
-)
-
-func hostVethName(containerID string) string {
-	return vethPrefix + containerID[:containerIDPrefixLen]
-}
-
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
 	start := time.Now()
 
-	conf := config.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		logging.Logger.Error("cni_command_failed",
-			"operation", "add",
-			"container_id", args.ContainerID,
-			"error", err.Error(),
-		)
-		return fmt.Errorf("failed to parse config: %v", err)
+	hostVeth, err := network.HostVethName(conf.VethPrefix, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
 	}
-
-	hostVeth := hostVethName(args.ContainerID)
 	containerVeth := args.IfName
 
-	n := network.New()
-	addr, err := n.SetupNetwork(args.Netns, hostVeth, containerVeth, args.ContainerID, conf.Bridge, conf.IPAM)
+	n := network.New().WithContext(ctx)
+	addr, mac, err := n.SetupNetwork(args.Netns, hostVeth, containerVeth, args.ContainerID, conf)
 	if err != nil {
 		logging.Logger.Error("cni_command_failed",
 			"operation", "add",
@@ -60,6 +50,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		"netns", args.Netns,
 		"ifname", args.IfName,
 		"allocated_ip", addr.IPNet.String(),
+		"mac", mac.String(),
 		"duration_ms", time.Since(start).Milliseconds(),
 		"status", "success",
 	)
@@ -68,35 +59,35 @@ func cmdAdd(args *skel.CmdArgs) error {
 	result := &current.Result{
 		CNIVersion: conf.CNIVersion,
 		Interfaces: []*current.Interface{
-			{Name: containerVeth},
+			{Name: containerVeth, Mac: mac.String(), Sandbox: args.Netns},
 		},
 		IPs: []*current.IPConfig{
 			{
-				Address: *addr.IPNet,
+				Interface: current.Int(0),
+				Address:   *addr.IPNet,
 			},
 		},
+		DNS: conf.ResultDNS(),
 	}
 
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+func cmdDel(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
 	start := time.Now()
 
-	conf := config.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
+	hostVeth, err := network.HostVethName(conf.VethPrefix, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
 	}
 
-	hostVeth := hostVethName(args.ContainerID)
-
 	logging.Logger.Info("cmdDel",
 		"hostVeth", hostVeth,
 	)
 
-	n := network.New()
+	n := network.New().WithContext(ctx)
 
-	if err := n.TeardownNetwork(hostVeth, conf.Bridge, conf.IPAM, args.ContainerID); err != nil {
+	if err := n.TeardownNetwork(hostVeth, args.ContainerID, args.IfName, conf); err != nil {
 		logging.Logger.Error("cni_command_failed",
 			"operation", "del",
 			"container_id", args.ContainerID,
@@ -115,27 +106,25 @@ func cmdDel(args *skel.CmdArgs) error {
 	return nil
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
+func cmdCheck(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
 	start := time.Now()
 
-	conf := config.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
-	}
-
 	if conf.PrevResult == nil {
-		return fmt.Errorf("missing prevResult from runtime")
+		return cnierr.Errorf(types.ErrInvalidNetworkConfig, "missing prevResult from runtime")
 	}
 
 	prevResult, err := current.GetResult(conf.PrevResult)
 	if err != nil {
-		return fmt.Errorf("failed to parse prevResult: %v", err)
+		return cnierr.Errorf(types.ErrDecodingFailure, "failed to parse prevResult: %v", err)
 	}
 
-	hostVeth := hostVethName(args.ContainerID)
-	n := network.New()
+	hostVeth, err := network.HostVethName(conf.VethPrefix, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+	n := network.New().WithContext(ctx)
 
-	if err := n.CheckNetwork(args.Netns, hostVeth, args.IfName, prevResult.IPs); err != nil {
+	if err := n.CheckNetwork(args.Netns, hostVeth, args.IfName, args.ContainerID, prevResult.IPs, conf); err != nil {
 		logging.Logger.Error("cni_command_failed",
 			"operation", "check",
 			"container_id", args.ContainerID,
@@ -155,14 +144,12 @@ func cmdCheck(args *skel.CmdArgs) error {
 	return nil
 }
 
-func cmdStatus(args *skel.CmdArgs) error {
-	conf := config.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
+func cmdStatus(ctx context.Context, _ *skel.CmdArgs, conf *config.NetConf) error {
+	n := network.New().WithContext(ctx)
+	if conf.Reconcile != nil && conf.Reconcile.OnStatus {
+		reconcile(n, conf)
 	}
-
-	n := network.New()
-	if err := n.CheckPluginStatus(conf.IPAM); err != nil {
+	if err := n.CheckPluginStatus(conf); err != nil {
 		logging.Logger.Error("cni_command_failed",
 			"operation", "status",
 			"error", err.Error(),
@@ -178,21 +165,16 @@ func cmdStatus(args *skel.CmdArgs) error {
 	return nil
 }
 
-func cmdGC(args *skel.CmdArgs) error {
+func cmdGC(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
 	start := time.Now()
 
-	conf := config.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("failed to parse config: %v", err)
-	}
-
 	validContainerIDs := make(map[string]bool)
 	for _, attachment := range conf.ValidAttachments {
 		validContainerIDs[attachment.ContainerID] = true
 	}
 
-	n := network.New()
-	if err := n.GarbageCollect(conf.IPAM, validContainerIDs); err != nil {
+	n := network.New().WithContext(ctx)
+	if err := n.GarbageCollect(conf, validContainerIDs); err != nil {
 		logging.Logger.Error("cni_command_failed",
 			"operation", "gc",
 			"duration_ms", time.Since(start).Milliseconds(),
@@ -200,6 +182,9 @@ func cmdGC(args *skel.CmdArgs) error {
 		)
 		return err
 	}
+	if conf.Reconcile != nil && conf.Reconcile.OnGC {
+		reconcile(n, conf)
+	}
 
 	logging.Logger.Info("cni_command_completed",
 		"operation", "gc",
@@ -211,16 +196,171 @@ func cmdGC(args *skel.CmdArgs) error {
 	return nil
 }
 
-func main() {
-	if err := logging.Init(""); err != nil {
+// reconcile frees the allocations of pods gone from the node. It is a
+// side job of STATUS and GC, so a failure is logged rather than returned.
+func reconcile(n *network.Network, conf *config.NetConf) {
+	if _, err := n.Reconcile(conf.IPAM, conf.Reconcile.DryRun); err != nil {
+		logging.Logger.Warn("reconcile_failed", "error", err.Error())
+	}
+}
+
+// withCNIError hands the runtime a types.Error carrying the code attached
+// where the failure was detected.
+func withCNIError(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		return cnierr.ToCNI(cmd(args))
+	}
+}
+
+// command runs one CNI command against the network config.
+type command func(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error
+
+// defaultTraceFlushTimeout bounds the span flush at exit unless the config
+// sets tracing.flushTimeoutMs. It is kept short: every command waits it out
+// when the collector is unreachable.
+const defaultTraceFlushTimeout = 200 * time.Millisecond
+
+// withConfig loads the network config once for the wrappers and the
+// command, failing the command when the config cannot be used.
+func withConfig(name string, cmd command) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		conf, err := loadConfig(args, name)
+		if err != nil {
+			logging.Logger.Error("cni_command_failed",
+				"operation", name,
+				"container_id", args.ContainerID,
+				"error", err.Error(),
+			)
+			return err
+		}
+		return cmd(context.Background(), args, conf)
+	}
+}
+
+// withTracing runs cmd in a root span for the command, parented to the
+// caller's span when one is passed in CNI_ARGS or the environment, and
+// flushes the spans before the plugin exits.
+func withTracing(name string, cmd command) command {
+	return func(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
+		if conf.Tracing == nil {
+			return cmd(ctx, args, conf)
+		}
+
+		shutdown, err := tracing.Init(ctx, tracing.Options{
+			Endpoint: conf.Tracing.Endpoint,
+			Insecure: conf.Tracing.Insecure,
+			File:     conf.Tracing.File,
+		})
+		if err != nil {
+			// Tracing must never fail the command itself.
+			fmt.Fprintf(os.Stderr, "tracing disabled: %v\n", err)
+			return cmd(ctx, args, conf)
+		}
+		defer func() {
+			timeout := defaultTraceFlushTimeout
+			if conf.Tracing.FlushTimeoutMs != nil {
+				timeout = time.Duration(*conf.Tracing.FlushTimeoutMs) * time.Millisecond
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			shutdown(flushCtx)
+		}()
+
+		traceparent := conf.TraceParent
+		if traceparent == "" {
+			traceparent = os.Getenv("TRACEPARENT")
+		}
+		ctx = tracing.Extract(ctx, traceparent, os.Getenv("TRACESTATE"))
+		ctx, span := tracing.Start(ctx, "cni."+name,
+			attribute.String("cni.network", conf.Name),
+			attribute.String("cni.container_id", args.ContainerID),
+			attribute.String("cni.ifname", args.IfName),
+			attribute.String("cni.netns", args.Netns),
+		)
+		err = cmd(ctx, args, conf)
+		tracing.End(span, err)
+		return err
+	}
+}
+
+// withMetrics records the outcome and duration of cmd, and the IPAM pool
+// usage after it, in the configured metrics file.
+func withMetrics(name string, cmd command) command {
+	return func(ctx context.Context, args *skel.CmdArgs, conf *config.NetConf) error {
+		start := time.Now()
+		err := cmd(ctx, args, conf)
+
+		if conf.MetricsFile == "" {
+			return err
+		}
+		inv := metrics.Invocation{
+			Network:  conf.Name,
+			Command:  name,
+			Err:      err,
+			Duration: time.Since(start),
+		}
+		if conf.IPAM != nil {
+			im := ipam.NewIPAM(conf.IPAM)
+			usage, usageErr := im.Usage()
+			if usageErr != nil {
+				logging.Logger.Warn("metrics_pool_usage_failed", "error", usageErr.Error())
+			}
+			for _, u := range usage {
+				inv.Pools = append(inv.Pools, metrics.Pool{Range: u.Range, Size: u.Size, Allocated: u.Allocated})
+			}
+		}
+		if recErr := metrics.Record(conf.MetricsFile, inv); recErr != nil {
+			logging.Logger.Warn("metrics_record_failed", "path", conf.MetricsFile, "error", recErr.Error())
+		}
+		return err
+	}
+}
+
+// loadConfig validates and parses the network config and sets up logging
+// from it, so every record of the invocation carries its request ID and
+// network name. DEL is best-effort: it goes ahead on a config that fails
+// validation, as long as the config can be parsed at all.
+func loadConfig(args *skel.CmdArgs, command string) (*config.NetConf, error) {
+	conf, err := config.Load(args.StdinData, args.Args)
+	if err != nil {
+		initLogging(logging.Options{})
+	} else {
+		initLogging(logging.Options{
+			Path:       conf.LogFile,
+			Level:      conf.LogLevel,
+			Format:     conf.LogFormat,
+			MaxSizeMB:  conf.LogMaxSizeMB,
+			MaxBackups: conf.LogMaxBackups,
+		})
+		logging.WithInvocation(conf.Name)
+	}
+
+	if verr := config.Validate(args.StdinData); verr != nil {
+		if command != "del" || err != nil {
+			return nil, verr
+		}
+		logging.Logger.Warn("config_invalid", "operation", command, "error", verr.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// initLogging falls back to stderr rather than failing the command.
+func initLogging(opts logging.Options) {
+	if err := logging.Init(opts); err != nil {
 		logging.InitStderr()
+		logging.Logger.Warn("log_init_failed", "error", err.Error())
 	}
+}
 
+func main() {
 	skel.PluginMainFuncs(skel.CNIFuncs{
-		Add:    cmdAdd,
-		Del:    cmdDel,
-		Check:  cmdCheck,
-		Status: cmdStatus,
-		GC:     cmdGC,
+		Add:    withCNIError(withConfig("add", withMetrics("add", withTracing("add", cmdAdd)))),
+		Del:    withCNIError(withConfig("del", withMetrics("del", withTracing("del", cmdDel)))),
+		Check:  withCNIError(withConfig("check", withMetrics("check", withTracing("check", cmdCheck)))),
+		Status: withCNIError(withConfig("status", withTracing("status", cmdStatus))),
+		GC:     withCNIError(withConfig("gc", withMetrics("gc", withTracing("gc", cmdGC)))),
 	}, version.All, "probable-eureka v1.0.0")
 }
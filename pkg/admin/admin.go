@@ -0,0 +1,255 @@
+// Package admin implements the operator commands of the eureka tool against
+// the networks the plugin serves on this node: it finds them in the CNI
+// config directory and cross-checks their IPAM stores with the host.
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/ipam"
+	"github.com/innfi/probable-eureka/pkg/network"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/vishvananda/netlink"
+)
+
+// PluginType is the plugin's "type" in network configs.
+const PluginType = "probable-eureka"
+
+// DefaultConfDir is where runtimes look for network configs.
+const DefaultConfDir = "/etc/cni/net.d"
+
+// hostVethLen is the length of every host veth name: the hash fills the
+// name up to IFNAMSIZ minus the trailing NUL.
+const hostVethLen = config.MaxIfNameLen
+
+// Network is one network whose config invokes the plugin.
+type Network struct {
+	Name string
+	File string
+	Conf *config.NetConf
+}
+
+// IPAM opens the network's allocation store.
+func (n Network) IPAM() *ipam.IPAM {
+	im := ipam.NewIPAM(n.Conf.IPAM)
+	return &im
+}
+
+// Networks loads the plugin's networks from the config files in dir. A file
+// that cannot be read does not hide the others: it is reported in the
+// returned error next to the networks that did load.
+func Networks(dir string) ([]Network, error) {
+	files, err := libcni.ConfFiles(dir, []string{".conf", ".conflist", ".json"})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var nets []Network
+	var errs []error
+	for _, file := range files {
+		list, err := libcni.NetworkConfFromFile(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		for _, plugin := range list.Plugins {
+			if plugin.Network.Type != PluginType {
+				continue
+			}
+			conf, err := config.Load(plugin.Bytes, "")
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", file, err))
+				continue
+			}
+			if conf.IPAM == nil {
+				errs = append(errs, fmt.Errorf("%s: network %s has no ipam section", file, list.Name))
+				continue
+			}
+			// A conflist carries the name on the list, not on its plugins.
+			conf.Name = list.Name
+			nets = append(nets, Network{Name: list.Name, File: file, Conf: conf})
+		}
+	}
+	return nets, errors.Join(errs...)
+}
+
+// Select returns the network called name, or the only network when name is
+// empty.
+func Select(nets []Network, name string) (Network, error) {
+	if name == "" {
+		if len(nets) == 1 {
+			return nets[0], nil
+		}
+		return Network{}, fmt.Errorf("%d networks found (%s), pick one with -network", len(nets), names(nets))
+	}
+	for _, n := range nets {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return Network{}, fmt.Errorf("network %q not found among %s", name, names(nets))
+}
+
+// ForIP returns the network called name, or when name is empty the one
+// network whose ranges contain ip. An address outside every range, left
+// behind by a range change, belongs to the network whose store records it.
+func ForIP(nets []Network, name string, ip net.IP) (Network, error) {
+	if name != "" {
+		return Select(nets, name)
+	}
+	var matches []Network
+	for _, n := range nets {
+		if n.IPAM().InRange(ip) {
+			matches = append(matches, n)
+		}
+	}
+	if len(matches) == 0 {
+		for _, n := range nets {
+			if holds(n, ip) {
+				matches = append(matches, n)
+			}
+		}
+	}
+	if len(matches) != 1 {
+		return Network{}, fmt.Errorf("%s is in the ranges of %d networks, pick one with -network", ip, len(matches))
+	}
+	return matches[0], nil
+}
+
+func holds(n Network, ip net.IP) bool {
+	allocs, err := n.IPAM().Allocations()
+	if err != nil {
+		return false
+	}
+	for _, a := range allocs {
+		if net.ParseIP(a.IP).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func names(nets []Network) string {
+	if len(nets) == 0 {
+		return "none"
+	}
+	var out []string
+	for _, n := range nets {
+		out = append(out, n.Name)
+	}
+	return strings.Join(out, ", ")
+}
+
+// Problem kinds reported by Check.
+const (
+	// MissingVeth is an allocation whose host veth is gone from the node.
+	MissingVeth = "missing_veth"
+	// UntrackedVeth is a plugin veth on the network's bridge that no
+	// allocation records.
+	UntrackedVeth = "untracked_veth"
+	// DuplicateIP is an address recorded more than once.
+	DuplicateIP = "duplicate_ip"
+	// OutOfRange is an allocation outside the configured ranges, usually
+	// left behind by a range change.
+	OutOfRange = "out_of_range"
+)
+
+// Problem is one inconsistency between a store and the node.
+type Problem struct {
+	Network string
+	Kind    string
+	IP      string
+	Link    string
+	Detail  string
+}
+
+// Check compares the allocation stores of nets with links, the interfaces
+// present on the node.
+func Check(nets []Network, links []netlink.Link) ([]Problem, error) {
+	byName := make(map[string]netlink.Link, len(links))
+	for _, l := range links {
+		byName[l.Attrs().Name] = l
+	}
+
+	allocs := make(map[string][]ipam.Allocation, len(nets))
+	tracked := make(map[string]bool)
+	for _, n := range nets {
+		a, err := n.IPAM().Allocations()
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %w", n.Name, err)
+		}
+		allocs[n.Name] = a
+		for _, alloc := range a {
+			if alloc.HostVeth != "" {
+				tracked[alloc.HostVeth] = true
+			}
+		}
+	}
+
+	var problems []Problem
+	for _, n := range nets {
+		im := n.IPAM()
+		seen := make(map[string]string)
+		for _, alloc := range allocs[n.Name] {
+			owner := alloc.ContainerID
+			if alloc.Reserved {
+				owner = "reservation"
+			}
+			if prev, ok := seen[alloc.IP]; ok {
+				problems = append(problems, Problem{Network: n.Name, Kind: DuplicateIP, IP: alloc.IP,
+					Detail: fmt.Sprintf("held by %s and %s", prev, owner)})
+			}
+			seen[alloc.IP] = owner
+
+			if ip := net.ParseIP(alloc.IP); ip == nil || !im.InRange(ip) {
+				problems = append(problems, Problem{Network: n.Name, Kind: OutOfRange, IP: alloc.IP,
+					Detail: "held by " + owner})
+			}
+			if alloc.HostVeth != "" && byName[alloc.HostVeth] == nil {
+				problems = append(problems, Problem{Network: n.Name, Kind: MissingVeth, IP: alloc.IP,
+					Link: alloc.HostVeth, Detail: "container " + alloc.ContainerID})
+			}
+		}
+
+		for _, l := range untrackedVeths(n.Conf, byName, links, tracked) {
+			problems = append(problems, Problem{Network: n.Name, Kind: UntrackedVeth, Link: l,
+				Detail: "attached to bridge " + n.Conf.Bridge})
+		}
+	}
+	return problems, nil
+}
+
+// untrackedVeths lists the veths on the network's bridge that are named like
+// the plugin's host veths but recorded by no store. Other veths with the same
+// prefix, such as Docker's, are neither full length nor on the bridge.
+func untrackedVeths(conf *config.NetConf, byName map[string]netlink.Link, links []netlink.Link, tracked map[string]bool) []string {
+	br := byName[conf.Bridge]
+	if conf.Bridge == "" || br == nil {
+		return nil
+	}
+	prefix := conf.VethPrefix
+	if prefix == "" {
+		prefix = network.DefaultVethPrefix
+	}
+
+	var out []string
+	for _, l := range links {
+		attrs := l.Attrs()
+		if l.Type() != "veth" || attrs.MasterIndex != br.Attrs().Index {
+			continue
+		}
+		if len(attrs.Name) != hostVethLen || !strings.HasPrefix(attrs.Name, prefix) || tracked[attrs.Name] {
+			continue
+		}
+		out = append(out, attrs.Name)
+	}
+	sort.Strings(out)
+	return out
+}
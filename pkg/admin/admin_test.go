@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/innfi/probable-eureka/pkg/ipam"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestMain(m *testing.M) {
+	logging.InitStderr()
+	os.Exit(m.Run())
+}
+
+// writeConfDir writes a conflist for each network, named after it, whose
+// IPAM store lives in a directory of its own.
+func writeConfDir(t *testing.T, subnets map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, subnet := range subnets {
+		conf := fmt.Sprintf(`{"cniVersion":"1.0.0","name":%q,"plugins":[
+			{"type":"probable-eureka","bridge":"br-%s","ipam":{"dataDir":%q,"ranges":[[{"subnet":%q}]]}},
+			{"type":"portmap"}]}`, name, name, filepath.Join(dir, "ipam-"+name), subnet)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "10-"+name+".conflist"), []byte(conf), 0644))
+	}
+	return dir
+}
+
+func writeStore(t *testing.T, n Network, allocs []ipam.Allocation) {
+	t.Helper()
+	data, err := json.Marshal(ipam.AllocationStore{Allocations: allocs})
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(n.Conf.IPAM.DataDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(n.Conf.IPAM.DataDir, "allocations.json"), data, 0644))
+}
+
+func TestNetworks(t *testing.T) {
+	dir := writeConfDir(t, map[string]string{"blue": "10.1.0.0/24", "green": "10.2.0.0/24"})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20-other.conf"),
+		[]byte(`{"cniVersion":"1.0.0","name":"other","type":"bridge"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "30-broken.conflist"), []byte(`{`), 0644))
+
+	nets, err := Networks(dir)
+
+	assert.ErrorContains(t, err, "30-broken.conflist")
+	require.Len(t, nets, 2)
+	assert.Equal(t, "blue", nets[0].Name)
+	assert.Equal(t, "blue", nets[0].Conf.Name)
+	assert.Equal(t, "br-blue", nets[0].Conf.Bridge)
+	assert.Equal(t, "green", nets[1].Name)
+}
+
+func TestSelectAndForIP(t *testing.T) {
+	nets, err := Networks(writeConfDir(t, map[string]string{"blue": "10.1.0.0/24", "green": "10.2.0.0/24"}))
+	require.NoError(t, err)
+	writeStore(t, nets[1], []ipam.Allocation{{IP: "10.9.0.5", ContainerID: "old"}})
+
+	_, err = Select(nets, "")
+	assert.ErrorContains(t, err, "2 networks found (blue, green)")
+	n, err := Select(nets, "green")
+	require.NoError(t, err)
+	assert.Equal(t, "green", n.Name)
+
+	n, err = ForIP(nets, "", net.ParseIP("10.1.0.7"))
+	require.NoError(t, err)
+	assert.Equal(t, "blue", n.Name)
+
+	n, err = ForIP(nets, "", net.ParseIP("10.9.0.5"))
+	require.NoError(t, err)
+	assert.Equal(t, "green", n.Name, "an address outside every range belongs to the store holding it")
+
+	_, err = ForIP(nets, "", net.ParseIP("192.0.2.1"))
+	assert.ErrorContains(t, err, "0 networks")
+}
+
+func veth(name string, index, master int) netlink.Link {
+	return &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name, Index: index, MasterIndex: master}}
+}
+
+func TestCheck(t *testing.T) {
+	nets, err := Networks(writeConfDir(t, map[string]string{"blue": "10.1.0.0/24"}))
+	require.NoError(t, err)
+	writeStore(t, nets[0], []ipam.Allocation{
+		{IP: "10.1.0.2", ContainerID: "live", HostVeth: "veth00000000001"},
+		{IP: "10.1.0.3", ContainerID: "gone", HostVeth: "veth00000000002"},
+		{IP: "10.1.0.3", Reserved: true},
+		{IP: "10.9.0.4", ContainerID: "moved"},
+	})
+	links := []netlink.Link{
+		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-blue", Index: 10}},
+		veth("veth00000000001", 11, 10),
+		veth("veth00000000003", 12, 10),
+		veth("veth1234abc", 13, 10),     // not a plugin name
+		veth("veth00000000004", 14, 99), // on another bridge
+	}
+
+	problems, err := Check(nets, links)
+
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Problem{
+		{Network: "blue", Kind: MissingVeth, IP: "10.1.0.3", Link: "veth00000000002", Detail: "container gone"},
+		{Network: "blue", Kind: DuplicateIP, IP: "10.1.0.3", Detail: "held by gone and reservation"},
+		{Network: "blue", Kind: OutOfRange, IP: "10.9.0.4", Detail: "held by moved"},
+		{Network: "blue", Kind: UntrackedVeth, Link: "veth00000000003", Detail: "attached to bridge br-blue"},
+	}, problems)
+}
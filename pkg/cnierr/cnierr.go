@@ -0,0 +1,94 @@
+// Package cnierr attaches CNI error codes to errors so the runtime can tell
+// failures apart. Codes are attached where a failure is detected and the
+// error is converted to a types.Error once, when it leaves the plugin.
+package cnierr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Codes from the spec that types does not define.
+const (
+	// ErrPluginNotAvailable is returned by STATUS when ADD cannot succeed.
+	ErrPluginNotAvailable uint = 50
+	// ErrLimitedConnectivity is returned by STATUS when ADD works but pods
+	// would not get full connectivity.
+	ErrLimitedConnectivity uint = 51
+)
+
+// Plugin-specific codes; the spec reserves 100 and up for plugins.
+const (
+	// ErrPoolExhausted means every address of the IPAM range is allocated.
+	ErrPoolExhausted uint = 100
+	// ErrPortConflict means a requested host port is mapped by another
+	// container.
+	ErrPortConflict uint = 101
+	// ErrFeatureUnavailable means the config asks for a feature whose host
+	// tooling (iptables, ipset, nft) is missing.
+	ErrFeatureUnavailable uint = 102
+)
+
+type coded struct {
+	code uint
+	err  error
+}
+
+func (e *coded) Error() string { return e.err.Error() }
+func (e *coded) Unwrap() error { return e.err }
+
+// Wrap attaches code to err. A nil err stays nil.
+func Wrap(code uint, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &coded{code: code, err: err}
+}
+
+// Errorf is fmt.Errorf with a code attached.
+func Errorf(code uint, format string, args ...any) error {
+	return &coded{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// Code returns the outermost code attached to err, ErrInternal if none is.
+// Of errors joined by errors.Join, the first one carrying a code decides.
+func Code(err error) uint {
+	if code, ok := findCode(err); ok {
+		return code
+	}
+	return types.ErrInternal
+}
+
+func findCode(err error) (uint, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *coded:
+			return e.code, true
+		case *types.Error:
+			return e.Code, true
+		case interface{ Unwrap() []error }:
+			for _, member := range e.Unwrap() {
+				if code, ok := findCode(member); ok {
+					return code, true
+				}
+			}
+			return 0, false
+		}
+		err = errors.Unwrap(err)
+	}
+	return 0, false
+}
+
+// ToCNI converts err for the runtime, keeping the full message: skel would
+// otherwise unwrap to an inner types.Error and drop the context around it.
+func ToCNI(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*types.Error); ok {
+		return e
+	}
+	return types.NewError(Code(err), err.Error(), "")
+}
@@ -0,0 +1,43 @@
+package cnierr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode(t *testing.T) {
+	pool := Errorf(ErrPoolExhausted, "no available IP addresses in range")
+
+	assert.Equal(t, ErrPoolExhausted, Code(pool))
+	assert.Equal(t, ErrPoolExhausted, Code(fmt.Errorf("bind: %w", pool)))
+	assert.Equal(t, ErrPluginNotAvailable, Code(Wrap(ErrPluginNotAvailable, pool)), "the outermost code wins")
+	assert.Equal(t, types.ErrInvalidNetNS, Code(fmt.Errorf("x: %w", types.NewError(types.ErrInvalidNetNS, "gone", ""))))
+	assert.Equal(t, types.ErrInternal, Code(errors.New("plain")))
+	assert.NoError(t, Wrap(ErrPortConflict, nil))
+}
+
+func TestCode_Joined(t *testing.T) {
+	pool := Errorf(ErrPoolExhausted, "no available IP addresses in range")
+	conflict := Errorf(ErrPortConflict, "tcp/80 is already mapped")
+
+	assert.Equal(t, ErrPoolExhausted, Code(errors.Join(errors.New("plain"), pool, conflict)), "the first coded member wins")
+	assert.Equal(t, ErrPortConflict, Code(fmt.Errorf("teardown: %w", errors.Join(errors.New("plain"), fmt.Errorf("x: %w", conflict)))))
+	assert.Equal(t, ErrPoolExhausted, Code(fmt.Errorf("%w; %w", errors.New("plain"), pool)))
+	assert.Equal(t, types.ErrInternal, Code(errors.Join(errors.New("a"), errors.New("b"))))
+}
+
+func TestToCNI_KeepsTheWholeMessage(t *testing.T) {
+	err := fmt.Errorf("failed to map host ports: %w", Errorf(ErrPortConflict, "tcp/80 is already mapped"))
+
+	got := ToCNI(err)
+
+	var e *types.Error
+	assert.ErrorAs(t, got, &e)
+	assert.Equal(t, ErrPortConflict, e.Code)
+	assert.Equal(t, "failed to map host ports: tcp/80 is already mapped", e.Msg)
+	assert.NoError(t, ToCNI(nil))
+}
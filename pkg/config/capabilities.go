@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strings"
+)
+
+// PodSysctls lists the keys the sysctl map may set inside the pod netns.
+// All of them are namespaced, so they cannot affect the host or other pods.
+// A "*" segment matches any single segment, i.e. any interface name.
+var PodSysctls = []string{
+	"net.core.somaxconn",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.tcp_fin_timeout",
+	"net.ipv4.tcp_keepalive_intvl",
+	"net.ipv4.tcp_keepalive_probes",
+	"net.ipv4.tcp_keepalive_time",
+	"net.ipv4.tcp_syncookies",
+	"net.ipv4.tcp_tw_reuse",
+	"net.ipv4.conf.*.arp_ignore",
+	"net.ipv4.conf.*.arp_announce",
+	"net.ipv4.conf.*.rp_filter",
+	"net.ipv6.conf.*.accept_ra",
+	"net.ipv6.conf.*.accept_dad",
+	"net.ipv6.conf.*.disable_ipv6",
+}
+
+// HostVethSysctls maps the keys of the hostSysctl map to the sysctl they set
+// on the host veth.
+var HostVethSysctls = map[string]string{
+	"proxy_arp":      "net.ipv4.conf.%s.proxy_arp",
+	"rp_filter":      "net.ipv4.conf.%s.rp_filter",
+	"route_localnet": "net.ipv4.conf.%s.route_localnet",
+	"accept_ra":      "net.ipv6.conf.%s.accept_ra",
+	"disable_ipv6":   "net.ipv6.conf.%s.disable_ipv6",
+}
+
+// CheckSysctl fails unless the sysctl map may set key.
+func CheckSysctl(key string) error {
+	if !slices.ContainsFunc(PodSysctls, func(pattern string) bool { return sysctlMatches(pattern, key) }) {
+		return fmt.Errorf("sysctl %q is not allowed", key)
+	}
+	return nil
+}
+
+// CheckHostSysctl fails unless the hostSysctl map may set key.
+func CheckHostSysctl(key string) error {
+	if _, ok := HostVethSysctls[key]; !ok {
+		return fmt.Errorf("host sysctl %q is not allowed", key)
+	}
+	return nil
+}
+
+// sysctlMatches compares dot-separated keys segment by segment.
+func sysctlMatches(pattern, key string) bool {
+	p, k := strings.Split(pattern, "."), strings.Split(key, ".")
+	if len(p) != len(k) {
+		return false
+	}
+	for i := range p {
+		if p[i] != "*" && p[i] != k[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseMAC parses the mac capability. net.ParseMAC also takes EUI-64 and
+// InfiniBand addresses, and neither they nor a multicast address can be set
+// on a veth, so only 6-byte unicast addresses are accepted.
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q: %v", s, err)
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q: not a 6-byte Ethernet address", s)
+	}
+	if mac[0]&1 != 0 {
+		return nil, fmt.Errorf("invalid MAC address %q: multicast", s)
+	}
+	return mac, nil
+}
+
+// Check rejects limits the kernel cannot express: a rate needs a burst, and
+// the burst in bytes must fit TBF's 32-bit buffer. A nil entry is valid.
+func (bw *BandwidthEntry) Check() error {
+	if problems := bw.problems(); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+func (bw *BandwidthEntry) problems() []error {
+	if bw == nil {
+		return nil
+	}
+	var out []error
+	for _, dir := range []struct {
+		name        string
+		rate, burst uint64
+	}{
+		{"ingress", bw.IngressRate, bw.IngressBurst},
+		{"egress", bw.EgressRate, bw.EgressBurst},
+	} {
+		if dir.rate == 0 {
+			continue
+		}
+		if dir.burst == 0 {
+			out = append(out, fmt.Errorf("%s bandwidth rate %d needs a burst", dir.name, dir.rate))
+		} else if dir.burst/8 > math.MaxUint32 {
+			out = append(out, fmt.Errorf("%s bandwidth burst %d is too large", dir.name, dir.burst))
+		}
+	}
+	return out
+}
+
+// Check rejects a mapping the firewall cannot install. The protocol
+// defaults to tcp, and an empty host IP means every address.
+func (pm PortMapping) Check() error {
+	switch strings.ToLower(pm.Protocol) {
+	case "", "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("invalid port mapping protocol %q", pm.Protocol)
+	}
+	if pm.HostPort < 1 || pm.HostPort > 65535 || pm.ContainerPort < 1 || pm.ContainerPort > 65535 {
+		return fmt.Errorf("invalid port mapping %d:%d", pm.HostPort, pm.ContainerPort)
+	}
+	if pm.HostIP != "" && net.ParseIP(pm.HostIP) == nil {
+		return fmt.Errorf("invalid port mapping host IP %q", pm.HostIP)
+	}
+	return nil
+}
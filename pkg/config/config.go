@@ -1,11 +1,214 @@
 package config
 
-import "github.com/containernetworking/cni/pkg/types"
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
 
 type NetConf struct {
 	types.NetConf
-	Bridge string      `json:"bridge"`
-	IPAM   *IPAMConfig `json:"ipam"`
+	Bridge                string   `json:"bridge"`
+	DeleteBridgeWhenEmpty bool     `json:"deleteBridgeWhenEmpty,omitempty"`
+	VethPrefix            string   `json:"vethPrefix,omitempty"`
+	MTU                   int      `json:"mtu,omitempty"`
+	MacFromIP             bool     `json:"macFromIP,omitempty"`
+	GARPCount             *int     `json:"garpCount,omitempty"`
+	FirewallBackend       string   `json:"firewallBackend,omitempty"`
+	IPMasq                *bool    `json:"ipMasq,omitempty"`
+	NonMasqueradeCIDRs    []string `json:"nonMasqueradeCIDRs,omitempty"`
+	SNATIPs               []string `json:"snatIPs,omitempty"`
+	SpoofCheck            bool     `json:"spoofCheck,omitempty"`
+	// Sysctl is applied inside the pod netns; HostSysctl on the host veth.
+	Sysctl        map[string]string `json:"sysctl,omitempty"`
+	HostSysctl    map[string]string `json:"hostSysctl,omitempty"`
+	Policy        *PolicyConfig     `json:"policy,omitempty"`
+	LogFile       string            `json:"logFile,omitempty"`
+	LogLevel      string            `json:"logLevel,omitempty"`
+	LogFormat     string            `json:"logFormat,omitempty"`
+	LogMaxSizeMB  int               `json:"logMaxSizeMB,omitempty"`
+	LogMaxBackups int               `json:"logMaxBackups,omitempty"`
+	// MetricsFile is the node-exporter textfile the plugin keeps its
+	// metrics in; empty disables metrics.
+	MetricsFile   string           `json:"metricsFile,omitempty"`
+	Tracing       *TracingConfig   `json:"tracing,omitempty"`
+	Reconcile     *ReconcileConfig `json:"reconcile,omitempty"`
+	GC            *GCConfig        `json:"gc,omitempty"`
+	RuntimeConfig RuntimeConfig    `json:"runtimeConfig,omitempty"`
+	IPAM          *IPAMConfig      `json:"ipam"`
+
+	// PodLabels, PodPolicy and TraceParent come from CNI_ARGS, not from the
+	// config file.
+	PodLabels   map[string]string `json:"-"`
+	PodPolicy   string            `json:"-"`
+	TraceParent string            `json:"-"`
+}
+
+// TracingConfig exports OpenTelemetry spans for each command.
+type TracingConfig struct {
+	// Endpoint is an OTLP/HTTP collector, as host:port or a URL.
+	Endpoint string `json:"endpoint,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	// File appends spans as JSON for offline analysis.
+	File string `json:"file,omitempty"`
+	// FlushTimeoutMs bounds how long the plugin waits at exit to hand
+	// spans to Endpoint; nil means the plugin's default.
+	FlushTimeoutMs *int `json:"flushTimeoutMs,omitempty"`
+}
+
+// ReconcileConfig frees the allocations of pods that are gone from the node
+// when the plugin runs STATUS or GC, for runtimes whose GC leaves them
+// behind or that never send one.
+type ReconcileConfig struct {
+	OnStatus bool `json:"onStatus,omitempty"`
+	OnGC     bool `json:"onGC,omitempty"`
+	// DryRun logs what would be freed instead of freeing it.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// GCConfig tunes the GC command.
+type GCConfig struct {
+	// GracePeriodSeconds spares attachments allocated this recently, whose
+	// ADD may still be in flight; nil means the plugin's default.
+	GracePeriodSeconds *int `json:"gracePeriodSeconds,omitempty"`
+	// DryRun logs what would be removed instead of removing it.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// PolicyConfig enables pod network policy enforcement.
+type PolicyConfig struct {
+	// File is an optional policy file whose policies select pods by label.
+	File string `json:"file,omitempty"`
+	// DryRun logs the generated rules instead of installing them.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// RuntimeConfig holds the capability arguments injected by the runtime.
+type RuntimeConfig struct {
+	Mac          string          `json:"mac,omitempty"`
+	PortMappings []PortMapping   `json:"portMappings,omitempty"`
+	Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
+	DNS          *RuntimeDNS     `json:"dns,omitempty"`
+}
+
+// RuntimeDNS is the dns capability, in the runtime's field names.
+type RuntimeDNS struct {
+	Servers  []string `json:"servers,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// BandwidthEntry is the bandwidth capability. Rates are in bits per second
+// and bursts in bits; a zero rate leaves that direction unshaped.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// PortMapping is one entry of the portMappings capability.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// EnvArgs are the CNI_ARGS keys understood by the plugin.
+type EnvArgs struct {
+	types.CommonArgs
+	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	// POD_LABELS is a comma-separated list of key:value pod labels.
+	POD_LABELS types.UnmarshallableString
+	// POD_POLICY is an inline policy in the syntax of policy.ParseInline.
+	POD_POLICY types.UnmarshallableString
+	// TRACEPARENT is the W3C traceparent of the runtime's span.
+	TRACEPARENT types.UnmarshallableString
+}
+
+// Load parses the network configuration and merges CNI_ARGS overrides into it.
+func Load(stdin []byte, envArgs string) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, cnierr.Errorf(types.ErrDecodingFailure, "failed to parse config: %v", err)
+	}
+
+	if envArgs != "" {
+		e := EnvArgs{}
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return nil, cnierr.Errorf(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS: %v", err)
+		}
+		if e.MAC != "" {
+			conf.RuntimeConfig.Mac = string(e.MAC)
+		}
+		if e.POD_LABELS != "" {
+			labels, err := parseLabels(string(e.POD_LABELS))
+			if err != nil {
+				return nil, err
+			}
+			conf.PodLabels = labels
+		}
+		conf.PodPolicy = string(e.POD_POLICY)
+		conf.TraceParent = string(e.TRACEPARENT)
+	}
+
+	for _, ns := range conf.ResultDNS().Nameservers {
+		if err := checkNameserver(ns); err != nil {
+			return nil, cnierr.Errorf(types.ErrInvalidNetworkConfig, "invalid DNS nameserver: %v", err)
+		}
+	}
+
+	return conf, nil
+}
+
+// checkNameserver fails unless ns is an IP address, the only form
+// resolv.conf accepts.
+func checkNameserver(ns string) error {
+	if net.ParseIP(ns) == nil {
+		return fmt.Errorf("%q is not an IP address", ns)
+	}
+	return nil
+}
+
+// ResultDNS is the DNS configuration returned to the runtime: the network's
+// dns block, falling back to the ipam one, with each field the runtime
+// passes in runtimeConfig.dns replacing the configured one.
+func (c *NetConf) ResultDNS() types.DNS {
+	dns := c.DNS
+	if dns.IsEmpty() && c.IPAM != nil && c.IPAM.DNS != nil {
+		dns = *c.IPAM.DNS
+	}
+	if rt := c.RuntimeConfig.DNS; rt != nil {
+		if len(rt.Servers) > 0 {
+			dns.Nameservers = rt.Servers
+		}
+		if len(rt.Searches) > 0 {
+			dns.Search = rt.Searches
+		}
+		if len(rt.Options) > 0 {
+			dns.Options = rt.Options
+		}
+	}
+	return dns
+}
+
+// parseLabels parses "key:value,key:value"; CNI_ARGS values cannot contain '='.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, ":")
+		if !ok || k == "" {
+			return nil, cnierr.Errorf(types.ErrInvalidEnvironmentVariables, "invalid POD_LABELS entry %q", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
 }
 
 type IPAMConfig struct {
@@ -13,6 +216,8 @@ type IPAMConfig struct {
 	DataDir string    `json:"dataDir"`
 	Ranges  [][]Range `json:"ranges"`
 	Routes  []Route   `json:"routes"`
+	// DNS is used when the network config has no dns block of its own.
+	DNS *types.DNS `json:"dns,omitempty"`
 }
 
 type Range struct {
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_CNIArgsOverrideRuntimeConfigMac(t *testing.T) {
+	stdin := []byte(`{"cniVersion":"1.0.0","name":"eureka","bridge":"cni0","runtimeConfig":{"mac":"02:00:00:00:00:01"}}`)
+
+	conf, err := Load(stdin, "")
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:01", conf.RuntimeConfig.Mac)
+
+	conf, err = Load(stdin, "IgnoreUnknown=1;K8S_POD_NAME=web;MAC=02:00:00:00:00:02")
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:02", conf.RuntimeConfig.Mac)
+}
+
+func TestLoad_InvalidJSON(t *testing.T) {
+	_, err := Load([]byte(`{`), "")
+	assert.Error(t, err)
+}
+
+func TestLoad_PolicyArgs(t *testing.T) {
+	stdin := []byte(`{"cniVersion":"1.0.0","name":"eureka","policy":{"file":"/etc/cni/eureka-policy.json"}}`)
+
+	conf, err := Load(stdin, "IgnoreUnknown=1;POD_LABELS=app:web,tier:frontend;POD_POLICY=in:10.0.0.0/8@tcp/80")
+
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/cni/eureka-policy.json", conf.Policy.File)
+	assert.Equal(t, map[string]string{"app": "web", "tier": "frontend"}, conf.PodLabels)
+	assert.Equal(t, "in:10.0.0.0/8@tcp/80", conf.PodPolicy)
+
+	_, err = Load(stdin, "POD_LABELS=app")
+	assert.Error(t, err)
+}
+
+func TestLoad_DNS(t *testing.T) {
+	t.Run("network block wins over ipam", func(t *testing.T) {
+		stdin := []byte(`{"cniVersion":"1.0.0","name":"eureka",
+			"dns":{"nameservers":["10.96.0.10"],"domain":"cluster.local","search":["default.svc.cluster.local"]},
+			"ipam":{"dns":{"nameservers":["8.8.8.8"]}}}`)
+
+		conf, err := Load(stdin, "")
+
+		require.NoError(t, err)
+		assert.Equal(t, types.DNS{
+			Nameservers: []string{"10.96.0.10"},
+			Domain:      "cluster.local",
+			Search:      []string{"default.svc.cluster.local"},
+		}, conf.ResultDNS())
+	})
+
+	t.Run("ipam block is the fallback", func(t *testing.T) {
+		stdin := []byte(`{"cniVersion":"1.0.0","name":"eureka","ipam":{"dns":{"nameservers":["8.8.8.8"]}}}`)
+
+		conf, err := Load(stdin, "")
+
+		require.NoError(t, err)
+		assert.Equal(t, types.DNS{Nameservers: []string{"8.8.8.8"}}, conf.ResultDNS())
+	})
+
+	t.Run("runtime config overrides per field", func(t *testing.T) {
+		stdin := []byte(`{"cniVersion":"1.0.0","name":"eureka",
+			"dns":{"nameservers":["10.96.0.10"],"domain":"cluster.local","options":["ndots:5"]},
+			"runtimeConfig":{"dns":{"servers":["1.1.1.1"],"searches":["svc.cluster.local"]}}}`)
+
+		conf, err := Load(stdin, "")
+
+		require.NoError(t, err)
+		assert.Equal(t, types.DNS{
+			Nameservers: []string{"1.1.1.1"},
+			Domain:      "cluster.local",
+			Search:      []string{"svc.cluster.local"},
+			Options:     []string{"ndots:5"},
+		}, conf.ResultDNS())
+	})
+
+	t.Run("rejects a bad nameserver", func(t *testing.T) {
+		_, err := Load([]byte(`{"cniVersion":"1.0.0","name":"eureka","dns":{"nameservers":["dns.example"]}}`), "")
+		assert.ErrorContains(t, err, "invalid DNS nameserver")
+	})
+}
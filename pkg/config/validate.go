@@ -0,0 +1,424 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// MaxIfNameLen is IFNAMSIZ minus the trailing NUL.
+	MaxIfNameLen = 15
+	// MinVethHashLen keeps enough hash characters in host veth names to
+	// make collisions negligible.
+	MinVethHashLen = 8
+	// MaxVethPrefixLen leaves room for the hash in host veth names.
+	MaxVethPrefixLen = MaxIfNameLen - MinVethHashLen
+)
+
+// Validate checks the network config passed on stdin and reports every
+// problem it finds in one invalid-config error: unknown keys, values of the
+// wrong type, and values that are individually or jointly wrong, such as a
+// gateway outside its subnet or two overlapping ranges.
+func Validate(stdin []byte) error {
+	var v validator
+	conf := v.decode(stdin)
+	if conf != nil {
+		v.check(conf)
+	}
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return types.NewError(types.ErrInvalidNetworkConfig, "invalid network config", strings.Join(v.problems, "; "))
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// decode fills a NetConf field by field, so that one key of the wrong type
+// is reported without hiding the problems of the others.
+func (v *validator) decode(stdin []byte) *NetConf {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(stdin, &raw); err != nil {
+		v.addf("not a JSON object: %v", err)
+		return nil
+	}
+
+	conf := &NetConf{}
+	val := reflect.ValueOf(conf).Elem()
+	fields := jsonFields(val.Type())
+	for _, key := range sortedRawKeys(raw) {
+		f, ok := fields[key]
+		if !ok {
+			if !runtimeKey(key) {
+				v.addf("unknown key %q", key)
+			}
+			continue
+		}
+		target := reflect.New(f.typ)
+		if err := json.Unmarshal(raw[key], target.Interface()); err != nil {
+			v.addf("%s: %s", key, typeProblem(err))
+			continue
+		}
+		val.FieldByIndex(f.index).Set(target.Elem())
+		v.unknownNested(key, raw[key], f.typ)
+	}
+	return conf
+}
+
+// runtimeKey reports keys the runtime adds to the plugin config.
+func runtimeKey(key string) bool {
+	return key == "args" || strings.HasPrefix(key, "cni.dev/")
+}
+
+// unknownNested reports unknown keys inside the config's own objects. The
+// runtimeConfig and map-typed values are the runtime's or free-form.
+func (v *validator) unknownNested(path string, raw json.RawMessage, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(RuntimeConfig{}) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil {
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedRawKeys(obj) {
+			f, ok := fields[key]
+			if !ok {
+				v.addf("unknown key %q in %s", key, path)
+				continue
+			}
+			v.unknownNested(path+"."+key, obj[key], f.typ)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return
+		}
+		for i, item := range items {
+			v.unknownNested(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())
+		}
+	}
+}
+
+type jsonField struct {
+	index []int
+	typ   reflect.Type
+}
+
+// jsonFields maps the JSON keys of struct type t to its fields. As in
+// encoding/json, a field of t hides one of the same name in an embedded struct.
+func jsonFields(t reflect.Type) map[string]jsonField {
+	out := make(map[string]jsonField)
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			embedded = append(embedded, f)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out[name] = jsonField{index: f.Index, typ: f.Type}
+	}
+	for _, e := range embedded {
+		for name, f := range jsonFields(e.Type) {
+			if _, ok := out[name]; !ok {
+				out[name] = jsonField{index: append([]int{e.Index[0]}, f.index...), typ: f.typ}
+			}
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func typeProblem(err error) string {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		where := ""
+		if te.Field != "" {
+			where = " at " + te.Field
+		}
+		return fmt.Sprintf("expected %s%s, got %s", te.Type, where, te.Value)
+	}
+	return err.Error()
+}
+
+func (v *validator) check(c *NetConf) {
+	if c.Name == "" {
+		v.addf("name: required")
+	}
+	if c.Bridge != "" {
+		v.checkIfName("bridge", c.Bridge)
+	}
+	if len(c.VethPrefix) > MaxVethPrefixLen {
+		v.addf("vethPrefix: %q is longer than %d characters", c.VethPrefix, MaxVethPrefixLen)
+	}
+	if c.MTU != 0 && (c.MTU < 68 || c.MTU > 65535) {
+		v.addf("mtu: %d is outside 68-65535", c.MTU)
+	}
+	if c.GARPCount != nil && *c.GARPCount < 0 {
+		v.addf("garpCount: must not be negative")
+	}
+	if c.GC != nil && c.GC.GracePeriodSeconds != nil && *c.GC.GracePeriodSeconds < 0 {
+		v.addf("gc.gracePeriodSeconds: must not be negative")
+	}
+	if c.Tracing != nil && c.Tracing.FlushTimeoutMs != nil && *c.Tracing.FlushTimeoutMs < 0 {
+		v.addf("tracing.flushTimeoutMs: must not be negative")
+	}
+	switch c.FirewallBackend {
+	case "", "auto", "iptables", "nftables":
+	default:
+		v.addf("firewallBackend: %q is not one of auto, iptables, nftables", c.FirewallBackend)
+	}
+	for i, s := range c.NonMasqueradeCIDRs {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			v.addf("nonMasqueradeCIDRs[%d]: %q is not a CIDR", i, s)
+		}
+	}
+	families := make(map[bool]int)
+	for i, s := range c.SNATIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			v.addf("snatIPs[%d]: %q is not an IP address", i, s)
+			continue
+		}
+		if families[ip.To4() != nil]++; families[ip.To4() != nil] == 2 {
+			v.addf("snatIPs: more than one address of the family of %s", s)
+		}
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "warning", "error":
+	default:
+		v.addf("logLevel: %q is not one of debug, info, warn, error", c.LogLevel)
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "json", "text":
+	default:
+		v.addf("logFormat: %q is not one of json, text", c.LogFormat)
+	}
+	if c.LogMaxSizeMB < 0 || c.LogMaxBackups < 0 {
+		v.addf("logMaxSizeMB and logMaxBackups must not be negative")
+	}
+	v.checkNameservers("dns.nameservers", c.DNS.Nameservers)
+	for _, key := range sortedKeys(c.Sysctl) {
+		if err := CheckSysctl(key); err != nil {
+			v.addf("sysctl: %v", err)
+		}
+	}
+	for _, key := range sortedKeys(c.HostSysctl) {
+		if err := CheckHostSysctl(key); err != nil {
+			v.addf("hostSysctl: %v", err)
+		}
+	}
+	v.checkRuntimeConfig(&c.RuntimeConfig)
+	v.checkIPAM(c.IPAM)
+}
+
+// checkRuntimeConfig checks the capability arguments the runtime passed.
+func (v *validator) checkRuntimeConfig(rc *RuntimeConfig) {
+	if rc.Mac != "" {
+		if _, err := ParseMAC(rc.Mac); err != nil {
+			v.addf("runtimeConfig.mac: %v", err)
+		}
+	}
+	for i, pm := range rc.PortMappings {
+		if err := pm.Check(); err != nil {
+			v.addf("runtimeConfig.portMappings[%d]: %v", i, err)
+		}
+	}
+	for _, err := range rc.Bandwidth.problems() {
+		v.addf("runtimeConfig.bandwidth: %v", err)
+	}
+}
+
+func (v *validator) checkNameservers(field string, nameservers []string) {
+	for i, ns := range nameservers {
+		if err := checkNameserver(ns); err != nil {
+			v.addf("%s[%d]: %v", field, i, err)
+		}
+	}
+}
+
+func (v *validator) checkIfName(field, name string) {
+	if len(name) > MaxIfNameLen {
+		v.addf("%s: %q is longer than %d characters", field, name, MaxIfNameLen)
+	}
+	if strings.ContainsAny(name, "/: \t\n") || name == "." || name == ".." {
+		v.addf("%s: %q is not a valid interface name", field, name)
+	}
+}
+
+type parsedRange struct {
+	path       string
+	start, end net.IP
+}
+
+func (v *validator) checkIPAM(ipam *IPAMConfig) {
+	if ipam == nil {
+		v.addf("ipam: required")
+		return
+	}
+	if len(ipam.Ranges) == 0 {
+		v.addf("ipam.ranges: at least one range is required")
+	}
+
+	var parsed []parsedRange
+	for i, set := range ipam.Ranges {
+		if len(set) == 0 {
+			v.addf("ipam.ranges[%d]: empty range set", i)
+		}
+		for j, r := range set {
+			path := fmt.Sprintf("ipam.ranges[%d][%d]", i, j)
+			if pr, ok := v.checkRange(path, r); ok {
+				parsed = append(parsed, pr)
+			}
+		}
+	}
+	for i := range parsed {
+		for j := i + 1; j < len(parsed); j++ {
+			a, b := parsed[i], parsed[j]
+			if sameFamily(a.start, b.start) && bytes.Compare(a.start.To16(), b.end.To16()) <= 0 &&
+				bytes.Compare(b.start.To16(), a.end.To16()) <= 0 {
+				v.addf("%s overlaps %s", a.path, b.path)
+			}
+		}
+	}
+
+	for i, r := range ipam.Routes {
+		path := fmt.Sprintf("ipam.routes[%d]", i)
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			v.addf("%s.dst: %q is not a CIDR", path, r.Dst)
+		}
+		if r.Gw == "" {
+			continue
+		}
+		gw := net.ParseIP(r.Gw)
+		if gw == nil {
+			v.addf("%s.gw: %q is not an IP address", path, r.Gw)
+		} else if dst != nil && !sameFamily(gw, dst.IP) {
+			v.addf("%s.gw: %s is not of the family of %s", path, r.Gw, r.Dst)
+		}
+	}
+	if ipam.DNS != nil {
+		v.checkNameservers("ipam.dns.nameservers", ipam.DNS.Nameservers)
+	}
+}
+
+// checkRange validates one range and returns its resolved bounds.
+func (v *validator) checkRange(path string, r Range) (parsedRange, bool) {
+	_, subnet, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		v.addf("%s.subnet: %q is not a CIDR", path, r.Subnet)
+		return parsedRange{}, false
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		v.addf("%s.subnet: %s has no room for pod addresses", path, r.Subnet)
+		return parsedRange{}, false
+	}
+
+	inSubnet := func(field, s string) (net.IP, bool) {
+		if s == "" {
+			return nil, true
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			v.addf("%s.%s: %q is not an IP address", path, field, s)
+			return nil, false
+		}
+		if !subnet.Contains(ip) {
+			v.addf("%s.%s: %s is outside %s", path, field, s, subnet)
+			return nil, false
+		}
+		return ip, true
+	}
+	start, okStart := inSubnet("rangeStart", r.RangeStart)
+	end, okEnd := inSubnet("rangeEnd", r.RangeEnd)
+	gw, okGw := inSubnet("gateway", r.Gateway)
+	if !okStart || !okEnd || !okGw {
+		return parsedRange{}, false
+	}
+
+	if start == nil {
+		start = offsetIP(subnet.IP, 1)
+	}
+	if end == nil {
+		end = lastUsable(subnet)
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		v.addf("%s: rangeStart %s is after rangeEnd %s", path, start, end)
+		return parsedRange{}, false
+	}
+	// The IPAM skips the gateway of a range left at its default bounds; a
+	// range narrowed by hand is expected to leave it out.
+	narrowed := r.RangeStart != "" || r.RangeEnd != ""
+	if gw != nil && narrowed && bytes.Compare(start.To16(), gw.To16()) <= 0 && bytes.Compare(gw.To16(), end.To16()) <= 0 {
+		v.addf("%s.gateway: %s is inside %s-%s, but it is the bridge's address", path, gw, start, end)
+	}
+	return parsedRange{path: path, start: start, end: end}, true
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+func offsetIP(ip net.IP, n byte) net.IP {
+	out := append(net.IP{}, ip.To16()...)
+	out[len(out)-1] += n
+	return out
+}
+
+// lastUsable is the address before the subnet's broadcast address, as the
+// IPAM defaults rangeEnd to.
+func lastUsable(subnet *net.IPNet) net.IP {
+	ip := append(net.IP{}, subnet.IP...)
+	for i := range ip {
+		ip[i] |= ^subnet.Mask[i]
+	}
+	ip[len(ip)-1]--
+	return ip.To16()
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConf = `{
+	"cniVersion": "1.0.0",
+	"name": "eureka",
+	"type": "probable-eureka",
+	"bridge": "cni0",
+	"mtu": 1500,
+	"capabilities": {"portMappings": true},
+	"runtimeConfig": {"portMappings": [{"hostPort": 8080, "containerPort": 80}], "futureCapability": {}},
+	"cni.dev/valid-attachments": [],
+	"ipam": {
+		"type": "host-local",
+		"ranges": [
+			[{"subnet": "10.244.0.0/24", "gateway": "10.244.0.1"}],
+			[{"subnet": "fd00::/64", "rangeStart": "fd00::10", "rangeEnd": "fd00::ff"}]
+		],
+		"routes": [{"dst": "0.0.0.0/0", "gw": "10.244.0.1"}]
+	}
+}`
+
+func validationProblems(t *testing.T, stdin string) string {
+	t.Helper()
+	err := Validate([]byte(stdin))
+	require.Error(t, err)
+	var e *types.Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, uint(types.ErrInvalidNetworkConfig), e.Code)
+	return e.Details
+}
+
+func TestValidate_AcceptsValidConfig(t *testing.T) {
+	assert.NoError(t, Validate([]byte(validConf)))
+}
+
+func TestValidate_AcceptsShippedConflist(t *testing.T) {
+	data, err := os.ReadFile("../../deployments/10-eureka.conflist")
+	require.NoError(t, err)
+	var list struct {
+		Plugins []map[string]any `json:"plugins"`
+	}
+	require.NoError(t, json.Unmarshal(data, &list))
+	require.NotEmpty(t, list.Plugins)
+
+	plugin := list.Plugins[0]
+	plugin["cniVersion"] = "1.0.0"
+	plugin["name"] = "eureka"
+	stdin, err := json.Marshal(plugin)
+	require.NoError(t, err)
+	assert.NoError(t, Validate(stdin))
+}
+
+func TestValidate_RequiresIPAM(t *testing.T) {
+	details := validationProblems(t, `{"cniVersion":"1.0.0","name":"eureka"}`)
+	assert.Contains(t, details, "ipam: required")
+
+	details = validationProblems(t, `{"cniVersion":"1.0.0","name":"eureka","ipam":{}}`)
+	assert.Contains(t, details, "ipam.ranges: at least one range is required")
+}
+
+func TestValidate_ReportsEveryProblem(t *testing.T) {
+	details := validationProblems(t, `{
+		"cniVersion": "1.0.0",
+		"name": "eureka",
+		"brigde": "cni0",
+		"garpCount": "3",
+		"ipam": {
+			"ranges": [
+				[{"subnet": "10.0.0.0/24", "gateway": "10.0.1.1", "gatway": "10.0.0.1"}],
+				[{"subnet": "10.0.0.128/25"}]
+			],
+			"routes": [{"dst": "default"}]
+		}
+	}`)
+
+	assert.Contains(t, details, `unknown key "brigde"`)
+	assert.Contains(t, details, `unknown key "gatway" in ipam.ranges[0][0]`)
+	assert.Contains(t, details, "garpCount: expected int")
+	assert.Contains(t, details, "ipam.ranges[0][0].gateway: 10.0.1.1 is outside 10.0.0.0/24")
+	assert.Contains(t, details, `ipam.routes[0].dst: "default" is not a CIDR`)
+}
+
+func TestValidate_Ranges(t *testing.T) {
+	details := validationProblems(t, `{"name":"eureka","ipam":{"ranges":[
+		[{"subnet": "10.0.0.0/24", "rangeStart": "10.0.0.100", "rangeEnd": "10.0.0.10"}],
+		[{"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.10", "rangeEnd": "10.1.0.100"}],
+		[{"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.100", "rangeEnd": "10.1.0.200"}],
+		[{"subnet": "10.2.0.0/24", "rangeStart": "fd00::1"}],
+		[{"subnet": "10.3.0.0/24", "rangeStart": "10.3.0.1", "rangeEnd": "10.3.0.50", "gateway": "10.3.0.1"}],
+		[{"subnet": "10.4.0.0/24", "rangeStart": "10.4.0.10", "gateway": "10.4.0.1"}]
+	]}}`)
+
+	assert.Contains(t, details, "ipam.ranges[0][0]: rangeStart 10.0.0.100 is after rangeEnd 10.0.0.10")
+	assert.Contains(t, details, "ipam.ranges[1][0] overlaps ipam.ranges[2][0]")
+	assert.Contains(t, details, "ipam.ranges[3][0].rangeStart: fd00::1 is outside 10.2.0.0/24")
+	assert.Contains(t, details, "ipam.ranges[4][0].gateway: 10.3.0.1 is inside 10.3.0.1-10.3.0.50, but it is the bridge's address")
+	assert.NotContains(t, details, "ipam.ranges[5][0]")
+}
+
+func TestValidate_RuntimeConfigAndSysctls(t *testing.T) {
+	details := validationProblems(t, `{"name":"eureka",
+		"sysctl": {"net.ipv4.ip_forward": "1", "net.core.somaxconn": "1024"},
+		"hostSysctl": {"forwarding": "1"},
+		"runtimeConfig": {
+			"mac": "not-a-mac",
+			"portMappings": [
+				{"hostPort": 8080, "containerPort": 80, "protocol": "icmp"},
+				{"hostPort": 0, "containerPort": 80},
+				{"hostPort": 8443, "containerPort": 443, "hostIP": "localhost"}
+			],
+			"bandwidth": {"ingressRate": 1000, "egressRate": 1000, "egressBurst": 400000000000}
+		},
+		"ipam": {"ranges": [[{"subnet": "10.0.0.0/24"}]]}}`)
+
+	assert.Contains(t, details, `sysctl: sysctl "net.ipv4.ip_forward" is not allowed`)
+	assert.NotContains(t, details, "somaxconn")
+	assert.Contains(t, details, `hostSysctl: host sysctl "forwarding" is not allowed`)
+	assert.Contains(t, details, `runtimeConfig.mac: invalid MAC address "not-a-mac"`)
+	assert.Contains(t, details, `runtimeConfig.portMappings[0]: invalid port mapping protocol "icmp"`)
+	assert.Contains(t, details, "runtimeConfig.portMappings[1]: invalid port mapping 0:80")
+	assert.Contains(t, details, `runtimeConfig.portMappings[2]: invalid port mapping host IP "localhost"`)
+	assert.Contains(t, details, "runtimeConfig.bandwidth: ingress bandwidth rate 1000 needs a burst")
+	assert.Contains(t, details, "runtimeConfig.bandwidth: egress bandwidth burst 400000000000 is too large")
+}
+
+func TestValidate_Fields(t *testing.T) {
+	details := validationProblems(t, `{"name":"eureka",
+		"bridge": "a-very-long-bridge-name",
+		"mtu": 20,
+		"firewallBackend": "pf",
+		"snatIPs": ["192.0.2.1", "192.0.2.2"],
+		"logLevel": "loud",
+		"dns": {"nameservers": ["dns.example"]},
+		"gc": {"gracePeriodSeconds": -1},
+		"tracing": {"flushTimeoutMs": -1},
+		"ipam": {"ranges": [[{"subnet": "10.0.0.0/24"}]]}}`)
+
+	assert.Contains(t, details, `bridge: "a-very-long-bridge-name" is longer than 15 characters`)
+	assert.Contains(t, details, "mtu: 20 is outside 68-65535")
+	assert.Contains(t, details, `firewallBackend: "pf"`)
+	assert.Contains(t, details, "snatIPs: more than one address of the family of 192.0.2.2")
+	assert.Contains(t, details, `logLevel: "loud"`)
+	assert.Contains(t, details, `dns.nameservers[0]: "dns.example" is not an IP address`)
+	assert.Contains(t, details, "gc.gracePeriodSeconds: must not be negative")
+	assert.Contains(t, details, "tracing.flushTimeoutMs: must not be negative")
+}
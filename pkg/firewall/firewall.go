@@ -0,0 +1,224 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+)
+
+// Backend names accepted by the firewallBackend config key.
+const (
+	BackendAuto     = "auto"
+	BackendIPTables = "iptables"
+	BackendNFTables = "nftables"
+)
+
+// Owner identifies the attachment a rule was created for.
+type Owner struct {
+	Network     string
+	ContainerID string
+}
+
+// Comment is the tag attached to every rule the owner creates, so rules can
+// be told apart from other components' and removed in bulk.
+func (o Owner) Comment() string {
+	return fmt.Sprintf("name=%s,id=%s", o.Network, o.ContainerID)
+}
+
+// owns reports whether a rule comment belongs to the owner, either as its
+// plain tag or as the tag followed by rule-specific attributes.
+func (o Owner) owns(comment string) bool {
+	return comment == o.Comment() || strings.HasPrefix(comment, o.Comment()+",")
+}
+
+// parseOwner reads the owner back from a rule comment written by Comment,
+// ignoring any rule-specific attributes after the tag.
+func parseOwner(comment string) (Owner, bool) {
+	rest, ok := strings.CutPrefix(comment, "name=")
+	if !ok {
+		return Owner{}, false
+	}
+	network, rest, ok := strings.Cut(rest, ",id=")
+	if !ok {
+		return Owner{}, false
+	}
+	id, _, _ := strings.Cut(rest, ",")
+	if id == "" {
+		return Owner{}, false
+	}
+	return Owner{Network: network, ContainerID: id}, true
+}
+
+// ownersOf returns the distinct owners on network among rule comments, in
+// the order they first appear.
+func ownersOf(network string, comments []string) []Owner {
+	seen := make(map[Owner]bool)
+	var out []Owner
+	for _, c := range comments {
+		o, ok := parseOwner(c)
+		if !ok || o.Network != network || seen[o] {
+			continue
+		}
+		seen[o] = true
+		out = append(out, o)
+	}
+	return out
+}
+
+// PortMapping forwards a port on the host to a port of the pod.
+type PortMapping struct {
+	HostPort      int
+	ContainerPort int
+	// Protocol is tcp, udp or sctp.
+	Protocol string
+	// HostIP restricts the mapping to one local address; nil matches all.
+	HostIP net.IP
+}
+
+// hostPortKey is the part of a port mapping that must be unique on the host.
+func (m PortMapping) hostPortKey() string {
+	key := m.Protocol + "/" + strconv.Itoa(m.HostPort)
+	if m.HostIP != nil {
+		key += "/" + m.HostIP.String()
+	}
+	return key
+}
+
+// portMappingComment tags a port mapping rule with its owner and host port,
+// which is what conflict detection reads back.
+func portMappingComment(owner Owner, m PortMapping) string {
+	return owner.Comment() + ",hostport=" + m.hostPortKey()
+}
+
+// parsePortMappingComment splits a port mapping comment into its owner tag
+// and the mapping's protocol, host port and host IP.
+func parsePortMappingComment(comment string) (owner string, m PortMapping, ok bool) {
+	owner, key, found := strings.Cut(comment, ",hostport=")
+	if !found {
+		return "", PortMapping{}, false
+	}
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 2 {
+		return "", PortMapping{}, false
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", PortMapping{}, false
+	}
+	m = PortMapping{Protocol: parts[0], HostPort: port}
+	if len(parts) == 3 {
+		m.HostIP = net.ParseIP(parts[2])
+	}
+	return owner, m, true
+}
+
+// overlaps reports whether two mappings would capture the same traffic.
+func (m PortMapping) overlaps(other PortMapping) bool {
+	if m.Protocol != other.Protocol || m.HostPort != other.HostPort {
+		return false
+	}
+	return m.HostIP == nil || other.HostIP == nil || m.HostIP.Equal(other.HostIP)
+}
+
+// checkPortConflicts returns an error if any of mappings overlaps a mapping
+// that another owner holds, given the comments of the installed rules.
+func checkPortConflicts(owner Owner, comments []string, mappings []PortMapping) error {
+	for _, c := range comments {
+		holder, existing, ok := parsePortMappingComment(c)
+		if !ok || holder == owner.Comment() {
+			continue
+		}
+		for _, m := range mappings {
+			if m.overlaps(existing) {
+				return cnierr.Errorf(cnierr.ErrPortConflict, "host port %s is already mapped by %s", m.hostPortKey(), holder)
+			}
+		}
+	}
+	return nil
+}
+
+// mappingsFor returns the mappings that apply to a pod address of ip's
+// family; a host IP of the other family cannot reach it.
+func mappingsFor(ip net.IP, mappings []PortMapping) []PortMapping {
+	var out []PortMapping
+	for _, m := range mappings {
+		if m.HostIP != nil && isIPv4(m.HostIP) != isIPv4(ip) {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// NATPolicy describes how traffic from a pod leaving the node is source-NATed.
+type NATPolicy struct {
+	// Bridge is the pod-facing bridge; traffic leaving through it is not NATed.
+	Bridge string
+	// Exclude lists destinations that keep the pod's source address. Entries of
+	// the other address family are ignored.
+	Exclude []*net.IPNet
+	// SNATIP, when set, replaces MASQUERADE with SNAT to this fixed address.
+	SNATIP net.IP
+}
+
+// Firewall manages the packet filtering and NAT state the plugin installs on
+// the host. Every call is idempotent.
+type Firewall interface {
+	// AddSourceNAT installs the NAT policy for traffic from src, replacing any
+	// NAT rules the owner already had.
+	AddSourceNAT(owner Owner, src *net.IPNet, policy NATPolicy) error
+	// AddPortMappings DNATs the host ports to podIP and masquerades hairpin
+	// traffic from the pod to itself, replacing the owner's existing mappings.
+	// It changes nothing if another owner already maps one of the host ports.
+	AddPortMappings(owner Owner, podIP net.IP, mappings []PortMapping) error
+	// DeleteOwned removes every rule tagged with owner.
+	DeleteOwned(owner Owner) error
+	// Owners lists the owners on network that have rules installed, so GC
+	// can find the rules of containers that are gone.
+	Owners(network string) ([]Owner, error)
+	// AddForward accepts forwarded traffic between the bridge and the pod
+	// subnet, for hosts whose FORWARD policy is DROP.
+	AddForward(bridge string, subnet *net.IPNet) error
+	// CheckForward reports an error if the rules from AddForward are missing.
+	CheckForward(bridge string, subnet *net.IPNet) error
+	// TeardownBridge removes bridge-wide state once the bridge has no ports left.
+	TeardownBridge(bridge string, subnet *net.IPNet) error
+}
+
+// bridgeComment tags the rules shared by every pod on a bridge.
+func bridgeComment(bridge string) string {
+	return "bridge=" + bridge
+}
+
+// New returns the firewall for the named backend. The auto backend keeps
+// using iptables where its binary is installed and falls back to nftables.
+func New(backend string) (Firewall, error) {
+	switch backend {
+	case BackendIPTables:
+		return newIPTablesFirewall()
+	case BackendNFTables:
+		return newNFTablesFirewall()
+	case "", BackendAuto:
+		if fw, err := newIPTablesFirewall(); err == nil {
+			return fw, nil
+		}
+		return newNFTablesFirewall()
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// hostNet returns ip as a single-address network.
+func hostNet(ip net.IP) *net.IPNet {
+	if isIPv4(ip) {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
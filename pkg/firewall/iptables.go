@@ -0,0 +1,372 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	natTable    = "nat"
+	filterTable = "filter"
+
+	postroutingChain       = "POSTROUTING"
+	eurekaPostroutingChain = "EUREKA-POSTROUTING"
+	forwardChain           = "FORWARD"
+	eurekaForwardChain     = "EUREKA-FORWARD"
+	preroutingChain        = "PREROUTING"
+	outputChain            = "OUTPUT"
+	eurekaHostportsChain   = "EUREKA-HOSTPORTS"
+)
+
+// localDst limits the host port jumps to traffic addressed to the node.
+var localDst = []string{"-m", "addrtype", "--dst-type", "LOCAL"}
+
+type ipTablesFirewall struct {
+	ipt4 iptableswrapper.IPTablesIface
+	ipt6 iptableswrapper.IPTablesIface
+}
+
+// NewIPTables returns a Firewall that programs iptables for IPv4 and ip6tables
+// for IPv6. Either handle may be nil when that family is unavailable.
+func NewIPTables(ipt4, ipt6 iptableswrapper.IPTablesIface) Firewall {
+	return &ipTablesFirewall{ipt4: ipt4, ipt6: ipt6}
+}
+
+func newIPTablesFirewall() (Firewall, error) {
+	ipt4, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+	// IPv6 is optional: nodes without ip6tables still get IPv4 rules.
+	ipt6, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv6)
+	if err != nil {
+		ipt6 = nil
+	}
+	return NewIPTables(ipt4, ipt6), nil
+}
+
+// forIP returns the handle for the address family of ip.
+func (f *ipTablesFirewall) forIP(ip net.IP) (iptableswrapper.IPTablesIface, error) {
+	if isIPv4(ip) {
+		if f.ipt4 == nil {
+			return nil, fmt.Errorf("iptables is not available for IPv4")
+		}
+		return f.ipt4, nil
+	}
+	if f.ipt6 == nil {
+		return nil, fmt.Errorf("ip6tables is not available for IPv6")
+	}
+	return f.ipt6, nil
+}
+
+// handles returns every available handle.
+func (f *ipTablesFirewall) handles() []iptableswrapper.IPTablesIface {
+	var out []iptableswrapper.IPTablesIface
+	for _, ipt := range []iptableswrapper.IPTablesIface{f.ipt4, f.ipt6} {
+		if ipt != nil {
+			out = append(out, ipt)
+		}
+	}
+	return out
+}
+
+func commentArgs(comment string) []string {
+	return []string{"-m", "comment", "--comment", comment}
+}
+
+func (f *ipTablesFirewall) AddSourceNAT(owner Owner, src *net.IPNet, policy NATPolicy) error {
+	ipt, err := f.forIP(src.IP)
+	if err != nil {
+		return err
+	}
+	if err := ensureChain(ipt, natTable, eurekaPostroutingChain, postroutingChain); err != nil {
+		return err
+	}
+
+	// Rebuild the owner's rules from scratch so a changed policy keeps the
+	// RETURN exclusions ahead of the NAT rule.
+	comment := owner.Comment()
+	if err := deleteTaggedRules(ipt, natTable, eurekaPostroutingChain, exactly(comment)); err != nil {
+		return err
+	}
+
+	for _, dst := range policy.Exclude {
+		if isIPv4(dst.IP) != isIPv4(src.IP) {
+			continue
+		}
+		rule := append([]string{"-s", src.String(), "-d", dst.String()}, commentArgs(comment)...)
+		rule = append(rule, "-j", "RETURN")
+		if err := ipt.Append(natTable, eurekaPostroutingChain, rule...); err != nil {
+			return fmt.Errorf("failed to add NAT exclusion for %s: %w", dst, err)
+		}
+	}
+
+	rule := append([]string{"-s", src.String(), "!", "-o", policy.Bridge}, commentArgs(comment)...)
+	if policy.SNATIP != nil {
+		rule = append(rule, "-j", "SNAT", "--to-source", policy.SNATIP.String())
+	} else {
+		rule = append(rule, "-j", "MASQUERADE")
+	}
+	return ipt.Append(natTable, eurekaPostroutingChain, rule...)
+}
+
+func (f *ipTablesFirewall) AddPortMappings(owner Owner, podIP net.IP, mappings []PortMapping) error {
+	ipt, err := f.forIP(podIP)
+	if err != nil {
+		return err
+	}
+	mappings = mappingsFor(podIP, mappings)
+
+	for _, parent := range []string{preroutingChain, outputChain} {
+		if err := ensureChain(ipt, natTable, eurekaHostportsChain, parent, localDst...); err != nil {
+			return err
+		}
+	}
+	if err := ensureChain(ipt, natTable, eurekaPostroutingChain, postroutingChain); err != nil {
+		return err
+	}
+
+	comments, err := listComments(ipt, natTable, eurekaHostportsChain)
+	if err != nil {
+		return err
+	}
+	if err := checkPortConflicts(owner, comments, mappings); err != nil {
+		return err
+	}
+
+	isMapping := func(c string) bool { return strings.HasPrefix(c, owner.Comment()+",hostport=") }
+	for _, chain := range []string{eurekaHostportsChain, eurekaPostroutingChain} {
+		if err := deleteTaggedRules(ipt, natTable, chain, isMapping); err != nil {
+			return err
+		}
+	}
+
+	podNet := hostNet(podIP)
+	hairpins := make(map[string]bool)
+	for _, m := range mappings {
+		comment := commentArgs(portMappingComment(owner, m))
+		dport := strconv.Itoa(m.ContainerPort)
+
+		rule := []string{"-p", m.Protocol}
+		if m.HostIP != nil {
+			rule = append(rule, "-d", m.HostIP.String())
+		}
+		rule = append(rule, "--dport", strconv.Itoa(m.HostPort))
+		rule = append(rule, comment...)
+		rule = append(rule, "-j", "DNAT", "--to-destination", net.JoinHostPort(podIP.String(), dport))
+		if err := ipt.Append(natTable, eurekaHostportsChain, rule...); err != nil {
+			return fmt.Errorf("failed to add port mapping %s: %w", m.hostPortKey(), err)
+		}
+
+		// A pod reaching itself through its host port must see the node as
+		// the source, or its reply would bypass the DNAT. The rule goes first
+		// so NAT exclusions for the pod subnet cannot shadow it.
+		if key := m.Protocol + "/" + dport; !hairpins[key] {
+			hairpins[key] = true
+			rule := []string{"-s", podNet.String(), "-d", podNet.String(), "-p", m.Protocol, "--dport", dport}
+			rule = append(rule, comment...)
+			rule = append(rule, "-j", "MASQUERADE")
+			if err := ipt.Insert(natTable, eurekaPostroutingChain, 1, rule...); err != nil {
+				return fmt.Errorf("failed to add hairpin rule for %s: %w", m.hostPortKey(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *ipTablesFirewall) DeleteOwned(owner Owner) error {
+	var errs []error
+	for _, ipt := range f.handles() {
+		for _, chain := range []string{eurekaPostroutingChain, eurekaHostportsChain} {
+			if err := deleteTaggedRules(ipt, natTable, chain, owner.owns); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *ipTablesFirewall) Owners(network string) ([]Owner, error) {
+	var comments []string
+	for _, ipt := range f.handles() {
+		for _, chain := range []string{eurekaPostroutingChain, eurekaHostportsChain} {
+			c, err := listComments(ipt, natTable, chain)
+			if err != nil {
+				return nil, err
+			}
+			comments = append(comments, c...)
+		}
+	}
+	return ownersOf(network, comments), nil
+}
+
+// forwardRules returns the accept rules for traffic entering and leaving the pod subnet.
+func forwardRules(bridge string, subnet *net.IPNet) [][]string {
+	comment := commentArgs(bridgeComment(bridge))
+	return [][]string{
+		append(append([]string{"-i", bridge, "-s", subnet.String()}, comment...), "-j", "ACCEPT"),
+		append(append([]string{"-o", bridge, "-d", subnet.String()}, comment...), "-j", "ACCEPT"),
+	}
+}
+
+func (f *ipTablesFirewall) AddForward(bridge string, subnet *net.IPNet) error {
+	ipt, err := f.forIP(subnet.IP)
+	if err != nil {
+		return err
+	}
+	if err := ensureChain(ipt, filterTable, eurekaForwardChain, forwardChain); err != nil {
+		return err
+	}
+	for _, rule := range forwardRules(bridge, subnet) {
+		if err := ipt.AppendUnique(filterTable, eurekaForwardChain, rule...); err != nil {
+			return fmt.Errorf("failed to add forward rule for %s: %w", bridge, err)
+		}
+	}
+	return nil
+}
+
+func (f *ipTablesFirewall) CheckForward(bridge string, subnet *net.IPNet) error {
+	ipt, err := f.forIP(subnet.IP)
+	if err != nil {
+		return err
+	}
+	jump := append(commentArgs("eureka"), "-j", eurekaForwardChain)
+	if ok, err := ipt.Exists(filterTable, forwardChain, jump...); err != nil || !ok {
+		return fmt.Errorf("jump from %s to %s is missing", forwardChain, eurekaForwardChain)
+	}
+	for _, rule := range forwardRules(bridge, subnet) {
+		if ok, err := ipt.Exists(filterTable, eurekaForwardChain, rule...); err != nil || !ok {
+			return fmt.Errorf("forward rule %q is missing", strings.Join(rule, " "))
+		}
+	}
+	return nil
+}
+
+func (f *ipTablesFirewall) TeardownBridge(bridge string, subnet *net.IPNet) error {
+	if subnet == nil {
+		return nil
+	}
+	ipt, err := f.forIP(subnet.IP)
+	if err != nil {
+		return nil
+	}
+
+	if err := deleteTaggedRules(ipt, filterTable, eurekaForwardChain, exactly(bridgeComment(bridge))); err != nil {
+		return err
+	}
+
+	// Earlier versions appended an untagged subnet-wide rule to nat/POSTROUTING.
+	legacy := []string{"-s", subnet.String(), "!", "-o", bridge, "-j", "MASQUERADE"}
+	ok, err := ipt.Exists(natTable, postroutingChain, legacy...)
+	if err != nil || !ok {
+		return err
+	}
+	if err := ipt.Delete(natTable, postroutingChain, legacy...); err != nil {
+		return fmt.Errorf("failed to delete legacy masquerade rule: %w", err)
+	}
+	logging.Logger.Info("masquerade_rule_deleted", "subnet", subnet.String(), "bridge", bridge)
+	return nil
+}
+
+// ensureChain creates the plugin-owned chain if needed and makes sure the
+// parent chain jumps to it exactly once, for packets matching match.
+func ensureChain(ipt iptableswrapper.IPTablesIface, table, chain, parent string, match ...string) error {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return fmt.Errorf("failed to check chain %s/%s: %w", table, chain, err)
+	}
+	if !exists {
+		if err := ipt.NewChain(table, chain); err != nil {
+			// Another ADD may have created it concurrently.
+			if exists, _ := ipt.ChainExists(table, chain); !exists {
+				return fmt.Errorf("failed to create chain %s/%s: %w", table, chain, err)
+			}
+		}
+	}
+
+	jump := append(append(append([]string{}, match...), commentArgs("eureka")...), "-j", chain)
+	ok, err := ipt.Exists(table, parent, jump...)
+	if err != nil {
+		return fmt.Errorf("failed to check jump %s -> %s: %w", parent, chain, err)
+	}
+	if !ok {
+		if err := ipt.Insert(table, parent, 1, jump...); err != nil {
+			return fmt.Errorf("failed to add jump %s -> %s: %w", parent, chain, err)
+		}
+	}
+	return nil
+}
+
+// exactly matches one comment.
+func exactly(comment string) func(string) bool {
+	return func(c string) bool { return c == comment }
+}
+
+// listComments returns the comment of every rule in the chain, or nothing if
+// the chain does not exist.
+func listComments(ipt iptableswrapper.IPTablesIface, table, chain string) ([]string, error) {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil || !exists {
+		return nil, err
+	}
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s/%s: %w", table, chain, err)
+	}
+	var out []string
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "-A ") {
+			out = append(out, parseComment(rule))
+		}
+	}
+	return out, nil
+}
+
+// deleteTaggedRules removes every rule in the chain whose comment matches.
+// Rules are deleted by their full rulespec, so rules inserted or deleted
+// concurrently by other attachments cannot redirect a delete.
+func deleteTaggedRules(ipt iptableswrapper.IPTablesIface, table, chain string, match func(comment string) bool) error {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil || !exists {
+		return err
+	}
+
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return fmt.Errorf("failed to list %s/%s: %w", table, chain, err)
+	}
+
+	deleted := 0
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") || !match(parseComment(rule)) {
+			continue
+		}
+		if err := iptableswrapper.DeleteRule(ipt, table, rule); err != nil {
+			return fmt.Errorf("failed to delete rule from %s/%s: %w", table, chain, err)
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		logging.Logger.Info("iptables_rules_deleted", "table", table, "chain", chain, "count", deleted)
+	}
+	return nil
+}
+
+// parseComment extracts the --comment value from a rule as printed by iptables -S.
+func parseComment(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--comment" {
+			return strings.Trim(fields[i+1], `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,197 @@
+package firewall
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper/iptablestest"
+	"github.com/innfi/probable-eureka/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logging.InitStderr()
+	os.Exit(m.Run())
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	require.NoError(t, err)
+	return n
+}
+
+func TestIPTables_MasqueradeInOwnChainTaggedPerContainer(t *testing.T) {
+	ipt := iptablestest.New()
+	fw := NewIPTables(ipt, nil)
+
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	ctr2 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "10.0.0.2/32"), NATPolicy{Bridge: "cni0"}))
+	require.NoError(t, fw.AddSourceNAT(ctr2, mustCIDR(t, "10.0.0.3/32"), NATPolicy{Bridge: "cni0"}))
+	// Re-running ADD must not duplicate the jump or the rule.
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "10.0.0.2/32"), NATPolicy{Bridge: "cni0"}))
+
+	assert.True(t, ipt.Chains["nat/EUREKA-POSTROUTING"])
+	assert.Equal(t, []string{"-m comment --comment eureka -j EUREKA-POSTROUTING"}, ipt.Rules["nat/POSTROUTING"])
+	assert.ElementsMatch(t, []string{
+		"-s 10.0.0.2/32 ! -o cni0 -m comment --comment name=eureka,id=ctr1 -j MASQUERADE",
+		"-s 10.0.0.3/32 ! -o cni0 -m comment --comment name=eureka,id=ctr2 -j MASQUERADE",
+	}, ipt.Rules["nat/EUREKA-POSTROUTING"])
+
+	require.NoError(t, fw.DeleteOwned(ctr1))
+
+	assert.Equal(t, []string{
+		"-s 10.0.0.3/32 ! -o cni0 -m comment --comment name=eureka,id=ctr2 -j MASQUERADE",
+	}, ipt.Rules["nat/EUREKA-POSTROUTING"])
+}
+
+func TestIPTables_SourceNATPolicyPerFamily(t *testing.T) {
+	ipt4, ipt6 := iptablestest.New(), iptablestest.New()
+	fw := NewIPTables(ipt4, ipt6)
+	policy := NATPolicy{
+		Bridge:  "cni0",
+		Exclude: []*net.IPNet{mustCIDR(t, "10.244.0.0/16"), mustCIDR(t, "fd00::/8")},
+	}
+
+	v4 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	v6 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	require.NoError(t, fw.AddSourceNAT(v4, mustCIDR(t, "10.0.0.2/32"), policy))
+	policy.SNATIP = net.ParseIP("2001:db8::1")
+	require.NoError(t, fw.AddSourceNAT(v6, mustCIDR(t, "fd01::2/128"), policy))
+
+	assert.Equal(t, []string{
+		"-s 10.0.0.2/32 -d 10.244.0.0/16 -m comment --comment name=eureka,id=ctr1 -j RETURN",
+		"-s 10.0.0.2/32 ! -o cni0 -m comment --comment name=eureka,id=ctr1 -j MASQUERADE",
+	}, ipt4.Rules["nat/EUREKA-POSTROUTING"])
+	assert.Equal(t, []string{
+		"-s fd01::2/128 -d fd00::/8 -m comment --comment name=eureka,id=ctr2 -j RETURN",
+		"-s fd01::2/128 ! -o cni0 -m comment --comment name=eureka,id=ctr2 -j SNAT --to-source 2001:db8::1",
+	}, ipt6.Rules["nat/EUREKA-POSTROUTING"])
+
+	require.NoError(t, fw.DeleteOwned(v6))
+	assert.Empty(t, ipt6.Rules["nat/EUREKA-POSTROUTING"])
+	assert.Len(t, ipt4.Rules["nat/EUREKA-POSTROUTING"], 2)
+}
+
+func TestIPTables_IPv6WithoutIp6tables(t *testing.T) {
+	fw := NewIPTables(iptablestest.New(), nil)
+
+	err := fw.AddSourceNAT(Owner{Network: "eureka", ContainerID: "ctr1"}, mustCIDR(t, "fd01::2/128"), NATPolicy{Bridge: "cni0"})
+
+	assert.Error(t, err)
+}
+
+func TestIPTables_TeardownBridgeRemovesLegacyRule(t *testing.T) {
+	ipt := iptablestest.New()
+	require.NoError(t, ipt.Append("nat", "POSTROUTING", "-s", "10.0.0.0/24", "!", "-o", "cni0", "-j", "MASQUERADE"))
+
+	require.NoError(t, NewIPTables(ipt, nil).TeardownBridge("cni0", mustCIDR(t, "10.0.0.0/24")))
+
+	assert.Empty(t, ipt.Rules["nat/POSTROUTING"])
+}
+
+func TestIPTables_ForwardRules(t *testing.T) {
+	ipt := iptablestest.New()
+	fw := NewIPTables(ipt, nil)
+	subnet := mustCIDR(t, "10.0.0.0/24")
+
+	assert.Error(t, fw.CheckForward("cni0", subnet))
+
+	require.NoError(t, fw.AddForward("cni0", subnet))
+	require.NoError(t, fw.AddForward("cni0", subnet))
+
+	assert.Equal(t, []string{"-m comment --comment eureka -j EUREKA-FORWARD"}, ipt.Rules["filter/FORWARD"])
+	assert.Equal(t, []string{
+		"-i cni0 -s 10.0.0.0/24 -m comment --comment bridge=cni0 -j ACCEPT",
+		"-o cni0 -d 10.0.0.0/24 -m comment --comment bridge=cni0 -j ACCEPT",
+	}, ipt.Rules["filter/EUREKA-FORWARD"])
+	assert.NoError(t, fw.CheckForward("cni0", subnet))
+
+	require.NoError(t, fw.TeardownBridge("cni0", subnet))
+	assert.Empty(t, ipt.Rules["filter/EUREKA-FORWARD"])
+	assert.Error(t, fw.CheckForward("cni0", subnet))
+}
+
+func TestParseComment(t *testing.T) {
+	assert.Equal(t, "name=eureka,id=ctr1", parseComment(`-A EUREKA-POSTROUTING -s 10.0.0.2/32 -m comment --comment "name=eureka,id=ctr1" -j MASQUERADE`))
+	assert.Equal(t, "name=eureka,id=ctr1", parseComment(`-A EUREKA-POSTROUTING -m comment --comment name=eureka,id=ctr1 -j MASQUERADE`))
+	assert.Equal(t, "", parseComment(`-A POSTROUTING -j MASQUERADE`))
+}
+
+func TestIPTables_PortMappings(t *testing.T) {
+	ipt4, ipt6 := iptablestest.New(), iptablestest.New()
+	fw := NewIPTables(ipt4, ipt6)
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	ctr2 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	mappings := []PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: net.ParseIP("192.0.2.1")},
+		{HostPort: 8443, ContainerPort: 443, Protocol: "tcp", HostIP: net.ParseIP("2001:db8::1")},
+	}
+
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "10.0.0.2/32"), NATPolicy{Bridge: "cni0"}))
+	require.NoError(t, fw.AddPortMappings(ctr1, net.ParseIP("10.0.0.2"), mappings))
+	// CHECK re-applies the mappings without duplicating them.
+	require.NoError(t, fw.AddPortMappings(ctr1, net.ParseIP("10.0.0.2"), mappings))
+
+	jump := "-m addrtype --dst-type LOCAL -m comment --comment eureka -j EUREKA-HOSTPORTS"
+	assert.Equal(t, []string{jump}, ipt4.Rules["nat/PREROUTING"])
+	assert.Equal(t, []string{jump}, ipt4.Rules["nat/OUTPUT"])
+	assert.Equal(t, []string{
+		"-p tcp --dport 8080 -m comment --comment name=eureka,id=ctr1,hostport=tcp/8080 -j DNAT --to-destination 10.0.0.2:80",
+		"-p udp -d 192.0.2.1 --dport 5353 -m comment --comment name=eureka,id=ctr1,hostport=udp/5353/192.0.2.1 -j DNAT --to-destination 10.0.0.2:53",
+	}, ipt4.Rules["nat/EUREKA-HOSTPORTS"], "the IPv6 host IP does not apply to an IPv4 pod")
+	assert.Equal(t, []string{
+		"-s 10.0.0.2/32 -d 10.0.0.2/32 -p udp --dport 53 -m comment --comment name=eureka,id=ctr1,hostport=udp/5353/192.0.2.1 -j MASQUERADE",
+		"-s 10.0.0.2/32 -d 10.0.0.2/32 -p tcp --dport 80 -m comment --comment name=eureka,id=ctr1,hostport=tcp/8080 -j MASQUERADE",
+		"-s 10.0.0.2/32 ! -o cni0 -m comment --comment name=eureka,id=ctr1 -j MASQUERADE",
+	}, ipt4.Rules["nat/EUREKA-POSTROUTING"], "hairpin rules go ahead of the NAT policy")
+
+	// Another container cannot take a port that overlaps, but can use a free one.
+	err := fw.AddPortMappings(ctr2, net.ParseIP("10.0.0.3"), []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: net.ParseIP("192.0.2.1")}})
+	require.ErrorContains(t, err, "already mapped by name=eureka,id=ctr1")
+	require.NoError(t, fw.AddPortMappings(ctr2, net.ParseIP("10.0.0.3"), []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "udp"}}))
+
+	v6 := Owner{Network: "eureka", ContainerID: "ctr3"}
+	require.NoError(t, fw.AddPortMappings(v6, net.ParseIP("fd00::3"), mappings[2:]))
+	assert.Equal(t, []string{
+		"-p tcp -d 2001:db8::1 --dport 8443 -m comment --comment name=eureka,id=ctr3,hostport=tcp/8443/2001:db8::1 -j DNAT --to-destination [fd00::3]:443",
+	}, ipt6.Rules["nat/EUREKA-HOSTPORTS"])
+
+	owners, err := fw.Owners("eureka")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Owner{ctr1, ctr2, v6}, owners, "owners of both families")
+	owners, err = fw.Owners("other")
+	require.NoError(t, err)
+	assert.Empty(t, owners)
+
+	require.NoError(t, fw.DeleteOwned(ctr1))
+	assert.Equal(t, []string{
+		"-p udp --dport 8080 -m comment --comment name=eureka,id=ctr2,hostport=udp/8080 -j DNAT --to-destination 10.0.0.3:80",
+	}, ipt4.Rules["nat/EUREKA-HOSTPORTS"])
+	assert.Equal(t, []string{
+		"-s 10.0.0.3/32 -d 10.0.0.3/32 -p udp --dport 80 -m comment --comment name=eureka,id=ctr2,hostport=udp/8080 -j MASQUERADE",
+	}, ipt4.Rules["nat/EUREKA-POSTROUTING"])
+}
+
+func TestOwner_OwnsOnlyItsOwnComments(t *testing.T) {
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	assert.True(t, ctr1.owns("name=eureka,id=ctr1"))
+	assert.True(t, ctr1.owns("name=eureka,id=ctr1,hostport=tcp/80"))
+	assert.False(t, ctr1.owns("name=eureka,id=ctr10"))
+	assert.False(t, ctr1.owns("name=eureka,id=ctr10,hostport=tcp/80"))
+}
+
+func TestParseOwner(t *testing.T) {
+	o, ok := parseOwner("name=eureka,id=ctr1,hostport=tcp/80")
+	assert.True(t, ok)
+	assert.Equal(t, Owner{Network: "eureka", ContainerID: "ctr1"}, o)
+
+	for _, c := range []string{"eureka", "bridge=cni0", "name=eureka", "name=eureka,id="} {
+		_, ok := parseOwner(c)
+		assert.False(t, ok, c)
+	}
+}
@@ -0,0 +1,368 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+	"sigs.k8s.io/knftables"
+)
+
+const (
+	nftTable = "eureka"
+
+	nftPostroutingChain = "postrouting"
+	nftForwardChain     = "forward"
+	nftPreroutingChain  = "prerouting"
+	nftOutputChain      = "output"
+	nftHostportsChain   = "hostports"
+)
+
+type nfTablesFirewall struct {
+	nft  knftables.Interface
+	ipt4 iptableswrapper.IPTablesIface
+	ipt6 iptableswrapper.IPTablesIface
+}
+
+// NewNFTables returns a Firewall that programs the plugin's table through nft.
+// The table is in the inet family so one set of chains serves IPv4 and IPv6.
+// ipt4 and ipt6 are only read, to find an iptables FORWARD DROP policy the
+// table cannot override; either may be nil when that family has no iptables.
+func NewNFTables(nft knftables.Interface, ipt4, ipt6 iptableswrapper.IPTablesIface) Firewall {
+	return &nfTablesFirewall{nft: nft, ipt4: ipt4, ipt6: ipt6}
+}
+
+func newNFTablesFirewall() (Firewall, error) {
+	nft, err := knftables.New(knftables.InetFamily, nftTable)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts without the iptables binaries have no iptables policy to check.
+	ipt4, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv4)
+	if err != nil {
+		ipt4 = nil
+	}
+	ipt6, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv6)
+	if err != nil {
+		ipt6 = nil
+	}
+	return NewNFTables(nft, ipt4, ipt6), nil
+}
+
+// ensureBase adds the table and base chains; nft "add" is a no-op for
+// objects that already exist.
+func (f *nfTablesFirewall) ensureBase(tx *knftables.Transaction) {
+	tx.Add(&knftables.Table{
+		Comment: knftables.PtrTo("rules managed by the eureka CNI plugin"),
+	})
+	tx.Add(&knftables.Chain{
+		Name:     nftPostroutingChain,
+		Type:     knftables.PtrTo(knftables.NATType),
+		Hook:     knftables.PtrTo(knftables.PostroutingHook),
+		Priority: knftables.PtrTo(knftables.SNATPriority),
+	})
+	tx.Add(&knftables.Chain{
+		Name:     nftForwardChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.ForwardHook),
+		Priority: knftables.PtrTo(knftables.FilterPriority),
+	})
+}
+
+func (f *nfTablesFirewall) AddSourceNAT(owner Owner, src *net.IPNet, policy NATPolicy) error {
+	ctx := context.TODO()
+	comment := knftables.PtrTo(owner.Comment())
+	family := ipFamily(src.IP)
+
+	tx := f.nft.NewTransaction()
+	f.ensureBase(tx)
+	// Replace whatever the owner had so repeated ADDs stay idempotent.
+	if err := f.deleteTaggedRules(ctx, tx, nftPostroutingChain, exactly(owner.Comment())); err != nil {
+		return err
+	}
+
+	for _, dst := range policy.Exclude {
+		if isIPv4(dst.IP) != isIPv4(src.IP) {
+			continue
+		}
+		tx.Add(&knftables.Rule{
+			Chain:   nftPostroutingChain,
+			Rule:    knftables.Concat(family, "saddr", src, family, "daddr", dst, "return"),
+			Comment: comment,
+		})
+	}
+
+	verdict := "masquerade"
+	if policy.SNATIP != nil {
+		verdict = knftables.Concat("snat", family, "to", policy.SNATIP)
+	}
+	tx.Add(&knftables.Rule{
+		Chain: nftPostroutingChain,
+		Rule: knftables.Concat(
+			family, "saddr", src,
+			"oifname", "!=", fmt.Sprintf("%q", policy.Bridge),
+			verdict,
+		),
+		Comment: comment,
+	})
+	return f.nft.Run(ctx, tx)
+}
+
+// ensureHostports adds the host port chain and the base chains that jump to
+// it for traffic addressed to the node, whether it arrives from outside or
+// is generated locally.
+func (f *nfTablesFirewall) ensureHostports(tx *knftables.Transaction) {
+	tx.Add(&knftables.Chain{Name: nftHostportsChain})
+	for _, base := range []struct {
+		name string
+		hook knftables.BaseChainHook
+	}{
+		{nftPreroutingChain, knftables.PreroutingHook},
+		{nftOutputChain, knftables.OutputHook},
+	} {
+		tx.Add(&knftables.Chain{
+			Name:     base.name,
+			Type:     knftables.PtrTo(knftables.NATType),
+			Hook:     knftables.PtrTo(base.hook),
+			Priority: knftables.PtrTo(knftables.DNATPriority),
+		})
+		// The base chain holds only the jump, so rewriting it is idempotent.
+		tx.Flush(&knftables.Chain{Name: base.name})
+		tx.Add(&knftables.Rule{
+			Chain: base.name,
+			Rule:  knftables.Concat("fib daddr type local", "jump", nftHostportsChain),
+		})
+	}
+}
+
+func (f *nfTablesFirewall) AddPortMappings(owner Owner, podIP net.IP, mappings []PortMapping) error {
+	ctx := context.TODO()
+	family := ipFamily(podIP)
+	mappings = mappingsFor(podIP, mappings)
+
+	comments, err := f.listComments(ctx, nftHostportsChain)
+	if err != nil {
+		return err
+	}
+	if err := checkPortConflicts(owner, comments, mappings); err != nil {
+		return err
+	}
+
+	tx := f.nft.NewTransaction()
+	f.ensureBase(tx)
+	f.ensureHostports(tx)
+	isMapping := func(c string) bool { return strings.HasPrefix(c, owner.Comment()+",hostport=") }
+	for _, chain := range []string{nftHostportsChain, nftPostroutingChain} {
+		if err := f.deleteTaggedRules(ctx, tx, chain, isMapping); err != nil {
+			return err
+		}
+	}
+
+	hairpins := make(map[string]bool)
+	for _, m := range mappings {
+		comment := knftables.PtrTo(portMappingComment(owner, m))
+
+		match := knftables.Concat("meta nfproto", nfProto(podIP))
+		if m.HostIP != nil {
+			match = knftables.Concat(family, "daddr", m.HostIP)
+		}
+		tx.Add(&knftables.Rule{
+			Chain: nftHostportsChain,
+			Rule: knftables.Concat(
+				match, m.Protocol, "dport", m.HostPort,
+				"dnat", family, "to", net.JoinHostPort(podIP.String(), fmt.Sprint(m.ContainerPort)),
+			),
+			Comment: comment,
+		})
+
+		// Masquerade a pod reaching itself through its host port; inserted
+		// first so NAT exclusions for the pod subnet cannot shadow it.
+		if key := fmt.Sprintf("%s/%d", m.Protocol, m.ContainerPort); !hairpins[key] {
+			hairpins[key] = true
+			tx.Insert(&knftables.Rule{
+				Chain: nftPostroutingChain,
+				Rule: knftables.Concat(
+					family, "saddr", podIP, family, "daddr", podIP,
+					m.Protocol, "dport", m.ContainerPort, "masquerade",
+				),
+				Comment: comment,
+			})
+		}
+	}
+	return f.nft.Run(ctx, tx)
+}
+
+func (f *nfTablesFirewall) DeleteOwned(owner Owner) error {
+	ctx := context.TODO()
+	tx := f.nft.NewTransaction()
+	for _, chain := range []string{nftPostroutingChain, nftHostportsChain} {
+		if err := f.deleteTaggedRules(ctx, tx, chain, owner.owns); err != nil {
+			return err
+		}
+	}
+	if tx.NumOperations() == 0 {
+		return nil
+	}
+	if err := f.nft.Run(ctx, tx); err != nil {
+		return err
+	}
+	logging.Logger.Info("nftables_rules_deleted", "comment", owner.Comment(), "count", tx.NumOperations())
+	return nil
+}
+
+func (f *nfTablesFirewall) Owners(network string) ([]Owner, error) {
+	var comments []string
+	for _, chain := range []string{nftPostroutingChain, nftHostportsChain} {
+		c, err := f.listComments(context.TODO(), chain)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c...)
+	}
+	return ownersOf(network, comments), nil
+}
+
+// AddForward accepts bridge traffic in the plugin's own forward chain. Note
+// that nftables verdicts are per base chain: an accept here cannot override a
+// drop in another table, so on hosts whose iptables FORWARD policy is DROP
+// it fails with ErrFeatureUnavailable rather than install rules pod traffic
+// never reaches; those hosts need the iptables backend.
+func (f *nfTablesFirewall) AddForward(bridge string, subnet *net.IPNet) error {
+	if err := f.checkIPTablesForward(subnet); err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	comment := bridgeComment(bridge)
+	family := ipFamily(subnet.IP)
+
+	tx := f.nft.NewTransaction()
+	f.ensureBase(tx)
+	if err := f.deleteTaggedRules(ctx, tx, nftForwardChain, exactly(comment)); err != nil {
+		return err
+	}
+	tx.Add(&knftables.Rule{
+		Chain:   nftForwardChain,
+		Rule:    knftables.Concat("iifname", fmt.Sprintf("%q", bridge), family, "saddr", subnet, "accept"),
+		Comment: knftables.PtrTo(comment),
+	})
+	tx.Add(&knftables.Rule{
+		Chain:   nftForwardChain,
+		Rule:    knftables.Concat("oifname", fmt.Sprintf("%q", bridge), family, "daddr", subnet, "accept"),
+		Comment: knftables.PtrTo(comment),
+	})
+	return f.nft.Run(ctx, tx)
+}
+
+func (f *nfTablesFirewall) CheckForward(bridge string, subnet *net.IPNet) error {
+	if err := f.checkIPTablesForward(subnet); err != nil {
+		return err
+	}
+	rules, err := f.nft.ListRules(context.TODO(), nftForwardChain)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables chain %s: %w", nftForwardChain, err)
+	}
+	found := 0
+	for _, r := range rules {
+		if r.Comment != nil && *r.Comment == bridgeComment(bridge) {
+			found++
+		}
+	}
+	if found < 2 {
+		return fmt.Errorf("forward rules for bridge %s are missing", bridge)
+	}
+	return nil
+}
+
+// checkIPTablesForward fails when the iptables FORWARD chain for subnet's
+// family drops by default.
+func (f *nfTablesFirewall) checkIPTablesForward(subnet *net.IPNet) error {
+	ipt := f.ipt6
+	if isIPv4(subnet.IP) {
+		ipt = f.ipt4
+	}
+	if ipt == nil {
+		return nil
+	}
+	rules, err := ipt.List(filterTable, forwardChain)
+	if err != nil {
+		return fmt.Errorf("failed to list iptables chain %s: %w", forwardChain, err)
+	}
+	for _, r := range rules {
+		if strings.HasPrefix(r, "-P ") && strings.HasSuffix(r, " DROP") {
+			return cnierr.Errorf(cnierr.ErrFeatureUnavailable,
+				"the iptables %s policy is DROP, which the nftables backend cannot override for %s; use firewallBackend \"iptables\"",
+				forwardChain, subnet)
+		}
+	}
+	return nil
+}
+
+func (f *nfTablesFirewall) TeardownBridge(bridge string, _ *net.IPNet) error {
+	ctx := context.TODO()
+	tx := f.nft.NewTransaction()
+	if err := f.deleteTaggedRules(ctx, tx, nftForwardChain, exactly(bridgeComment(bridge))); err != nil {
+		return err
+	}
+	if tx.NumOperations() == 0 {
+		return nil
+	}
+	return f.nft.Run(ctx, tx)
+}
+
+// listComments returns the comment of every rule in the chain, or nothing if
+// the chain does not exist.
+func (f *nfTablesFirewall) listComments(ctx context.Context, chain string) ([]string, error) {
+	rules, err := f.nft.ListRules(ctx, chain)
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list nftables chain %s: %w", chain, err)
+	}
+	var out []string
+	for _, r := range rules {
+		if r.Comment != nil {
+			out = append(out, *r.Comment)
+		}
+	}
+	return out, nil
+}
+
+// deleteTaggedRules queues deletion of every rule in the chain whose comment matches.
+func (f *nfTablesFirewall) deleteTaggedRules(ctx context.Context, tx *knftables.Transaction, chain string, match func(comment string) bool) error {
+	rules, err := f.nft.ListRules(ctx, chain)
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list nftables chain %s: %w", chain, err)
+	}
+	for _, r := range rules {
+		if r.Comment != nil && match(*r.Comment) {
+			tx.Delete(&knftables.Rule{Chain: chain, Handle: r.Handle})
+		}
+	}
+	return nil
+}
+
+// ipFamily returns the nft payload keyword matching the address family of ip.
+func ipFamily(ip net.IP) string {
+	if isIPv4(ip) {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// nfProto returns the meta nfproto value matching the address family of ip.
+func nfProto(ip net.IP) string {
+	if isIPv4(ip) {
+		return "ipv4"
+	}
+	return "ipv6"
+}
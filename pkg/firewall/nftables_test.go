@@ -0,0 +1,168 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper/iptablestest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/knftables"
+)
+
+func nftRules(t *testing.T, fake *knftables.Fake, chain string) []string {
+	t.Helper()
+	require.NotNil(t, fake.Table)
+	c := fake.Table.Chains[chain]
+	require.NotNil(t, c, "chain %s missing", chain)
+	var out []string
+	for _, r := range c.Rules {
+		out = append(out, r.Rule+" # "+*r.Comment)
+	}
+	return out
+}
+
+func TestNFTables_MasqueradeTaggedPerContainer(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	fw := NewNFTables(fake, nil, nil)
+
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	ctr2 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "10.0.0.2/32"), NATPolicy{Bridge: "cni0"}))
+	require.NoError(t, fw.AddSourceNAT(ctr2, mustCIDR(t, "fd00::3/128"), NATPolicy{Bridge: "cni0"}))
+	// Re-running ADD must not duplicate the rule.
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "10.0.0.2/32"), NATPolicy{Bridge: "cni0"}))
+
+	chain := fake.Table.Chains[nftPostroutingChain]
+	require.NotNil(t, chain)
+	assert.Equal(t, knftables.NATType, *chain.Type)
+	assert.Equal(t, knftables.PostroutingHook, *chain.Hook)
+	assert.ElementsMatch(t, []string{
+		`ip saddr 10.0.0.2/32 oifname != "cni0" masquerade # name=eureka,id=ctr1`,
+		`ip6 saddr fd00::3/128 oifname != "cni0" masquerade # name=eureka,id=ctr2`,
+	}, nftRules(t, fake, nftPostroutingChain))
+
+	owners, err := fw.Owners("eureka")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Owner{ctr1, ctr2}, owners)
+
+	require.NoError(t, fw.DeleteOwned(ctr1))
+
+	assert.Equal(t, []string{
+		`ip6 saddr fd00::3/128 oifname != "cni0" masquerade # name=eureka,id=ctr2`,
+	}, nftRules(t, fake, nftPostroutingChain))
+}
+
+func TestNFTables_SourceNATPolicy(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	fw := NewNFTables(fake, nil, nil)
+	policy := NATPolicy{
+		Bridge:  "cni0",
+		Exclude: []*net.IPNet{mustCIDR(t, "10.244.0.0/16"), mustCIDR(t, "fd00::/8")},
+		SNATIP:  net.ParseIP("192.0.2.10"),
+	}
+
+	owner := Owner{Network: "eureka", ContainerID: "ctr1"}
+	require.NoError(t, fw.AddSourceNAT(owner, mustCIDR(t, "10.0.0.2/32"), policy))
+	// A changed policy replaces the old rules.
+	policy.Exclude = nil
+	require.NoError(t, fw.AddSourceNAT(owner, mustCIDR(t, "10.0.0.2/32"), policy))
+
+	assert.Equal(t, []string{
+		`ip saddr 10.0.0.2/32 oifname != "cni0" snat ip to 192.0.2.10 # name=eureka,id=ctr1`,
+	}, nftRules(t, fake, nftPostroutingChain))
+
+	policy.Exclude = []*net.IPNet{mustCIDR(t, "10.244.0.0/16")}
+	require.NoError(t, fw.AddSourceNAT(owner, mustCIDR(t, "10.0.0.2/32"), policy))
+	assert.Equal(t, []string{
+		`ip saddr 10.0.0.2/32 ip daddr 10.244.0.0/16 return # name=eureka,id=ctr1`,
+		`ip saddr 10.0.0.2/32 oifname != "cni0" snat ip to 192.0.2.10 # name=eureka,id=ctr1`,
+	}, nftRules(t, fake, nftPostroutingChain))
+}
+
+func TestNFTables_ForwardRules(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	fw := NewNFTables(fake, nil, nil)
+	subnet := mustCIDR(t, "10.0.0.0/24")
+
+	require.NoError(t, fw.AddForward("cni0", subnet))
+	require.NoError(t, fw.AddForward("cni0", subnet))
+
+	assert.Equal(t, []string{
+		`iifname "cni0" ip saddr 10.0.0.0/24 accept # bridge=cni0`,
+		`oifname "cni0" ip daddr 10.0.0.0/24 accept # bridge=cni0`,
+	}, nftRules(t, fake, nftForwardChain))
+	assert.NoError(t, fw.CheckForward("cni0", subnet))
+
+	require.NoError(t, fw.TeardownBridge("cni0", subnet))
+	assert.Empty(t, nftRules(t, fake, nftForwardChain))
+	assert.Error(t, fw.CheckForward("cni0", subnet))
+}
+
+func TestNFTables_ForwardBehindIPTablesDrop(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	ipt4, ipt6 := iptablestest.New(), iptablestest.New()
+	ipt4.Policies[iptablestest.Key(filterTable, forwardChain)] = "DROP"
+	fw := NewNFTables(fake, ipt4, ipt6)
+
+	err := fw.AddForward("cni0", mustCIDR(t, "10.0.0.0/24"))
+	assert.Equal(t, cnierr.ErrFeatureUnavailable, cnierr.Code(err))
+	assert.Nil(t, fake.Table, "nothing is installed")
+	assert.Equal(t, cnierr.ErrFeatureUnavailable, cnierr.Code(fw.CheckForward("cni0", mustCIDR(t, "10.0.0.0/24"))))
+
+	// ip6tables still accepts, so the IPv6 subnet is forwarded.
+	require.NoError(t, fw.AddForward("cni0", mustCIDR(t, "fd00::/64")))
+	assert.NoError(t, fw.CheckForward("cni0", mustCIDR(t, "fd00::/64")))
+}
+
+func TestNFTables_DeleteOwnedWithoutTable(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+
+	assert.NoError(t, NewNFTables(fake, nil, nil).DeleteOwned(Owner{Network: "eureka", ContainerID: "ctr1"}))
+}
+
+func TestNew_UnknownBackend(t *testing.T) {
+	_, err := New("pf")
+	assert.Error(t, err)
+}
+
+func TestNFTables_PortMappings(t *testing.T) {
+	fake := knftables.NewFake(knftables.InetFamily, nftTable)
+	fw := NewNFTables(fake, nil, nil)
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	ctr2 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	mappings := []PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 8443, ContainerPort: 443, Protocol: "tcp", HostIP: net.ParseIP("2001:db8::1")},
+	}
+
+	require.NoError(t, fw.AddSourceNAT(ctr1, mustCIDR(t, "fd00::2/128"), NATPolicy{Bridge: "cni0"}))
+	require.NoError(t, fw.AddPortMappings(ctr1, net.ParseIP("fd00::2"), mappings))
+	require.NoError(t, fw.AddPortMappings(ctr1, net.ParseIP("fd00::2"), mappings))
+
+	for _, base := range []string{nftPreroutingChain, nftOutputChain} {
+		chain := fake.Table.Chains[base]
+		require.NotNil(t, chain)
+		assert.Equal(t, knftables.DNATPriority, *chain.Priority)
+		require.Len(t, chain.Rules, 1)
+		assert.Equal(t, "fib daddr type local jump hostports", chain.Rules[0].Rule)
+	}
+	assert.Equal(t, []string{
+		`meta nfproto ipv6 tcp dport 8080 dnat ip6 to [fd00::2]:80 # name=eureka,id=ctr1,hostport=tcp/8080`,
+		`ip6 daddr 2001:db8::1 tcp dport 8443 dnat ip6 to [fd00::2]:443 # name=eureka,id=ctr1,hostport=tcp/8443/2001:db8::1`,
+	}, nftRules(t, fake, nftHostportsChain))
+	assert.Equal(t, []string{
+		`ip6 saddr fd00::2 ip6 daddr fd00::2 tcp dport 443 masquerade # name=eureka,id=ctr1,hostport=tcp/8443/2001:db8::1`,
+		`ip6 saddr fd00::2 ip6 daddr fd00::2 tcp dport 80 masquerade # name=eureka,id=ctr1,hostport=tcp/8080`,
+		`ip6 saddr fd00::2/128 oifname != "cni0" masquerade # name=eureka,id=ctr1`,
+	}, nftRules(t, fake, nftPostroutingChain))
+
+	err := fw.AddPortMappings(ctr2, net.ParseIP("fd00::3"), []PortMapping{{HostPort: 8443, ContainerPort: 443, Protocol: "tcp"}})
+	require.ErrorContains(t, err, "already mapped")
+
+	require.NoError(t, fw.DeleteOwned(ctr1))
+	assert.Empty(t, fake.Table.Chains[nftHostportsChain].Rules)
+	assert.Empty(t, fake.Table.Chains[nftPostroutingChain].Rules)
+}
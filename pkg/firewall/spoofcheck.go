@@ -0,0 +1,153 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	"sigs.k8s.io/knftables"
+)
+
+const nftSpoofcheckChain = "spoofcheck"
+
+// SpoofChecker pins each bridge port to the addresses of the pod behind it,
+// so a pod cannot take over another pod's IP or MAC on the shared bridge.
+type SpoofChecker interface {
+	// Add drops frames from hostVeth whose source MAC is not mac, or whose
+	// source IP (including ARP sender IP) is not one of ips. It replaces any
+	// rules the owner already had.
+	Add(owner Owner, hostVeth string, mac net.HardwareAddr, ips []net.IP) error
+	// Delete removes the owner's rules.
+	Delete(owner Owner) error
+	// Owners lists the owners on network that have rules installed.
+	Owners(network string) ([]Owner, error)
+}
+
+type nftSpoofChecker struct {
+	nft knftables.Interface
+}
+
+// NewSpoofChecker returns a SpoofChecker over a bridge-family nftables table,
+// which sees frames as they enter the bridge from a port.
+func NewSpoofChecker(nft knftables.Interface) SpoofChecker {
+	return &nftSpoofChecker{nft: nft}
+}
+
+// NewBridgeSpoofChecker returns a SpoofChecker for the host's nft binary.
+func NewBridgeSpoofChecker() (SpoofChecker, error) {
+	nft, err := knftables.New(knftables.BridgeFamily, nftTable)
+	if err != nil {
+		return nil, err
+	}
+	return NewSpoofChecker(nft), nil
+}
+
+func (s *nftSpoofChecker) Add(owner Owner, hostVeth string, mac net.HardwareAddr, ips []net.IP) error {
+	ctx := context.TODO()
+	comment := knftables.PtrTo(owner.Comment())
+	port := knftables.Concat("iifname", fmt.Sprintf("%q", hostVeth))
+
+	var v4, v6 []string
+	for _, ip := range ips {
+		if isIPv4(ip) {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+
+	tx := s.nft.NewTransaction()
+	tx.Add(&knftables.Table{
+		Comment: knftables.PtrTo("rules managed by the eureka CNI plugin"),
+	})
+	tx.Add(&knftables.Chain{
+		Name:     nftSpoofcheckChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PreroutingHook),
+		Priority: knftables.PtrTo(knftables.DNATPriority),
+	})
+	if err := s.deleteRules(ctx, tx, owner); err != nil {
+		return err
+	}
+
+	rules := []string{
+		knftables.Concat(port, "ether saddr !=", mac.String(), "drop"),
+	}
+	if len(v4) > 0 {
+		rules = append(rules,
+			knftables.Concat(port, "ether type arp arp saddr ether !=", mac.String(), "drop"),
+			knftables.Concat(port, "ether type arp arp saddr ip !=", anyOf(v4), "drop"),
+			knftables.Concat(port, "ether type ip ip saddr !=", anyOf(v4), "drop"),
+		)
+	}
+	if len(v6) > 0 {
+		// Neighbor discovery needs the link-local and unspecified sources.
+		rules = append(rules,
+			knftables.Concat(port, "ether type ip6 ip6 saddr !=", anyOf(append([]string{"::", "fe80::/10"}, v6...)), "drop"),
+		)
+	}
+	for _, r := range rules {
+		tx.Add(&knftables.Rule{Chain: nftSpoofcheckChain, Rule: r, Comment: comment})
+	}
+	if err := s.nft.Run(ctx, tx); err != nil {
+		return fmt.Errorf("failed to add spoof check for %s: %w", hostVeth, err)
+	}
+	logging.Logger.Info("spoofcheck_added", "host_veth", hostVeth, "mac", mac.String(), "ips", strings.Join(append(v4, v6...), ","))
+	return nil
+}
+
+func (s *nftSpoofChecker) Delete(owner Owner) error {
+	ctx := context.TODO()
+	tx := s.nft.NewTransaction()
+	if err := s.deleteRules(ctx, tx, owner); err != nil {
+		return err
+	}
+	if tx.NumOperations() == 0 {
+		return nil
+	}
+	return s.nft.Run(ctx, tx)
+}
+
+func (s *nftSpoofChecker) Owners(network string) ([]Owner, error) {
+	rules, err := s.nft.ListRules(context.TODO(), nftSpoofcheckChain)
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list nftables chain %s: %w", nftSpoofcheckChain, err)
+	}
+	var comments []string
+	for _, r := range rules {
+		if r.Comment != nil {
+			comments = append(comments, *r.Comment)
+		}
+	}
+	return ownersOf(network, comments), nil
+}
+
+func (s *nftSpoofChecker) deleteRules(ctx context.Context, tx *knftables.Transaction, owner Owner) error {
+	rules, err := s.nft.ListRules(ctx, nftSpoofcheckChain)
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list nftables chain %s: %w", nftSpoofcheckChain, err)
+	}
+	for _, r := range rules {
+		if r.Comment != nil && owner.owns(*r.Comment) {
+			tx.Delete(&knftables.Rule{Chain: nftSpoofcheckChain, Handle: r.Handle})
+		}
+	}
+	return nil
+}
+
+// anyOf renders values as an anonymous nft set, or a single value as is.
+func anyOf(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return "{ " + strings.Join(values, ", ") + " }"
+}
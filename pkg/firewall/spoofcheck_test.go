@@ -0,0 +1,55 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/knftables"
+)
+
+func TestSpoofCheck_PinsPortToPodAddresses(t *testing.T) {
+	fake := knftables.NewFake(knftables.BridgeFamily, nftTable)
+	sc := NewSpoofChecker(fake)
+	ctr1 := Owner{Network: "eureka", ContainerID: "ctr1"}
+	ctr2 := Owner{Network: "eureka", ContainerID: "ctr2"}
+	mac1, _ := net.ParseMAC("0a:58:0a:00:00:02")
+	mac2, _ := net.ParseMAC("0a:58:0a:00:00:03")
+
+	require.NoError(t, sc.Add(ctr1, "veth1", mac1, []net.IP{net.ParseIP("10.0.0.2")}))
+	require.NoError(t, sc.Add(ctr2, "veth2", mac2, []net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("fd00::3")}))
+	// Re-adding replaces the owner's rules.
+	require.NoError(t, sc.Add(ctr1, "veth1", mac1, []net.IP{net.ParseIP("10.0.0.2")}))
+
+	chain := fake.Table.Chains[nftSpoofcheckChain]
+	require.NotNil(t, chain)
+	assert.Equal(t, knftables.PreroutingHook, *chain.Hook)
+	assert.ElementsMatch(t, []string{
+		`iifname "veth2" ether saddr != 0a:58:0a:00:00:03 drop # name=eureka,id=ctr2`,
+		`iifname "veth2" ether type arp arp saddr ether != 0a:58:0a:00:00:03 drop # name=eureka,id=ctr2`,
+		`iifname "veth2" ether type arp arp saddr ip != 10.0.0.3 drop # name=eureka,id=ctr2`,
+		`iifname "veth2" ether type ip ip saddr != 10.0.0.3 drop # name=eureka,id=ctr2`,
+		`iifname "veth2" ether type ip6 ip6 saddr != { ::, fe80::/10, fd00::3 } drop # name=eureka,id=ctr2`,
+		`iifname "veth1" ether saddr != 0a:58:0a:00:00:02 drop # name=eureka,id=ctr1`,
+		`iifname "veth1" ether type arp arp saddr ether != 0a:58:0a:00:00:02 drop # name=eureka,id=ctr1`,
+		`iifname "veth1" ether type arp arp saddr ip != 10.0.0.2 drop # name=eureka,id=ctr1`,
+		`iifname "veth1" ether type ip ip saddr != 10.0.0.2 drop # name=eureka,id=ctr1`,
+	}, nftRules(t, fake, nftSpoofcheckChain))
+
+	require.NoError(t, sc.Delete(ctr2))
+	assert.Len(t, nftRules(t, fake, nftSpoofcheckChain), 4)
+
+	owners, err := sc.Owners("eureka")
+	require.NoError(t, err)
+	assert.Equal(t, []Owner{ctr1}, owners)
+}
+
+func TestSpoofCheck_DeleteWithoutTable(t *testing.T) {
+	sc := NewSpoofChecker(knftables.NewFake(knftables.BridgeFamily, nftTable))
+
+	assert.NoError(t, sc.Delete(Owner{Network: "eureka", ContainerID: "ctr1"}))
+	owners, err := sc.Owners("eureka")
+	assert.NoError(t, err)
+	assert.Empty(t, owners)
+}
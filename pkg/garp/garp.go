@@ -0,0 +1,159 @@
+package garp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultCount is a single announcement: every further one costs ADD
+	// another interval, and the plugin exits before background sends finish.
+	DefaultCount = 1
+
+	interval = 100 * time.Millisecond
+
+	arpOpRequest   = 1
+	icmpv6NeighAdv = 136
+	// naFlagOverride asks receivers to replace any cached link-layer address.
+	naFlagOverride  = 0x20
+	optTargetLLAddr = 2
+	ipv6HeaderLen   = 40
+	neighAdvLen     = 24
+	ipv6HopLimitNDP = 255
+	ipv6NextICMPv6  = 58
+)
+
+var (
+	ethBroadcast    = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	ipv6AllNodes    = net.ParseIP("ff02::1")
+	ipv6AllNodesMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// Announcer tells neighbors on a link that an address now lives at a MAC,
+// so stale cache entries left by a previous owner of the IP are replaced.
+type Announcer interface {
+	Announce(ifIndex int, mac net.HardwareAddr, ip net.IP, count int) error
+}
+
+type announcer struct{}
+
+func NewAnnouncer() Announcer {
+	return &announcer{}
+}
+
+// Announce sends count gratuitous ARPs for IPv4 or unsolicited neighbor
+// advertisements for IPv6 out of the interface, from the current netns.
+func (*announcer) Announce(ifIndex int, mac net.HardwareAddr, ip net.IP, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if len(mac) != 6 {
+		return fmt.Errorf("unsupported hardware address %q", mac)
+	}
+
+	var proto uint16
+	var dst net.HardwareAddr
+	var payload []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		proto = unix.ETH_P_ARP
+		dst = ethBroadcast
+		payload = gratuitousARP(mac, ip4)
+	} else {
+		proto = unix.ETH_P_IPV6
+		dst = ipv6AllNodesMAC
+		payload = unsolicitedNA(mac, ip.To16())
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(proto)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(proto),
+		Ifindex:  ifIndex,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], dst)
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		if err := unix.Sendto(fd, payload, 0, sa); err != nil {
+			return fmt.Errorf("failed to announce %s: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// gratuitousARP builds an ARP request whose sender and target are both ip.
+func gratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(b[2:4], unix.ETH_P_IP)
+	b[4] = 6
+	b[5] = 4
+	binary.BigEndian.PutUint16(b[6:8], arpOpRequest)
+	copy(b[8:14], mac)
+	copy(b[14:18], ip)
+	// target hardware address stays zero
+	copy(b[24:28], ip)
+	return b
+}
+
+// unsolicitedNA builds an IPv6 packet carrying a neighbor advertisement for
+// ip with the override flag set and a target link-layer address option.
+func unsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	icmp := make([]byte, neighAdvLen+8)
+	icmp[0] = icmpv6NeighAdv
+	icmp[4] = naFlagOverride
+	copy(icmp[8:24], ip)
+	icmp[24] = optTargetLLAddr
+	icmp[25] = 1 // option length in units of 8 octets
+	copy(icmp[26:32], mac)
+
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip, ipv6AllNodes, icmp))
+
+	b := make([]byte, ipv6HeaderLen+len(icmp))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(icmp)))
+	b[6] = ipv6NextICMPv6
+	b[7] = ipv6HopLimitNDP
+	copy(b[8:24], ip)
+	copy(b[24:40], ipv6AllNodes)
+	copy(b[40:], icmp)
+	return b
+}
+
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	add(src.To16())
+	add(dst.To16())
+	sum += uint32(len(msg))
+	sum += ipv6NextICMPv6
+	add(msg)
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,143 @@
+package garp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// setupPair creates a veth pair spanning two throwaway namespaces and returns
+// the sending namespace, its interface, and a packet socket listening on the peer.
+func setupPair(t *testing.T, proto uint16) (ns.NetNS, netlink.Link, int) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+
+	sender, err := testutils.NewNS()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sender.Close()
+		testutils.UnmountNS(sender)
+	})
+	receiver, err := testutils.NewNS()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		receiver.Close()
+		testutils.UnmountNS(receiver)
+	})
+
+	var link netlink.Link
+	require.NoError(t, sender.Do(func(_ ns.NetNS) error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "garp0"},
+			PeerName:  "garp1",
+		}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		peer, err := netlink.LinkByName("garp1")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetNsFd(peer, int(receiver.Fd())); err != nil {
+			return err
+		}
+		if link, err = netlink.LinkByName("garp0"); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}))
+
+	var fd int
+	require.NoError(t, receiver.Do(func(_ ns.NetNS) error {
+		peer, err := netlink.LinkByName("garp1")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(peer); err != nil {
+			return err
+		}
+		fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(proto)))
+		if err != nil {
+			return err
+		}
+		tv := unix.Timeval{Sec: 2}
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return err
+		}
+		return unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(proto), Ifindex: peer.Attrs().Index})
+	}))
+	t.Cleanup(func() { unix.Close(fd) })
+
+	return sender, link, fd
+}
+
+// receive returns the first packet accepted by match, or fails after a deadline.
+func receive(t *testing.T, fd int, match func([]byte) bool) []byte {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		if match(buf[:n]) {
+			return append([]byte(nil), buf[:n]...)
+		}
+	}
+	t.Fatal("announcement not received")
+	return nil
+}
+
+func TestAnnounce_GratuitousARP(t *testing.T) {
+	sender, link, fd := setupPair(t, unix.ETH_P_ARP)
+	ip := net.ParseIP("10.0.0.5").To4()
+	mac := link.Attrs().HardwareAddr
+
+	require.NoError(t, sender.Do(func(_ ns.NetNS) error {
+		return NewAnnouncer().Announce(link.Attrs().Index, mac, ip, 1)
+	}))
+
+	pkt := receive(t, fd, func(b []byte) bool { return len(b) >= 28 })
+	assert.Equal(t, uint16(arpOpRequest), binary.BigEndian.Uint16(pkt[6:8]))
+	assert.Equal(t, mac, net.HardwareAddr(pkt[8:14]))
+	assert.Equal(t, ip, net.IP(pkt[14:18]), "sender IP")
+	assert.Equal(t, ip, net.IP(pkt[24:28]), "target IP")
+}
+
+func TestAnnounce_UnsolicitedNA(t *testing.T) {
+	sender, link, fd := setupPair(t, unix.ETH_P_IPV6)
+	ip := net.ParseIP("fd00::5")
+	mac := link.Attrs().HardwareAddr
+
+	require.NoError(t, sender.Do(func(_ ns.NetNS) error {
+		return NewAnnouncer().Announce(link.Attrs().Index, mac, ip, 1)
+	}))
+
+	pkt := receive(t, fd, func(b []byte) bool {
+		return len(b) >= ipv6HeaderLen+neighAdvLen && b[6] == ipv6NextICMPv6 && b[ipv6HeaderLen] == icmpv6NeighAdv
+	})
+	icmp := pkt[ipv6HeaderLen:]
+	assert.Equal(t, ip, net.IP(pkt[8:24]), "source address")
+	assert.Equal(t, uint8(ipv6HopLimitNDP), pkt[7])
+	assert.Equal(t, uint8(naFlagOverride), icmp[4])
+	assert.Equal(t, ip, net.IP(icmp[8:24]), "target address")
+	assert.Equal(t, mac, net.HardwareAddr(icmp[26:32]), "target link-layer option")
+	assert.Zero(t, icmpv6Checksum(pkt[8:24], pkt[24:40], icmp), "checksum must verify")
+}
+
+func TestAnnounce_ZeroCountIsNoop(t *testing.T) {
+	err := NewAnnouncer().Announce(0, nil, net.ParseIP("10.0.0.5"), 0)
+	assert.NoError(t, err)
+}
@@ -7,10 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/innfi/probable-eureka/pkg/cnierr"
 	"github.com/innfi/probable-eureka/pkg/config"
 	"github.com/innfi/probable-eureka/pkg/logging"
 
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/vishvananda/netlink"
 )
 
@@ -18,11 +21,31 @@ const (
 	defaultDataDir  = "/var/lib/cni/networks"
 	lockFileName    = ".lock"
 	allocationsFile = "allocations.json"
+	// lockPollInterval is how often tryLock retries a held lock.
+	lockPollInterval = 20 * time.Millisecond
 )
 
 type Allocation struct {
 	IP          string `json:"ip"`
 	ContainerID string `json:"container_id"`
+	IfName      string `json:"ifname,omitempty"`
+	HostVeth    string `json:"host_veth,omitempty"`
+	Netns       string `json:"netns,omitempty"`
+	// AllocatedAt is zero for records written before it was tracked.
+	AllocatedAt time.Time `json:"allocated_at,omitzero"`
+	// Reserved marks an address taken out of the pool by an operator; it
+	// belongs to no container and is only freed by ReleaseIP.
+	Reserved bool   `json:"reserved,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+// matches reports whether the allocation belongs to the given attachment.
+// Records written before ifname was tracked match any interface of the container.
+func (a Allocation) matches(containerID, ifName string) bool {
+	if a.Reserved || a.ContainerID != containerID {
+		return false
+	}
+	return ifName == "" || a.IfName == "" || a.IfName == ifName
 }
 
 type AllocationStore struct {
@@ -32,13 +55,14 @@ type AllocationStore struct {
 type IPAM struct {
 	config     *config.IPAMConfig
 	netlinkAdd func(link netlink.Link, addr *netlink.Addr) error
+	onLock     func() func()
 }
 
 func NewIPAM(config *config.IPAMConfig) IPAM {
 	return IPAM{config: config, netlinkAdd: netlink.AddrAdd}
 }
 
-func (ipam *IPAM) BindNewAddr(link netlink.Link, containerID string) (*netlink.Addr, error) {
+func (ipam *IPAM) BindNewAddr(link netlink.Link, containerID, ifName, hostVeth, netns string) (*netlink.Addr, error) {
 	unlock, err := ipam.acquireLock()
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire lock: %w", err)
@@ -54,7 +78,14 @@ func (ipam *IPAM) BindNewAddr(link netlink.Link, containerID string) (*netlink.A
 		return nil, err
 	}
 
-	if err := ipam.saveAllocation(addr.IP.String(), containerID); err != nil {
+	if err := ipam.saveAllocation(Allocation{
+		IP:          addr.IP.String(),
+		ContainerID: containerID,
+		IfName:      ifName,
+		HostVeth:    hostVeth,
+		Netns:       netns,
+		AllocatedAt: time.Now().UTC(),
+	}); err != nil {
 		return nil, fmt.Errorf("failed to save allocation: %w", err)
 	}
 
@@ -73,27 +104,82 @@ func (ipam *IPAM) dataDir() string {
 	return defaultDataDir
 }
 
+// Lock takes the data directory lock for callers that must serialize with
+// allocations, such as bridge creation and removal. The lock is not re-entrant:
+// release it before calling any other IPAM method.
+func (ipam *IPAM) Lock() (func(), error) {
+	return ipam.acquireLock()
+}
+
+// ObserveLock registers fn to be called when a lock is requested; the
+// function it returns is called once the lock is held or failed, so
+// callers can measure the wait.
+func (ipam *IPAM) ObserveLock(fn func() func()) {
+	ipam.onLock = fn
+}
+
 func (ipam *IPAM) acquireLock() (func(), error) {
-	dir := ipam.dataDir()
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	if ipam.onLock != nil {
+		defer ipam.onLock()()
 	}
 
-	lockPath := filepath.Join(dir, lockFileName)
-	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	f, err := ipam.openLockFile()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open lock file: %w", err)
+		return nil, err
 	}
 
 	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
 		f.Close()
-		return nil, fmt.Errorf("failed to acquire file lock: %w", err)
+		return nil, cnierr.Errorf(types.ErrTryAgainLater, "failed to acquire file lock: %w", err)
+	}
+
+	return unlockFunc(f), nil
+}
+
+// tryLock is acquireLock that gives up after timeout, for checks that must
+// not hang behind a stuck holder.
+func (ipam *IPAM) tryLock(timeout time.Duration) (func(), error) {
+	f, err := ipam.openLockFile()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return unlockFunc(f), nil
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, cnierr.Errorf(types.ErrTryAgainLater, "lock not acquired within %s", timeout)
+			}
+			return nil, cnierr.Errorf(types.ErrTryAgainLater, "failed to acquire file lock: %w", err)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (ipam *IPAM) openLockFile() (*os.File, error) {
+	dir := ipam.dataDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, cnierr.Errorf(types.ErrIOFailure, "failed to create data directory: %w", err)
+	}
+
+	lockPath := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, cnierr.Errorf(types.ErrIOFailure, "failed to open lock file: %w", err)
 	}
+	return f, nil
+}
 
+func unlockFunc(f *os.File) func() {
 	return func() {
 		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
 		f.Close()
-	}, nil
+	}
 }
 
 func (ipam *IPAM) loadAllocations() (*AllocationStore, error) {
@@ -104,36 +190,40 @@ func (ipam *IPAM) loadAllocations() (*AllocationStore, error) {
 		if os.IsNotExist(err) {
 			return &AllocationStore{Allocations: []Allocation{}}, nil
 		}
-		return nil, fmt.Errorf("failed to read allocations file: %w", err)
+		return nil, cnierr.Errorf(types.ErrIOFailure, "failed to read allocations file: %w", err)
 	}
 
 	var store AllocationStore
 	if err := json.Unmarshal(data, &store); err != nil {
-		return nil, fmt.Errorf("failed to parse allocations file: %w", err)
+		return nil, cnierr.Errorf(types.ErrIOFailure, "failed to parse allocations file: %w", err)
 	}
 
 	return &store, nil
 }
 
-func (ipam *IPAM) saveAllocation(ip, containerID string) error {
+func (ipam *IPAM) saveAllocation(alloc Allocation) error {
 	store, err := ipam.loadAllocations()
 	if err != nil {
 		return err
 	}
 
-	store.Allocations = append(store.Allocations, Allocation{
-		IP:          ip,
-		ContainerID: containerID,
-	})
+	store.Allocations = append(store.Allocations, alloc)
+	return ipam.writeAllocations(store.Allocations)
+}
 
-	data, err := json.MarshalIndent(store, "", "  ")
+func (ipam *IPAM) writeAllocations(allocs []Allocation) error {
+	if allocs == nil {
+		allocs = []Allocation{}
+	}
+
+	data, err := json.MarshalIndent(&AllocationStore{Allocations: allocs}, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal allocations: %w", err)
 	}
 
 	allocPath := filepath.Join(ipam.dataDir(), allocationsFile)
 	if err := os.WriteFile(allocPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write allocations file: %w", err)
+		return cnierr.Errorf(types.ErrIOFailure, "failed to write allocations file: %w", err)
 	}
 
 	return nil
@@ -141,35 +231,9 @@ func (ipam *IPAM) saveAllocation(ip, containerID string) error {
 
 func (ipam *IPAM) parseIPRange() (startIP, endIP net.IP, subnet *net.IPNet, err error) {
 	if len(ipam.config.Ranges) == 0 || len(ipam.config.Ranges[0]) == 0 {
-		return nil, nil, nil, fmt.Errorf("no IP ranges configured")
-	}
-
-	rangeConfig := ipam.config.Ranges[0][0]
-
-	_, subnet, err = net.ParseCIDR(rangeConfig.Subnet)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to parse subnet %s: %w", rangeConfig.Subnet, err)
-	}
-
-	if rangeConfig.RangeStart != "" {
-		startIP = net.ParseIP(rangeConfig.RangeStart)
-		if startIP == nil {
-			return nil, nil, nil, fmt.Errorf("failed to parse rangeStart %s", rangeConfig.RangeStart)
-		}
-	} else {
-		startIP = nextIP(subnet.IP)
-	}
-
-	if rangeConfig.RangeEnd != "" {
-		endIP = net.ParseIP(rangeConfig.RangeEnd)
-		if endIP == nil {
-			return nil, nil, nil, fmt.Errorf("failed to parse rangeEnd %s", rangeConfig.RangeEnd)
-		}
-	} else {
-		endIP = lastIP(subnet)
+		return nil, nil, nil, cnierr.Errorf(types.ErrInvalidNetworkConfig, "no IP ranges configured")
 	}
-
-	return startIP, endIP, subnet, nil
+	return rangeBounds(ipam.config.Ranges[0][0])
 }
 
 func (ipam *IPAM) newAddr() (*netlink.Addr, error) {
@@ -178,9 +242,12 @@ func (ipam *IPAM) newAddr() (*netlink.Addr, error) {
 		return nil, err
 	}
 
-	ip := ipam.findAvailableIP(startIP, endIP)
+	ip, err := ipam.findAvailableIP(startIP, endIP)
+	if err != nil {
+		return nil, err
+	}
 	if ip == nil {
-		return nil, fmt.Errorf("no available IP addresses in range")
+		return nil, cnierr.Errorf(cnierr.ErrPoolExhausted, "no available IP addresses in range")
 	}
 
 	maskSize, _ := subnet.Mask.Size()
@@ -189,68 +256,162 @@ func (ipam *IPAM) newAddr() (*netlink.Addr, error) {
 	return netlink.ParseAddr(addrStr)
 }
 
-func (ipam *IPAM) findAvailableIP(start, end net.IP) net.IP {
+// findAvailableIP returns the first free address, or nil if none is left.
+func (ipam *IPAM) findAvailableIP(start, end net.IP) (net.IP, error) {
 	store, err := ipam.loadAllocations()
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	return firstFree(start, end, ipam.inUse(store)), nil
+}
 
+func allocatedSet(store *AllocationStore) map[string]bool {
 	allocatedIPs := make(map[string]bool)
 	for _, alloc := range store.Allocations {
 		allocatedIPs[alloc.IP] = true
 	}
+	return allocatedIPs
+}
+
+// inUse returns the addresses no pod may be given: the allocated ones and
+// the gateway of every range, which the bridge holds.
+func (ipam *IPAM) inUse(store *AllocationStore) map[string]bool {
+	used := allocatedSet(store)
+	for _, set := range ipam.config.Ranges {
+		for _, r := range set {
+			if gw := net.ParseIP(r.Gateway); gw != nil {
+				used[gw.String()] = true
+			}
+		}
+	}
+	return used
+}
 
+// firstFree returns the first address from start to end not in allocated,
+// or nil when there is none.
+func firstFree(start, end net.IP, allocated map[string]bool) net.IP {
 	for ip := cloneIP(start); !ipGreaterThan(ip, end); ip = nextIP(ip) {
-		if !allocatedIPs[ip.String()] {
+		if !allocated[ip.String()] {
 			return ip
 		}
 	}
-
 	return nil
 }
 
-func (ipam *IPAM) ReleaseAddr(containerID string) error {
+// ReleaseAddr frees the allocations held by the given attachment and returns them.
+// An empty ifName releases every allocation of the container.
+func (ipam *IPAM) ReleaseAddr(containerID, ifName string) ([]Allocation, error) {
 	unlock, err := ipam.acquireLock()
 	if err != nil {
-		return fmt.Errorf("failed to acquire lock: %w", err)
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
 	}
 	defer unlock()
 
 	store, err := ipam.loadAllocations()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var kept []Allocation
+	var released []Allocation
 	for _, alloc := range store.Allocations {
-		if alloc.ContainerID == containerID {
+		if alloc.matches(containerID, ifName) {
 			logging.Logger.Info("ip_released",
 				"ip", alloc.IP,
 				"container_id", containerID,
+				"ifname", alloc.IfName,
 			)
+			released = append(released, alloc)
 		} else {
 			kept = append(kept, alloc)
 		}
 	}
 
-	if kept == nil {
-		kept = []Allocation{}
+	if err := ipam.writeAllocations(kept); err != nil {
+		return nil, err
 	}
 
-	data, err := json.MarshalIndent(&AllocationStore{Allocations: kept}, "", "  ")
+	return released, nil
+}
+
+// ReleaseOrphans frees the allocations gone reports as belonging to a pod
+// that no longer exists, or with dryRun only returns them. gone is called
+// under the lock, so an ADD cannot record an allocation in the meantime; it
+// must not call back into the IPAM.
+func (ipam *IPAM) ReleaseOrphans(gone func(Allocation) bool, dryRun bool) ([]Allocation, error) {
+	unlock, err := ipam.acquireLock()
 	if err != nil {
-		return fmt.Errorf("failed to marshal allocations: %w", err)
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer unlock()
+
+	store, err := ipam.loadAllocations()
+	if err != nil {
+		return nil, err
 	}
 
-	allocPath := filepath.Join(ipam.dataDir(), allocationsFile)
-	if err := os.WriteFile(allocPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write allocations file: %w", err)
+	var kept []Allocation
+	var orphans []Allocation
+	for _, alloc := range store.Allocations {
+		if !alloc.Reserved && gone(alloc) {
+			orphans = append(orphans, alloc)
+		} else {
+			kept = append(kept, alloc)
+		}
 	}
 
+	if len(orphans) == 0 || dryRun {
+		return orphans, nil
+	}
+	if err := ipam.writeAllocations(kept); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// ReserveIP takes ip out of the pool so that it is never handed to a
+// container. The address must lie in a configured range and be free.
+func (ipam *IPAM) ReserveIP(ip net.IP, note string) error {
+	if !ipam.InRange(ip) {
+		return fmt.Errorf("%s is not in any configured range", ip)
+	}
+
+	unlock, err := ipam.acquireLock()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer unlock()
+
+	store, err := ipam.loadAllocations()
+	if err != nil {
+		return err
+	}
+	for _, alloc := range store.Allocations {
+		if net.ParseIP(alloc.IP).Equal(ip) {
+			if alloc.Reserved {
+				return fmt.Errorf("%s is already reserved", ip)
+			}
+			return fmt.Errorf("%s is allocated to container %s", ip, alloc.ContainerID)
+		}
+	}
+
+	store.Allocations = append(store.Allocations, Allocation{
+		IP:          ip.String(),
+		AllocatedAt: time.Now().UTC(),
+		Reserved:    true,
+		Note:        note,
+	})
+	if err := ipam.writeAllocations(store.Allocations); err != nil {
+		return err
+	}
+
+	logging.Logger.Info("ip_reserved", "ip", ip.String(), "note", note)
 	return nil
 }
 
-func (ipam *IPAM) ReleaseStaleAllocations(validContainerIDs map[string]bool) ([]Allocation, error) {
+// ReleaseIP frees ip whoever holds it, container or reservation, and
+// returns the record it removed.
+func (ipam *IPAM) ReleaseIP(ip net.IP) (*Allocation, error) {
 	unlock, err := ipam.acquireLock()
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire lock: %w", err)
@@ -262,47 +423,172 @@ func (ipam *IPAM) ReleaseStaleAllocations(validContainerIDs map[string]bool) ([]
 		return nil, err
 	}
 
+	var released *Allocation
 	var kept []Allocation
-	var released []Allocation
 	for _, alloc := range store.Allocations {
+		if released == nil && net.ParseIP(alloc.IP).Equal(ip) {
+			released = &alloc
+			continue
+		}
+		kept = append(kept, alloc)
+	}
+	if released == nil {
+		return nil, fmt.Errorf("%s is not allocated", ip)
+	}
+	if err := ipam.writeAllocations(kept); err != nil {
+		return nil, err
+	}
+
+	logging.Logger.Info("ip_released",
+		"ip", released.IP,
+		"container_id", released.ContainerID,
+		"reserved", released.Reserved,
+	)
+	return released, nil
+}
+
+// Allocations returns a snapshot of the allocation store taken under the lock.
+func (ipam *IPAM) Allocations() ([]Allocation, error) {
+	unlock, err := ipam.acquireLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer unlock()
+
+	store, err := ipam.loadAllocations()
+	if err != nil {
+		return nil, err
+	}
+	return store.Allocations, nil
+}
+
+// ReleaseStaleAllocations frees the allocations of containers missing from
+// validContainerIDs. Allocations younger than gracePeriod are kept: their
+// ADD may still be in flight, not yet known to the runtime's GC list. The
+// age is judged under the store lock, so an ADD that binds while GC runs is
+// never freed. With dryRun the allocations are only reported.
+func (ipam *IPAM) ReleaseStaleAllocations(validContainerIDs map[string]bool, gracePeriod time.Duration, dryRun bool) ([]Allocation, error) {
+	now := time.Now()
+	return ipam.ReleaseOrphans(func(alloc Allocation) bool {
 		if validContainerIDs[alloc.ContainerID] {
-			kept = append(kept, alloc)
-		} else {
-			released = append(released, alloc)
+			return false
 		}
+		return alloc.AllocatedAt.IsZero() || now.Sub(alloc.AllocatedAt) >= gracePeriod
+	}, dryRun)
+}
+
+// CheckStatus reports whether an ADD could get an address: the data
+// directory is usable, the lock can be taken within lockTimeout, the
+// allocations file parses and the range ADD allocates from has a free
+// address.
+func (ipam *IPAM) CheckStatus(lockTimeout time.Duration) error {
+	start, end, _, err := ipam.parseIPRange()
+	if err != nil {
+		return err
 	}
 
-	if len(released) == 0 {
-		return nil, nil
+	unlock, err := ipam.tryLock(lockTimeout)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	data, err := json.MarshalIndent(&AllocationStore{Allocations: kept}, "", "  ")
+	store, err := ipam.loadAllocations()
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal allocations: %w", err)
+		return err
+	}
+	if firstFree(start, end, ipam.inUse(store)) == nil {
+		return cnierr.Errorf(cnierr.ErrPoolExhausted, "no available IP addresses in range %s-%s", start, end)
 	}
+	return nil
+}
 
-	allocPath := filepath.Join(ipam.dataDir(), allocationsFile)
-	if err := os.WriteFile(allocPath, data, 0644); err != nil {
-		return nil, fmt.Errorf("failed to write allocations file: %w", err)
+// RangeUsage is the occupancy of one configured range.
+type RangeUsage struct {
+	// Range is the subnet, or start-end when the range is narrowed.
+	Range     string
+	Size      float64
+	Allocated int
+}
+
+// Usage reports how many addresses of each configured range are allocated.
+func (ipam *IPAM) Usage() ([]RangeUsage, error) {
+	unlock, err := ipam.acquireLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	store, err := ipam.loadAllocations()
+	unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	return released, nil
+	var out []RangeUsage
+	for _, set := range ipam.config.Ranges {
+		for _, r := range set {
+			start, end, subnet, err := rangeBounds(r)
+			if err != nil {
+				return nil, err
+			}
+			label := subnet.String()
+			if r.RangeStart != "" || r.RangeEnd != "" {
+				label = start.String() + "-" + end.String()
+			}
+			u := RangeUsage{Range: label, Size: rangeSize(start, end)}
+			for _, alloc := range store.Allocations {
+				ip := net.ParseIP(alloc.IP)
+				if ip != nil && (ip.To4() == nil) == (start.To4() == nil) &&
+					!ipGreaterThan(start, ip) && !ipGreaterThan(ip, end) {
+					u.Allocated++
+				}
+			}
+			out = append(out, u)
+		}
+	}
+	return out, nil
 }
 
-func (ipam *IPAM) CheckStatus() error {
-	dir := ipam.dataDir()
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("IPAM data directory not accessible: %w", err)
+// InRange reports whether ip lies in one of the configured ranges.
+func (ipam *IPAM) InRange(ip net.IP) bool {
+	for _, set := range ipam.config.Ranges {
+		for _, r := range set {
+			start, end, _, err := rangeBounds(r)
+			if err != nil {
+				continue
+			}
+			if (ip.To4() == nil) == (start.To4() == nil) && !ipGreaterThan(start, ip) && !ipGreaterThan(ip, end) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	startIP, endIP, _, err := ipam.parseIPRange()
+// rangeBounds resolves a range to its first and last usable address; they
+// default to the subnet's second and second-to-last addresses.
+func rangeBounds(r config.Range) (startIP, endIP net.IP, subnet *net.IPNet, err error) {
+	_, subnet, err = net.ParseCIDR(r.Subnet)
 	if err != nil {
-		return err
+		return nil, nil, nil, cnierr.Errorf(types.ErrInvalidNetworkConfig, "failed to parse subnet %s: %w", r.Subnet, err)
 	}
 
-	if ipam.findAvailableIP(startIP, endIP) == nil {
-		return fmt.Errorf("no available IP addresses in configured range")
+	if r.RangeStart != "" {
+		startIP = net.ParseIP(r.RangeStart)
+		if startIP == nil {
+			return nil, nil, nil, cnierr.Errorf(types.ErrInvalidNetworkConfig, "failed to parse rangeStart %s", r.RangeStart)
+		}
+	} else {
+		startIP = nextIP(subnet.IP)
 	}
 
-	return nil
+	if r.RangeEnd != "" {
+		endIP = net.ParseIP(r.RangeEnd)
+		if endIP == nil {
+			return nil, nil, nil, cnierr.Errorf(types.ErrInvalidNetworkConfig, "failed to parse rangeEnd %s", r.RangeEnd)
+		}
+	} else {
+		endIP = lastIP(subnet)
+	}
+
+	return startIP, endIP, subnet, nil
 }
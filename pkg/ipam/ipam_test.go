@@ -2,11 +2,15 @@ package ipam
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/innfi/probable-eureka/pkg/cnierr"
 	"github.com/innfi/probable-eureka/pkg/config"
 	"github.com/innfi/probable-eureka/pkg/logging"
 	"github.com/stretchr/testify/assert"
@@ -60,7 +64,8 @@ func TestReleaseAddr_RemovesAllocation(t *testing.T) {
 		{IP: "10.0.0.2", ContainerID: "container-1"},
 	})
 
-	require.NoError(t, i.ReleaseAddr("container-1"))
+	_, err := i.ReleaseAddr("container-1", "")
+	require.NoError(t, err)
 
 	store, err := i.loadAllocations()
 	require.NoError(t, err)
@@ -73,7 +78,8 @@ func TestReleaseAddr_UnknownContainerIDIsNoop(t *testing.T) {
 		{IP: "10.0.0.2", ContainerID: "container-1"},
 	})
 
-	require.NoError(t, i.ReleaseAddr("container-unknown"))
+	_, err := i.ReleaseAddr("container-unknown", "")
+	require.NoError(t, err)
 
 	store, err := i.loadAllocations()
 	require.NoError(t, err)
@@ -81,18 +87,38 @@ func TestReleaseAddr_UnknownContainerIDIsNoop(t *testing.T) {
 	require.Equal(t, "container-1", store.Allocations[0].ContainerID)
 }
 
+func TestReleaseAddr_OnlyMatchingInterface(t *testing.T) {
+	i := makeIPAM(t)
+	writeAllocations(t, i.dataDir(), []Allocation{
+		{IP: "10.0.0.2", ContainerID: "container-1", IfName: "eth0", HostVeth: "veth0123456789a"},
+		{IP: "10.0.0.3", ContainerID: "container-1", IfName: "net1", HostVeth: "vethabcdef01234"},
+	})
+
+	released, err := i.ReleaseAddr("container-1", "net1")
+	require.NoError(t, err)
+	require.Len(t, released, 1)
+	assert.Equal(t, "vethabcdef01234", released[0].HostVeth)
+
+	store, err := i.loadAllocations()
+	require.NoError(t, err)
+	require.Len(t, store.Allocations, 1)
+	assert.Equal(t, "eth0", store.Allocations[0].IfName)
+}
+
 func TestReleaseAddr_IPReuse(t *testing.T) {
 	i := makeIPAM(t)
 	writeAllocations(t, i.dataDir(), []Allocation{
 		{IP: "10.0.0.2", ContainerID: "container-1"},
 	})
 
-	require.NoError(t, i.ReleaseAddr("container-1"))
+	_, err := i.ReleaseAddr("container-1", "")
+	require.NoError(t, err)
 
 	// After release, findAvailableIP should return 10.0.0.2 (first in range) again.
 	start, end, _, err := i.parseIPRange()
 	require.NoError(t, err)
-	ip := i.findAvailableIP(start, end)
+	ip, err := i.findAvailableIP(start, end)
+	require.NoError(t, err)
 	require.NotNil(t, ip)
 	require.Equal(t, "10.0.0.2", ip.String())
 }
@@ -106,7 +132,7 @@ func TestBindNewAddr(t *testing.T) {
 			name: "allocates IP in configured range",
 			run: func(t *testing.T) {
 				i := makeIPAM(t)
-				addr, err := i.BindNewAddr(&mockLink{}, "ctr1")
+				addr, err := i.BindNewAddr(&mockLink{}, "ctr1", "eth0", "", "")
 				require.NoError(t, err)
 				_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
 				assert.True(t, subnet.Contains(addr.IP), "allocated IP %s not in subnet", addr.IP)
@@ -117,9 +143,9 @@ func TestBindNewAddr(t *testing.T) {
 			name: "two allocations get different IPs",
 			run: func(t *testing.T) {
 				i := makeIPAM(t)
-				addr1, err := i.BindNewAddr(&mockLink{}, "ctr1")
+				addr1, err := i.BindNewAddr(&mockLink{}, "ctr1", "eth0", "", "")
 				require.NoError(t, err)
-				addr2, err := i.BindNewAddr(&mockLink{}, "ctr2")
+				addr2, err := i.BindNewAddr(&mockLink{}, "ctr2", "eth0", "", "")
 				require.NoError(t, err)
 				assert.NotEqual(t, addr1.IP.String(), addr2.IP.String())
 			},
@@ -128,15 +154,16 @@ func TestBindNewAddr(t *testing.T) {
 			name: "ReleaseAddr then BindNewAddr reuses the freed IP",
 			run: func(t *testing.T) {
 				i := makeIPAM(t)
-				addr1, err := i.BindNewAddr(&mockLink{}, "ctr1")
+				addr1, err := i.BindNewAddr(&mockLink{}, "ctr1", "eth0", "", "")
 				require.NoError(t, err)
 
-				_, err = i.BindNewAddr(&mockLink{}, "ctr2")
+				_, err = i.BindNewAddr(&mockLink{}, "ctr2", "eth0", "", "")
 				require.NoError(t, err)
 
-				require.NoError(t, i.ReleaseAddr("ctr1"))
+				_, err = i.ReleaseAddr("ctr1", "eth0")
+				require.NoError(t, err)
 
-				addr3, err := i.BindNewAddr(&mockLink{}, "ctr3")
+				addr3, err := i.BindNewAddr(&mockLink{}, "ctr3", "eth0", "", "")
 				require.NoError(t, err)
 				assert.Equal(t, addr1.IP.String(), addr3.IP.String(), "ctr3 should reuse ctr1's IP")
 			},
@@ -175,13 +202,24 @@ func TestReleaseStaleAllocations(t *testing.T) {
 			wantReleased: nil,
 			wantKept:     []string{"ctr1"},
 		},
+		{
+			name: "keeps allocations within the grace period",
+			initial: []Allocation{
+				{IP: "10.0.0.2", ContainerID: "old", AllocatedAt: time.Now().Add(-time.Hour)},
+				{IP: "10.0.0.3", ContainerID: "new", AllocatedAt: time.Now()},
+				{IP: "10.0.0.4", ContainerID: "legacy"},
+			},
+			validIDs:     map[string]bool{},
+			wantReleased: []string{"old", "legacy"},
+			wantKept:     []string{"new"},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			i := makeIPAM(t)
 			writeAllocations(t, i.dataDir(), tc.initial)
 
-			released, err := i.ReleaseStaleAllocations(tc.validIDs)
+			released, err := i.ReleaseStaleAllocations(tc.validIDs, time.Minute, false)
 			require.NoError(t, err)
 
 			var releasedIDs []string
@@ -201,6 +239,28 @@ func TestReleaseStaleAllocations(t *testing.T) {
 	}
 }
 
+func TestBindNewAddr_SkipsGateway(t *testing.T) {
+	i := NewIPAM(&config.IPAMConfig{
+		DataDir: t.TempDir(),
+		Ranges:  [][]config.Range{{{Subnet: "10.0.0.0/29", Gateway: "10.0.0.1"}}},
+	})
+	i.netlinkAdd = noopAddrAdd
+
+	var got []string
+	for n := range 5 {
+		addr, err := i.BindNewAddr(&mockLink{}, fmt.Sprintf("ctr%d", n), "eth0", "", "")
+		require.NoError(t, err)
+		got = append(got, addr.IP.String())
+	}
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}, got,
+		"the bridge's gateway address is never handed to a pod")
+
+	_, err := i.BindNewAddr(&mockLink{}, "ctr5", "eth0", "", "")
+	assert.Equal(t, cnierr.ErrPoolExhausted, cnierr.Code(err))
+	assert.Equal(t, cnierr.ErrPoolExhausted, cnierr.Code(i.CheckStatus(time.Second)),
+		"STATUS does not count the gateway as free")
+}
+
 func TestCheckStatus(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -227,7 +287,7 @@ func TestCheckStatus(t *testing.T) {
 				Ranges:  tc.ranges,
 			})
 			i.netlinkAdd = noopAddrAdd
-			err := i.CheckStatus()
+			err := i.CheckStatus(time.Second)
 			if tc.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -236,3 +296,178 @@ func TestCheckStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckStatus_Readiness(t *testing.T) {
+	t.Run("lock held past the timeout", func(t *testing.T) {
+		i := makeIPAM(t)
+		unlock, err := i.Lock()
+		require.NoError(t, err)
+		defer unlock()
+
+		err = i.CheckStatus(50 * time.Millisecond)
+		assert.Equal(t, types.ErrTryAgainLater, cnierr.Code(err))
+		assert.ErrorContains(t, err, "within 50ms")
+	})
+
+	t.Run("unparsable allocations file", func(t *testing.T) {
+		i := makeIPAM(t)
+		require.NoError(t, os.WriteFile(filepath.Join(i.dataDir(), allocationsFile), []byte("{"), 0644))
+
+		assert.Equal(t, types.ErrIOFailure, cnierr.Code(i.CheckStatus(time.Second)))
+	})
+
+	t.Run("the range ADD allocates from is exhausted", func(t *testing.T) {
+		i := makeIPAM(t)
+		var allocs []Allocation
+		for n := 2; n <= 10; n++ {
+			allocs = append(allocs, Allocation{IP: fmt.Sprintf("10.0.0.%d", n), ContainerID: fmt.Sprintf("ctr%d", n)})
+		}
+		writeAllocations(t, i.dataDir(), allocs)
+		i.config.Ranges = append(i.config.Ranges, []config.Range{{Subnet: "fd00::/120"}})
+
+		err := i.CheckStatus(time.Second)
+		assert.Equal(t, cnierr.ErrPoolExhausted, cnierr.Code(err), "free addresses elsewhere do not help ADD")
+		assert.ErrorContains(t, err, "10.0.0.2-10.0.0.10")
+	})
+
+	t.Run("other ranges are not counted", func(t *testing.T) {
+		i := makeIPAM(t)
+		i.config.Ranges = append(i.config.Ranges, []config.Range{{Subnet: "fd00::/126"}})
+		writeAllocations(t, i.dataDir(), []Allocation{
+			{IP: "fd00::1", ContainerID: "ctr1"},
+			{IP: "fd00::2", ContainerID: "ctr2"},
+		})
+
+		assert.NoError(t, i.CheckStatus(time.Second))
+	})
+}
+
+func TestUsage(t *testing.T) {
+	i := makeIPAM(t)
+	i.config.Ranges = append(i.config.Ranges, []config.Range{{Subnet: "fd00::/120"}})
+	writeAllocations(t, i.dataDir(), []Allocation{
+		{IP: "10.0.0.2", ContainerID: "ctr1"},
+		{IP: "10.0.0.3", ContainerID: "ctr2"},
+		{IP: "10.0.0.200", ContainerID: "outside"},
+		{IP: "fd00::5", ContainerID: "ctr3"},
+	})
+
+	usage, err := i.Usage()
+
+	require.NoError(t, err)
+	assert.Equal(t, []RangeUsage{
+		{Range: "10.0.0.2-10.0.0.10", Size: 9, Allocated: 2},
+		{Range: "fd00::/120", Size: 254, Allocated: 1},
+	}, usage)
+}
+
+func TestErrorCodes(t *testing.T) {
+	t.Run("exhausted pool", func(t *testing.T) {
+		i := makeIPAM(t)
+		var allocs []Allocation
+		for n := 2; n <= 10; n++ {
+			allocs = append(allocs, Allocation{IP: fmt.Sprintf("10.0.0.%d", n), ContainerID: fmt.Sprintf("ctr%d", n)})
+		}
+		writeAllocations(t, i.dataDir(), allocs)
+
+		_, err := i.BindNewAddr(nil, "new", "eth0", "", "")
+		assert.Equal(t, cnierr.ErrPoolExhausted, cnierr.Code(err))
+		assert.Equal(t, cnierr.ErrPoolExhausted, cnierr.Code(i.CheckStatus(time.Second)))
+	})
+
+	t.Run("corrupt store is not reported as exhaustion", func(t *testing.T) {
+		i := makeIPAM(t)
+		require.NoError(t, os.WriteFile(filepath.Join(i.dataDir(), allocationsFile), []byte("{"), 0644))
+
+		_, err := i.BindNewAddr(nil, "new", "eth0", "", "")
+		assert.Equal(t, types.ErrIOFailure, cnierr.Code(err))
+	})
+
+	t.Run("bad range", func(t *testing.T) {
+		i := makeIPAM(t)
+		i.config.Ranges = [][]config.Range{{{Subnet: "10.0.0.0/33"}}}
+
+		_, err := i.BindNewAddr(nil, "new", "eth0", "", "")
+		assert.Equal(t, types.ErrInvalidNetworkConfig, cnierr.Code(err))
+	})
+}
+
+func TestReserveIP(t *testing.T) {
+	i := makeIPAM(t)
+	writeAllocations(t, i.dataDir(), []Allocation{{IP: "10.0.0.3", ContainerID: "ctr1"}})
+
+	require.NoError(t, i.ReserveIP(net.ParseIP("10.0.0.2"), "router"))
+	assert.ErrorContains(t, i.ReserveIP(net.ParseIP("10.0.0.2"), ""), "already reserved")
+	assert.ErrorContains(t, i.ReserveIP(net.ParseIP("10.0.0.3"), ""), "allocated to container ctr1")
+	assert.ErrorContains(t, i.ReserveIP(net.ParseIP("10.0.0.11"), ""), "not in any configured range")
+
+	// The reservation is skipped by allocation and survives GC and DEL.
+	addr, err := i.BindNewAddr(&mockLink{}, "ctr2", "eth0", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.4", addr.IP.String())
+
+	_, err = i.ReleaseStaleAllocations(map[string]bool{}, 0, false)
+	require.NoError(t, err)
+	_, err = i.ReleaseAddr("", "")
+	require.NoError(t, err)
+
+	allocs, err := i.Allocations()
+	require.NoError(t, err)
+	require.Len(t, allocs, 1)
+	assert.Equal(t, Allocation{IP: "10.0.0.2", Reserved: true, Note: "router", AllocatedAt: allocs[0].AllocatedAt}, allocs[0])
+	assert.False(t, allocs[0].AllocatedAt.IsZero())
+}
+
+func TestReleaseIP(t *testing.T) {
+	i := makeIPAM(t)
+	writeAllocations(t, i.dataDir(), []Allocation{
+		{IP: "10.0.0.2", ContainerID: "ctr1", IfName: "eth0"},
+		{IP: "10.0.0.3", ContainerID: "ctr2", IfName: "eth0"},
+	})
+
+	released, err := i.ReleaseIP(net.ParseIP("10.0.0.2"))
+	require.NoError(t, err)
+	assert.Equal(t, "ctr1", released.ContainerID)
+
+	_, err = i.ReleaseIP(net.ParseIP("10.0.0.2"))
+	assert.ErrorContains(t, err, "not allocated")
+
+	allocs, err := i.Allocations()
+	require.NoError(t, err)
+	assert.Equal(t, []Allocation{{IP: "10.0.0.3", ContainerID: "ctr2", IfName: "eth0"}}, allocs)
+}
+
+func TestReleaseOrphans(t *testing.T) {
+	initial := []Allocation{
+		{IP: "10.0.0.2", ContainerID: "live", HostVeth: "veth-live"},
+		{IP: "10.0.0.3", ContainerID: "gone", HostVeth: "veth-gone"},
+		{IP: "10.0.0.4", Reserved: true},
+	}
+	gone := func(a Allocation) bool { return a.ContainerID != "live" }
+
+	t.Run("dry run keeps the store", func(t *testing.T) {
+		i := makeIPAM(t)
+		writeAllocations(t, i.dataDir(), initial)
+
+		orphans, err := i.ReleaseOrphans(gone, true)
+		require.NoError(t, err)
+		assert.Equal(t, []Allocation{initial[1]}, orphans)
+
+		allocs, err := i.Allocations()
+		require.NoError(t, err)
+		assert.Equal(t, initial, allocs)
+	})
+
+	t.Run("frees orphans but never reservations", func(t *testing.T) {
+		i := makeIPAM(t)
+		writeAllocations(t, i.dataDir(), initial)
+
+		orphans, err := i.ReleaseOrphans(gone, false)
+		require.NoError(t, err)
+		assert.Equal(t, []Allocation{initial[1]}, orphans)
+
+		allocs, err := i.Allocations()
+		require.NoError(t, err)
+		assert.Equal(t, []Allocation{initial[0], initial[2]}, allocs)
+	})
+}
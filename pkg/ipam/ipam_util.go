@@ -1,6 +1,9 @@
 package ipam
 
-import "net"
+import (
+	"math/big"
+	"net"
+)
 
 func ipGreaterThan(a, b net.IP) bool {
 	a = a.To16()
@@ -42,3 +45,14 @@ func cloneIP(ip net.IP) net.IP {
 	copy(result, ip)
 	return result
 }
+
+// rangeSize counts the addresses from start to end inclusive.
+func rangeSize(start, end net.IP) float64 {
+	s := new(big.Int).SetBytes(start.To16())
+	e := new(big.Int).SetBytes(end.To16())
+	if e.Cmp(s) < 0 {
+		return 0
+	}
+	f, _ := new(big.Float).SetInt(e.Sub(e, s).Add(e, big.NewInt(1))).Float64()
+	return f
+}
@@ -0,0 +1,75 @@
+package ipsetwrapper
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Set families accepted by Create.
+const (
+	FamilyIPv4 = "inet"
+	FamilyIPv6 = "inet6"
+)
+
+type IPSetIface interface {
+	Create(name, setType, family string) error
+	Add(name, entry string) error
+	Flush(name string) error
+	Destroy(name string) error
+	ListNames() ([]string, error)
+}
+
+type ipSet struct {
+	run func(args ...string) ([]byte, error)
+}
+
+// NewIPSet returns an IPSetIface that drives the ipset binary.
+func NewIPSet() (IPSetIface, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, fmt.Errorf("ipset binary not found: %w", err)
+	}
+	return &ipSet{run: func(args ...string) ([]byte, error) {
+		return exec.Command(path, args...).CombinedOutput()
+	}}, nil
+}
+
+func (i *ipSet) exec(args ...string) ([]byte, error) {
+	out, err := i.run(args...)
+	if err != nil {
+		return out, fmt.Errorf("ipset %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// Create creates the set, or does nothing if a set of that name exists.
+func (i *ipSet) Create(name, setType, family string) error {
+	_, err := i.exec("create", name, setType, "family", family, "-exist")
+	return err
+}
+
+// Add adds entry to the set, or does nothing if it is already a member.
+func (i *ipSet) Add(name, entry string) error {
+	_, err := i.exec("add", name, entry, "-exist")
+	return err
+}
+
+func (i *ipSet) Flush(name string) error {
+	_, err := i.exec("flush", name)
+	return err
+}
+
+func (i *ipSet) Destroy(name string) error {
+	_, err := i.exec("destroy", name)
+	return err
+}
+
+// ListNames returns the names of every set on the host.
+func (i *ipSet) ListNames() ([]string, error) {
+	out, err := i.exec("list", "-n")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
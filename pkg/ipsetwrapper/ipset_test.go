@@ -0,0 +1,45 @@
+package ipsetwrapper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPSet_CommandLines(t *testing.T) {
+	var calls []string
+	s := &ipSet{run: func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		return []byte("eureka-a\neureka-b\n"), nil
+	}}
+
+	require.NoError(t, s.Create("eureka-a", "hash:net", FamilyIPv4))
+	require.NoError(t, s.Add("eureka-a", "10.0.0.0/8"))
+	require.NoError(t, s.Flush("eureka-a"))
+	require.NoError(t, s.Destroy("eureka-a"))
+	names, err := s.ListNames()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"create eureka-a hash:net family inet -exist",
+		"add eureka-a 10.0.0.0/8 -exist",
+		"flush eureka-a",
+		"destroy eureka-a",
+		"list -n",
+	}, calls)
+	assert.Equal(t, []string{"eureka-a", "eureka-b"}, names)
+}
+
+func TestIPSet_ErrorIncludesOutput(t *testing.T) {
+	s := &ipSet{run: func(_ ...string) ([]byte, error) {
+		return []byte("ipset v7.1: The set with the given name does not exist\n"), errors.New("exit status 1")
+	}}
+
+	err := s.Destroy("missing")
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not exist")
+}
@@ -2,18 +2,22 @@ package iptableswrapper
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
 type IPTablesIface interface {
 	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
 	Append(table, chain string, rulespec ...string) error
 	AppendUnique(table, chain string, rulespec ...string) error
 	Delete(table, chain string, rulespec ...string) error
 	List(table, chain string) ([]string, error)
 	ListChains(table string) ([]string, error)
 	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
 }
 
 type ipTables struct {
@@ -33,6 +37,10 @@ func (i ipTables) Exists(table, chain string, rulespec ...string) (bool, error)
 	return i.ipt.Exists(table, chain, rulespec...)
 }
 
+func (i ipTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return i.ipt.Insert(table, chain, pos, rulespec...)
+}
+
 func (i ipTables) Append(table, chain string, rulespec ...string) error {
 	return i.ipt.Append(table, chain, rulespec...)
 }
@@ -57,6 +65,69 @@ func (i ipTables) ChainExists(table, chain string) (bool, error) {
 	return i.ipt.ChainExists(table, chain)
 }
 
+func (i ipTables) NewChain(table, chain string) error {
+	return i.ipt.NewChain(table, chain)
+}
+
+func (i ipTables) ClearAndDeleteChain(table, chain string) error {
+	return i.ipt.ClearAndDeleteChain(table, chain)
+}
+
+// ParseRule splits a rule as printed by iptables -S ("-A CHAIN args...")
+// into its chain and rulespec, undoing the quotes iptables puts around
+// arguments such as comments, so the rulespec can be passed to Delete.
+func ParseRule(line string) (chain string, rulespec []string, ok bool) {
+	var args []string
+	var cur strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if quoted || len(args) < 2 || args[0] != "-A" {
+		return "", nil, false
+	}
+	return args[1], args[2:], true
+}
+
+// DeleteRule deletes the rule that iptables -S printed as line. Deleting by
+// rulespec rather than by number keeps a concurrent insert from shifting the
+// target onto someone else's rule. A rule that is already gone counts as
+// deleted.
+func DeleteRule(ipt IPTablesIface, table, line string) error {
+	chain, rulespec, ok := ParseRule(line)
+	if !ok {
+		return fmt.Errorf("cannot parse rule %q", line)
+	}
+	err := ipt.Delete(table, chain, rulespec...)
+	if err == nil {
+		return nil
+	}
+	if exists, existsErr := ipt.Exists(table, chain, rulespec...); existsErr == nil && !exists {
+		return nil
+	}
+	return err
+}
+
 func TestRunIptables() {
 	instance, err := NewIPTables(iptables.ProtocolIPv4)
 	if err != nil {
@@ -3,9 +3,10 @@ package iptableswrapper
 import (
 	"fmt"
 	"os"
-	"strings"
 	"testing"
 
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper/iptablestest"
+
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,105 +29,36 @@ func TestInit(t *testing.T) {
 	}
 }
 
-// mockIPTables is an in-memory IPTablesIface for unit tests.
-type mockIPTables struct {
-	rules map[string][]string
-}
-
-func newMockIPTables() *mockIPTables {
-	return &mockIPTables{rules: make(map[string][]string)}
-}
-
-func ruleKey(table, chain string) string {
-	return table + "/" + chain
-}
-
-func (m *mockIPTables) Append(table, chain string, rulespec ...string) error {
-	key := ruleKey(table, chain)
-	m.rules[key] = append(m.rules[key], strings.Join(rulespec, " "))
-	return nil
-}
-
-func (m *mockIPTables) AppendUnique(table, chain string, rulespec ...string) error {
-	key := ruleKey(table, chain)
-	rule := strings.Join(rulespec, " ")
-	for _, r := range m.rules[key] {
-		if r == rule {
-			return nil
-		}
-	}
-	m.rules[key] = append(m.rules[key], rule)
-	return nil
-}
-
-func (m *mockIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
-	key := ruleKey(table, chain)
-	rule := strings.Join(rulespec, " ")
-	for _, r := range m.rules[key] {
-		if r == rule {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-func (m *mockIPTables) Delete(table, chain string, rulespec ...string) error {
-	key := ruleKey(table, chain)
-	rule := strings.Join(rulespec, " ")
-	existing := m.rules[key]
-	for i, r := range existing {
-		if r == rule {
-			m.rules[key] = append(existing[:i], existing[i+1:]...)
-			return nil
-		}
-	}
-	return nil
-}
-
-func (m *mockIPTables) List(table, chain string) ([]string, error) {
-	return m.rules[ruleKey(table, chain)], nil
-}
-
-func (m *mockIPTables) ListChains(table string) ([]string, error) {
-	return nil, nil
-}
-
-func (m *mockIPTables) ChainExists(table, chain string) (bool, error) {
-	return false, nil
-}
-
-// Verify mockIPTables satisfies the interface at compile time.
-var _ IPTablesIface = (*mockIPTables)(nil)
-
-func TestMockAppendExistsDelete(t *testing.T) {
-	ipt := newMockIPTables()
+var _ IPTablesIface = (*iptablestest.Fake)(nil)
 
-	rulespec := []string{"-s", "10.0.0.0/24", "!", "-o", "cni0", "-j", "MASQUERADE"}
+func TestParseRule(t *testing.T) {
+	chain, spec, ok := ParseRule(`-A EUREKA-POSTROUTING -s 10.0.0.2/32 -m comment --comment "name=net1,id=ctr1" -j MASQUERADE`)
+	assert.True(t, ok)
+	assert.Equal(t, "EUREKA-POSTROUTING", chain)
+	assert.Equal(t, []string{"-s", "10.0.0.2/32", "-m", "comment", "--comment", "name=net1,id=ctr1", "-j", "MASQUERADE"}, spec)
 
-	err := ipt.Append("nat", "POSTROUTING", rulespec...)
-	assert.NoError(t, err)
+	_, spec, ok = ParseRule(`-A X -m comment --comment "two \"words\"" -j ACCEPT`)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"-m", "comment", "--comment", `two "words"`, "-j", "ACCEPT"}, spec)
 
-	exists, err := ipt.Exists("nat", "POSTROUTING", rulespec...)
-	assert.NoError(t, err)
-	assert.True(t, exists)
-
-	err = ipt.Delete("nat", "POSTROUTING", rulespec...)
-	assert.NoError(t, err)
-
-	exists, err = ipt.Exists("nat", "POSTROUTING", rulespec...)
-	assert.NoError(t, err)
-	assert.False(t, exists)
+	_, _, ok = ParseRule("-N EUREKA-POSTROUTING")
+	assert.False(t, ok)
+	_, _, ok = ParseRule(`-A X --comment "unterminated`)
+	assert.False(t, ok)
 }
 
-func TestMockAppendUnique(t *testing.T) {
-	ipt := newMockIPTables()
-
-	rulespec := []string{"-j", "MASQUERADE"}
+func TestDeleteRule(t *testing.T) {
+	m := iptablestest.New()
+	assert.NoError(t, m.Append("nat", "X", "-s", "10.0.0.2/32", "-j", "MASQUERADE"))
+	assert.NoError(t, m.Insert("nat", "X", 1, "-s", "10.0.0.3/32", "-j", "MASQUERADE"))
 
-	assert.NoError(t, ipt.AppendUnique("nat", "POSTROUTING", rulespec...))
-	assert.NoError(t, ipt.AppendUnique("nat", "POSTROUTING", rulespec...))
+	// The insert moved the first rule to position 2; deleting by rulespec
+	// still hits it and not the rule now at position 1.
+	assert.NoError(t, DeleteRule(m, "nat", "-A X -s 10.0.0.2/32 -j MASQUERADE"))
+	ok, _ := m.Exists("nat", "X", "-s", "10.0.0.3/32", "-j", "MASQUERADE")
+	assert.True(t, ok)
+	ok, _ = m.Exists("nat", "X", "-s", "10.0.0.2/32", "-j", "MASQUERADE")
+	assert.False(t, ok)
 
-	rules, err := ipt.List("nat", "POSTROUTING")
-	assert.NoError(t, err)
-	assert.Len(t, rules, 1)
+	assert.NoError(t, DeleteRule(m, "nat", "-A X -s 10.0.0.2/32 -j MASQUERADE"), "already gone")
 }
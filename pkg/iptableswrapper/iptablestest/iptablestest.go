@@ -0,0 +1,126 @@
+// Package iptablestest provides an in-memory iptableswrapper.IPTablesIface
+// for unit tests.
+package iptablestest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// builtinChains exist in every table without being created.
+var builtinChains = map[string]bool{
+	"INPUT":       true,
+	"OUTPUT":      true,
+	"FORWARD":     true,
+	"PREROUTING":  true,
+	"POSTROUTING": true,
+}
+
+// Fake keeps each chain's rules, keyed by Key, as their rulespecs joined by
+// spaces. List output mimics iptables -S: a chain declaration, "-P <chain>
+// <policy>" for built-in chains, followed by "-A <chain> ..." lines. Built-in
+// chains accept by default unless Policies says otherwise.
+type Fake struct {
+	Chains   map[string]bool
+	Rules    map[string][]string
+	Policies map[string]string
+}
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{
+		Chains:   make(map[string]bool),
+		Rules:    make(map[string][]string),
+		Policies: make(map[string]string),
+	}
+}
+
+// Key is the key of table's chain in Chains and Rules.
+func Key(table, chain string) string { return table + "/" + chain }
+
+func (f *Fake) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rule := strings.Join(rulespec, " ")
+	for _, r := range f.Rules[Key(table, chain)] {
+		if r == rule {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *Fake) Insert(table, chain string, pos int, rulespec ...string) error {
+	k := Key(table, chain)
+	rules := f.Rules[k]
+	idx := min(max(pos-1, 0), len(rules))
+	f.Rules[k] = append(rules[:idx:idx], append([]string{strings.Join(rulespec, " ")}, rules[idx:]...)...)
+	return nil
+}
+
+func (f *Fake) Append(table, chain string, rulespec ...string) error {
+	k := Key(table, chain)
+	f.Rules[k] = append(f.Rules[k], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *Fake) AppendUnique(table, chain string, rulespec ...string) error {
+	if ok, _ := f.Exists(table, chain, rulespec...); ok {
+		return nil
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+// Delete fails for a rule that is not there, as iptables does.
+func (f *Fake) Delete(table, chain string, rulespec ...string) error {
+	k := Key(table, chain)
+	rule := strings.Join(rulespec, " ")
+	for i, r := range f.Rules[k] {
+		if r == rule {
+			f.Rules[k] = append(f.Rules[k][:i], f.Rules[k][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %q not found in %s", rule, k)
+}
+
+func (f *Fake) List(table, chain string) ([]string, error) {
+	out := []string{"-N " + chain}
+	if builtinChains[chain] {
+		policy := f.Policies[Key(table, chain)]
+		if policy == "" {
+			policy = "ACCEPT"
+		}
+		out = []string{"-P " + chain + " " + policy}
+	}
+	for _, r := range f.Rules[Key(table, chain)] {
+		out = append(out, "-A "+chain+" "+r)
+	}
+	return out, nil
+}
+
+// ListChains lists the chains created in table, sorted.
+func (f *Fake) ListChains(table string) ([]string, error) {
+	var out []string
+	for k := range f.Chains {
+		if chain, ok := strings.CutPrefix(k, table+"/"); ok {
+			out = append(out, chain)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (f *Fake) ChainExists(table, chain string) (bool, error) {
+	return builtinChains[chain] || f.Chains[Key(table, chain)], nil
+}
+
+func (f *Fake) NewChain(table, chain string) error {
+	f.Chains[Key(table, chain)] = true
+	return nil
+}
+
+func (f *Fake) ClearAndDeleteChain(table, chain string) error {
+	delete(f.Chains, Key(table, chain))
+	delete(f.Rules, Key(table, chain))
+	return nil
+}
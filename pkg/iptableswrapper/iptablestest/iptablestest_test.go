@@ -0,0 +1,63 @@
+package iptablestest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendExistsDelete(t *testing.T) {
+	ipt := New()
+	rulespec := []string{"-s", "10.0.0.0/24", "!", "-o", "cni0", "-j", "MASQUERADE"}
+
+	assert.NoError(t, ipt.Append("nat", "POSTROUTING", rulespec...))
+	exists, err := ipt.Exists("nat", "POSTROUTING", rulespec...)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, ipt.Delete("nat", "POSTROUTING", rulespec...))
+	exists, err = ipt.Exists("nat", "POSTROUTING", rulespec...)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Error(t, ipt.Delete("nat", "POSTROUTING", rulespec...), "the rule is gone")
+}
+
+func TestInsertAndList(t *testing.T) {
+	ipt := New()
+
+	assert.NoError(t, ipt.Append("nat", "POSTROUTING", "-j", "A"))
+	assert.NoError(t, ipt.Insert("nat", "POSTROUTING", 1, "-j", "B"))
+	assert.NoError(t, ipt.Insert("nat", "POSTROUTING", 9, "-j", "C"))
+
+	rules, err := ipt.List("nat", "POSTROUTING")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-P POSTROUTING ACCEPT", "-A POSTROUTING -j B", "-A POSTROUTING -j A", "-A POSTROUTING -j C"}, rules)
+}
+
+func TestAppendUnique(t *testing.T) {
+	ipt := New()
+
+	assert.NoError(t, ipt.AppendUnique("nat", "POSTROUTING", "-j", "MASQUERADE"))
+	assert.NoError(t, ipt.AppendUnique("nat", "POSTROUTING", "-j", "MASQUERADE"))
+
+	assert.Len(t, ipt.Rules[Key("nat", "POSTROUTING")], 1)
+}
+
+func TestChains(t *testing.T) {
+	ipt := New()
+
+	ok, _ := ipt.ChainExists("filter", "FORWARD")
+	assert.True(t, ok, "built-in chains always exist")
+	ok, _ = ipt.ChainExists("filter", "EUREKA-FORWARD")
+	assert.False(t, ok)
+
+	assert.NoError(t, ipt.NewChain("filter", "EUREKA-FORWARD"))
+	assert.NoError(t, ipt.Append("filter", "EUREKA-FORWARD", "-j", "ACCEPT"))
+	chains, _ := ipt.ListChains("filter")
+	assert.Equal(t, []string{"EUREKA-FORWARD"}, chains)
+
+	assert.NoError(t, ipt.ClearAndDeleteChain("filter", "EUREKA-FORWARD"))
+	chains, _ = ipt.ListChains("filter")
+	assert.Empty(t, chains)
+	assert.Empty(t, ipt.Rules[Key("filter", "EUREKA-FORWARD")])
+}
@@ -1,41 +1,119 @@
 package logging
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
-	defaultLogPath = "/var/log/cni/test-cni.log"
+	defaultLogDir     = "/var/log/cni"
+	defaultMaxSizeMB  = 10
+	defaultMaxBackups = 5
 )
 
-var Logger *slog.Logger
+// Logger starts out discarding records so packages can log before, or
+// without, Init.
+var Logger = slog.New(slog.DiscardHandler)
 
-func Init(logPath string) error {
-	if logPath == "" {
-		logPath = defaultLogPath
-	}
+// Options configures Init. Zero values select the defaults.
+type Options struct {
+	// Path defaults to /var/log/cni/<binary>.log.
+	Path string
+	// Level is debug, info, warn or error; the default is info.
+	Level string
+	// Format is json or text; the default is json.
+	Format string
+	// MaxSizeMB is the size at which the file is rotated.
+	MaxSizeMB int
+	// MaxBackups is how many rotated files are kept.
+	MaxBackups int
+}
+
+// PluginName is the name of the running binary, used as the plugin label
+// and the default log file name.
+func PluginName() string {
+	return filepath.Base(os.Args[0])
+}
 
-	dir := filepath.Dir(logPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// Init points Logger at a size-rotated log file.
+func Init(opts Options) error {
+	level, err := parseLevel(opts.Level)
+	if err != nil {
 		return err
 	}
+	if opts.Path == "" {
+		opts.Path = filepath.Join(defaultLogDir, PluginName()+".log")
+	}
+	if opts.MaxSizeMB <= 0 {
+		opts.MaxSizeMB = defaultMaxSizeMB
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = defaultMaxBackups
+	}
 
-	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		return err
+	}
+	w, err := newRotatingFile(opts.Path, int64(opts.MaxSizeMB)<<20, opts.MaxBackups)
 	if err != nil {
 		return err
 	}
 
-	Logger = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	})).With("plugin", "test-cni")
-
+	handler, err := newHandler(w, opts.Format, level)
+	if err != nil {
+		return err
+	}
+	Logger = slog.New(handler).With("plugin", PluginName())
 	return nil
 }
 
 func InitStderr() {
 	Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
-	})).With("plugin", "test-cni")
+	})).With("plugin", PluginName())
+}
+
+// WithInvocation tags every later record with a fresh request ID and the
+// network name, so the records of one CNI call can be told apart.
+func WithInvocation(network string) string {
+	id := newRequestID()
+	Logger = Logger.With("request_id", id, "network", network)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+func newHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
 }
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile_KeepsMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eureka.log")
+	r, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := r.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	read := func(name string) string {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestRotatingFile_ReopensAfterAnotherProcessRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eureka.log")
+	a, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	b, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	_, err = a.Write([]byte("a-first\n"))
+	require.NoError(t, err)
+	_, err = a.Write([]byte("a-second\n"))
+	require.NoError(t, err)
+	// b still holds the rotated file open and must not rotate it again.
+	_, err = b.Write([]byte("b-first\n"))
+	require.NoError(t, err)
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "a-second\nb-first\n", string(got))
+	backup, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "a-first\n", string(backup))
+	assert.NoFileExists(t, path+".2")
+}
+
+func TestInit_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "eureka.log")
+	require.NoError(t, Init(Options{Path: path, Level: "warn", Format: "json"}))
+	id := WithInvocation("eureka")
+
+	Logger.Info("dropped")
+	Logger.Warn("kept")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+	assert.Equal(t, "kept", rec["msg"])
+	assert.Equal(t, PluginName(), rec["plugin"])
+	assert.Equal(t, id, rec["request_id"])
+	assert.Equal(t, "eureka", rec["network"])
+
+	assert.Error(t, Init(Options{Path: path, Level: "loud"}))
+	assert.Error(t, Init(Options{Path: path, Format: "xml"}))
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// rotatingFile appends to path and, once a write would take it past
+// maxSize, renames it to path.1 (shifting older backups up and dropping
+// those beyond maxBackups) and starts a new file. Concurrent plugin
+// processes share the file, so rotation runs under a flock and a process
+// that finds the file already rotated by another just reopens it.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if fi, err := r.f.Stat(); err == nil && fi.Size() > 0 && fi.Size()+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the old file rather than losing records.
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", r.path, err)
+		}
+	}
+	return r.f.Write(p)
+}
+
+func (r *rotatingFile) rotate() error {
+	lock, err := os.OpenFile(r.path+".lock", os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	current, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	onDisk, err := os.Stat(r.path)
+	if err == nil && os.SameFile(current, onDisk) {
+		if err := r.shift(); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// shift renames path.N to path.N+1, newest last, and path to path.1.
+func (r *rotatingFile) shift() error {
+	if err := os.Remove(backupName(r.path, r.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(r.path, i), backupName(r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, backupName(r.path, 1))
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
@@ -0,0 +1,226 @@
+// Package metrics keeps plugin metrics in a node-exporter textfile.
+//
+// The plugin lives for one command, so counters and histograms are kept in
+// a state file next to the textfile and every invocation folds its own
+// observation in under a flock, then rewrites the textfile atomically.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Buckets are the upper bounds, in seconds, of the duration histogram.
+var Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Invocation is one command to record.
+type Invocation struct {
+	Network  string
+	Command  string
+	Err      error
+	Duration time.Duration
+	// Pools is the current occupancy of the network's ranges; nil leaves
+	// the last recorded values in place.
+	Pools []Pool
+}
+
+// Pool is the occupancy of one IPAM range.
+type Pool struct {
+	Range     string  `json:"range"`
+	Size      float64 `json:"size"`
+	Allocated int     `json:"allocated"`
+}
+
+type command struct {
+	Network string    `json:"network"`
+	Command string    `json:"command"`
+	Result  string    `json:"result"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+	Buckets []uint64  `json:"buckets"`
+	Bounds  []float64 `json:"bounds"`
+}
+
+type state struct {
+	Commands map[string]*command `json:"commands"`
+	Pools    map[string][]Pool   `json:"pools"`
+}
+
+// Record adds inv to the metrics in path, which should end in ".prom" and
+// sit in the textfile collector directory.
+func Record(path string, inv Invocation) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock metrics: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	st, err := load(statePath(path))
+	if err != nil {
+		return err
+	}
+	st.observe(inv)
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(statePath(path), data); err != nil {
+		return err
+	}
+	return writeAtomic(path, []byte(st.render()))
+}
+
+func statePath(path string) string {
+	return path + ".state"
+}
+
+func load(path string) (*state, error) {
+	st := &state{}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read metrics state: %w", err)
+	default:
+		// A corrupt state file only costs the history; start over.
+		_ = json.Unmarshal(data, st)
+	}
+	if st.Commands == nil {
+		st.Commands = make(map[string]*command)
+	}
+	if st.Pools == nil {
+		st.Pools = make(map[string][]Pool)
+	}
+	return st, nil
+}
+
+func (st *state) observe(inv Invocation) {
+	result := "success"
+	if inv.Err != nil {
+		result = "error"
+	}
+	key := inv.Network + "\x00" + inv.Command + "\x00" + result
+	c := st.Commands[key]
+	if c == nil || !slices.Equal(c.Bounds, Buckets) {
+		c = &command{Network: inv.Network, Command: inv.Command, Result: result,
+			Buckets: make([]uint64, len(Buckets)), Bounds: Buckets}
+		st.Commands[key] = c
+	}
+	seconds := inv.Duration.Seconds()
+	c.Count++
+	c.Sum += seconds
+	for i, le := range Buckets {
+		if seconds <= le {
+			c.Buckets[i]++
+		}
+	}
+	if inv.Pools != nil {
+		st.Pools[inv.Network] = inv.Pools
+	}
+}
+
+func (st *state) render() string {
+	var b strings.Builder
+
+	keys := make([]string, 0, len(st.Commands))
+	for k := range st.Commands {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteString("# HELP eureka_cni_commands_total CNI commands handled, by outcome.\n")
+	b.WriteString("# TYPE eureka_cni_commands_total counter\n")
+	for _, k := range keys {
+		c := st.Commands[k]
+		fmt.Fprintf(&b, "eureka_cni_commands_total{%s} %d\n", c.labels(), c.Count)
+	}
+
+	b.WriteString("# HELP eureka_cni_command_duration_seconds Time taken by CNI commands.\n")
+	b.WriteString("# TYPE eureka_cni_command_duration_seconds histogram\n")
+	for _, k := range keys {
+		c := st.Commands[k]
+		for i, le := range c.Bounds {
+			fmt.Fprintf(&b, "eureka_cni_command_duration_seconds_bucket{%s,%s} %d\n", c.labels(), label("le", formatFloat(le)), c.Buckets[i])
+		}
+		fmt.Fprintf(&b, "eureka_cni_command_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", c.labels(), c.Count)
+		fmt.Fprintf(&b, "eureka_cni_command_duration_seconds_sum{%s} %s\n", c.labels(), formatFloat(c.Sum))
+		fmt.Fprintf(&b, "eureka_cni_command_duration_seconds_count{%s} %d\n", c.labels(), c.Count)
+	}
+
+	networks := make([]string, 0, len(st.Pools))
+	for n := range st.Pools {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	gauges := []struct {
+		name, help string
+		value      func(Pool) float64
+	}{
+		{"eureka_ipam_range_size", "Addresses in the IPAM range.", func(p Pool) float64 { return p.Size }},
+		{"eureka_ipam_allocated_ips", "Allocated addresses in the IPAM range.", func(p Pool) float64 { return float64(p.Allocated) }},
+		{"eureka_ipam_free_ips", "Free addresses in the IPAM range.", func(p Pool) float64 { return math.Max(p.Size-float64(p.Allocated), 0) }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, n := range networks {
+			for _, p := range st.Pools[n] {
+				fmt.Fprintf(&b, "%s{%s,%s} %s\n", g.name, label("network", n), label("range", p.Range), formatFloat(g.value(p)))
+			}
+		}
+	}
+	return b.String()
+}
+
+func (c *command) labels() string {
+	return label("network", c.Network) + "," + label("command", c.Command) + "," + label("result", c.Result)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// label renders a label pair in the exposition format's escaping.
+func label(name, value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return name + `="` + r.Replace(value) + `"`
+}
+
+// writeAtomic replaces path so the collector never reads a partial file.
+// The temporary name must not end in .prom or it would be collected.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
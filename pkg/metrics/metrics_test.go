@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord_AccumulatesAcrossInvocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eureka.prom")
+
+	require.NoError(t, Record(path, Invocation{
+		Network: "eureka", Command: "add", Duration: 20 * time.Millisecond,
+		Pools: []Pool{{Range: "10.244.0.0/24", Size: 254, Allocated: 1}},
+	}))
+	require.NoError(t, Record(path, Invocation{
+		Network: "eureka", Command: "add", Duration: 3 * time.Second,
+		Pools: []Pool{{Range: "10.244.0.0/24", Size: 254, Allocated: 2}},
+	}))
+	require.NoError(t, Record(path, Invocation{
+		Network: "eureka", Command: "del", Err: errors.New("boom"), Duration: time.Millisecond,
+	}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	out := string(data)
+
+	assert.Contains(t, out, `eureka_cni_commands_total{network="eureka",command="add",result="success"} 2`)
+	assert.Contains(t, out, `eureka_cni_commands_total{network="eureka",command="del",result="error"} 1`)
+	assert.Contains(t, out, `eureka_cni_command_duration_seconds_bucket{network="eureka",command="add",result="success",le="0.025"} 1`)
+	assert.Contains(t, out, `eureka_cni_command_duration_seconds_bucket{network="eureka",command="add",result="success",le="5"} 2`)
+	assert.Contains(t, out, `eureka_cni_command_duration_seconds_bucket{network="eureka",command="add",result="success",le="+Inf"} 2`)
+	assert.Contains(t, out, `eureka_cni_command_duration_seconds_sum{network="eureka",command="add",result="success"} 3.02`)
+	// The del carried no pools, so the gauges keep the last add's values.
+	assert.Contains(t, out, `eureka_ipam_allocated_ips{network="eureka",range="10.244.0.0/24"} 2`)
+	assert.Contains(t, out, `eureka_ipam_free_ips{network="eureka",range="10.244.0.0/24"} 252`)
+	assert.Contains(t, out, `eureka_ipam_range_size{network="eureka",range="10.244.0.0/24"} 254`)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	var proms []string
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".prom" {
+			proms = append(proms, e.Name())
+		}
+	}
+	assert.Equal(t, []string{"eureka.prom"}, proms, "no temporary file may be left for the collector")
+}
+
+func TestRecord_StartsOverOnCorruptState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eureka.prom")
+	require.NoError(t, os.WriteFile(statePath(path), []byte("{not json"), 0644))
+
+	require.NoError(t, Record(path, Invocation{Network: "eureka", Command: "gc"}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `eureka_cni_commands_total{network="eureka",command="gc",result="success"} 1`)
+}
+
+func TestLabel_Escapes(t *testing.T) {
+	assert.Equal(t, `network="a\"b\\c\nd"`, label("network", "a\"b\\c\nd"))
+}
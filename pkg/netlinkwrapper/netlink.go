@@ -48,6 +48,11 @@ type NetLink interface {
 	RuleAdd(rule *netlink.Rule) error
 	RuleDel(rule *netlink.Rule) error
 	RuleList(family int) ([]netlink.Rule, error)
+
+	// Traffic control operations
+	QdiscAdd(qdisc netlink.Qdisc) error
+	QdiscList(link netlink.Link) ([]netlink.Qdisc, error)
+	FilterAdd(filter netlink.Filter) error
 }
 
 type netLink struct {
@@ -191,6 +196,20 @@ func (*netLink) RuleList(family int) ([]netlink.Rule, error) {
 	return netlink.RuleList(family)
 }
 
+// Traffic control operations
+
+func (*netLink) QdiscAdd(qdisc netlink.Qdisc) error {
+	return netlink.QdiscAdd(qdisc)
+}
+
+func (*netLink) QdiscList(link netlink.Link) ([]netlink.Qdisc, error) {
+	return netlink.QdiscList(link)
+}
+
+func (*netLink) FilterAdd(filter netlink.Filter) error {
+	return netlink.FilterAdd(filter)
+}
+
 func TestNetLink() {
 	netlink := NewNetlink()
 
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"syscall"
+
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	"github.com/vishvananda/netlink"
+)
+
+// tbfLatency bounds how long a packet may wait in a TBF queue; it sizes the
+// queue limit together with the rate.
+const tbfLatency = 25 * netlink.TIME_UNITS_PER_SEC / 1000
+
+// IFBName returns the name of the IFB device that shapes egress traffic of
+// the pod behind hostVeth.
+func IFBName(hostVeth string) string {
+	sum := sha256.Sum256([]byte(hostVeth))
+	return "ifb" + hex.EncodeToString(sum[:])[:config.MaxIfNameLen-3]
+}
+
+// setupBandwidth shapes the pod's traffic on the host side of its veth.
+// Traffic to the pod leaves the host veth and is shaped by a TBF qdisc there;
+// traffic from the pod enters the host veth, so it is redirected to an IFB
+// device whose TBF qdisc does the shaping. The IFB carries the veth's alias.
+func (n *Network) setupBandwidth(hostVeth, alias string, bw *config.BandwidthEntry) error {
+	host, err := n.netlink.LinkByName(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth %s: %w", hostVeth, err)
+	}
+
+	if bw.IngressRate > 0 {
+		if err := n.netlink.QdiscAdd(makeTBF(host.Attrs().Index, bw.IngressRate, bw.IngressBurst)); err != nil {
+			return fmt.Errorf("failed to add ingress qdisc on %s: %w", hostVeth, err)
+		}
+		logging.Logger.Info("ingress_shaping_added", "host_veth", hostVeth, "rate", bw.IngressRate, "burst", bw.IngressBurst)
+	}
+
+	if bw.EgressRate > 0 {
+		ifbName := IFBName(hostVeth)
+		if err := n.netlink.LinkAdd(&netlink.Ifb{
+			LinkAttrs: netlink.LinkAttrs{Name: ifbName, MTU: host.Attrs().MTU, Alias: alias},
+		}); err != nil {
+			return fmt.Errorf("failed to create IFB device %s: %w", ifbName, err)
+		}
+		ifb, err := n.netlink.LinkByName(ifbName)
+		if err != nil {
+			return fmt.Errorf("failed to find IFB device %s: %w", ifbName, err)
+		}
+		if err := n.netlink.LinkSetUp(ifb); err != nil {
+			return fmt.Errorf("failed to bring up IFB device %s: %w", ifbName, err)
+		}
+		if err := n.netlink.QdiscAdd(makeTBF(ifb.Attrs().Index, bw.EgressRate, bw.EgressBurst)); err != nil {
+			return fmt.Errorf("failed to add egress qdisc on %s: %w", ifbName, err)
+		}
+
+		ingress := &netlink.Ingress{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: host.Attrs().Index,
+				Handle:    netlink.MakeHandle(0xffff, 0),
+				Parent:    netlink.HANDLE_INGRESS,
+			},
+		}
+		if err := n.netlink.QdiscAdd(ingress); err != nil {
+			return fmt.Errorf("failed to add ingress qdisc on %s: %w", hostVeth, err)
+		}
+		redirect := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: host.Attrs().Index,
+				Parent:    ingress.Handle,
+				Priority:  1,
+				Protocol:  syscall.ETH_P_ALL,
+			},
+			ClassId:    netlink.MakeHandle(1, 1),
+			RedirIndex: ifb.Attrs().Index,
+			Actions:    []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+		}
+		if err := n.netlink.FilterAdd(redirect); err != nil {
+			return fmt.Errorf("failed to redirect %s to %s: %w", hostVeth, ifbName, err)
+		}
+		logging.Logger.Info("egress_shaping_added", "host_veth", hostVeth, "ifb", ifbName, "rate", bw.EgressRate, "burst", bw.EgressBurst)
+	}
+	return nil
+}
+
+// makeTBF returns a root token bucket qdisc for a rate and burst given in bits.
+func makeTBF(linkIndex int, rateBits, burstBits uint64) *netlink.Tbf {
+	rate := rateBits / 8
+	burst := uint32(burstBits / 8)
+	limit := uint64(float64(rate)*float64(tbfLatency)/float64(netlink.TIME_UNITS_PER_SEC)) + uint64(burst)
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  uint32(min(limit, math.MaxUint32)),
+		Buffer: netlink.Xmittime(rate, burst),
+	}
+}
+
+// checkBandwidth reports an error if the qdiscs from setupBandwidth are missing.
+func (n *Network) checkBandwidth(hostVeth string, bw *config.BandwidthEntry) error {
+	if bw.IngressRate > 0 {
+		if err := n.checkTBF(hostVeth); err != nil {
+			return err
+		}
+	}
+	if bw.EgressRate > 0 {
+		if err := n.checkTBF(IFBName(hostVeth)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Network) checkTBF(name string) error {
+	link, err := n.netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("shaping device %s not found: %w", name, err)
+	}
+	qdiscs, err := n.netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs on %s: %w", name, err)
+	}
+	for _, q := range qdiscs {
+		if _, ok := q.(*netlink.Tbf); ok && q.Attrs().LinkIndex == link.Attrs().Index {
+			return nil
+		}
+	}
+	return fmt.Errorf("bandwidth qdisc on %s is missing", name)
+}
@@ -0,0 +1,293 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/firewall"
+	"github.com/innfi/probable-eureka/pkg/ipam"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultGCGracePeriod spares attachments younger than this from GC unless
+// the config sets gc.gracePeriodSeconds.
+const DefaultGCGracePeriod = 60 * time.Second
+
+// gcSummary counts what one GC pass removed, per kind of resource.
+type gcSummary struct {
+	veths, ifbs, ips, firewallOwners, spoofcheckOwners, policies, neighbors, bridges int
+}
+
+// gcPass is one GC run. In dry-run mode it only logs what it would remove.
+type gcPass struct {
+	dryRun bool
+	sum    gcSummary
+}
+
+// remove runs del for one resource, logs the outcome and counts it in count.
+func (p *gcPass) remove(resource string, count *int, del func() error, attrs ...any) {
+	attrs = append([]any{"resource", resource}, attrs...)
+	if p.dryRun {
+		logging.Logger.Info("gc_would_remove", attrs...)
+		*count++
+		return
+	}
+	if err := del(); err != nil {
+		logging.Logger.Error("gc_remove_failed", append(attrs, "error", err.Error())...)
+		return
+	}
+	logging.Logger.Info("gc_removed", attrs...)
+	*count++
+}
+
+// GarbageCollect removes the state of every attachment the runtime no longer
+// lists in validContainerIDs. Each kind of resource is found through the
+// plugin's own markers: veths and IFBs through the allocation store and their
+// link alias, firewall and spoof-check rules through their owner comments,
+// policy chains and sets through their names, and neighbor entries through
+// the bridge and the pod subnet. Host routes are not touched: the plugin
+// installs none, pod routes live in the pod's netns and go away with it.
+//
+// Attachments allocated within the grace period are kept even when the
+// runtime does not list them, since their ADD may still be running. Only a
+// failure to read or update the allocation store fails GC; other steps log
+// their errors and the pass goes on, so one broken backend does not keep
+// the rest from being cleaned.
+func (n *Network) GarbageCollect(conf *config.NetConf, validContainerIDs map[string]bool) error {
+	im := n.newIPAM(conf.IPAM)
+	grace := DefaultGCGracePeriod
+	p := &gcPass{}
+	if conf.GC != nil {
+		if conf.GC.GracePeriodSeconds != nil {
+			grace = time.Duration(*conf.GC.GracePeriodSeconds) * time.Second
+		}
+		p.dryRun = conf.GC.DryRun
+	}
+
+	// Allocations are released first and under the store lock, so the
+	// grace period is judged against the store as an ADD would see it.
+	// Everything below only touches the state of released attachments or
+	// of containers that hold no allocation at all.
+	var released []ipam.Allocation
+	err := n.span("ipam.release_stale", func() error {
+		var err error
+		released, err = im.ReleaseStaleAllocations(validContainerIDs, grace, p.dryRun)
+		return err
+	}, attribute.Bool("dry_run", p.dryRun))
+	if err != nil {
+		return fmt.Errorf("failed to release stale allocations: %v", err)
+	}
+
+	event := "gc_released_ip"
+	if p.dryRun {
+		event = "gc_would_release_ip"
+	}
+	for _, alloc := range released {
+		logging.Logger.Info(event,
+			"ip", alloc.IP,
+			"container_id", alloc.ContainerID,
+		)
+	}
+	p.sum.ips = len(released)
+
+	remaining, err := im.Allocations()
+	if err != nil {
+		return fmt.Errorf("failed to load allocations: %v", err)
+	}
+	if p.dryRun {
+		remaining = withoutAllocations(remaining, released)
+	}
+	live := make(map[string]bool, len(validContainerIDs)+len(remaining))
+	for id := range validContainerIDs {
+		live[id] = true
+	}
+	for _, alloc := range remaining {
+		live[alloc.ContainerID] = true
+	}
+
+	for _, alloc := range released {
+		if alloc.HostVeth == "" {
+			continue
+		}
+		owner := firewall.Owner{Network: conf.Name, ContainerID: alloc.ContainerID}
+		// The IFB device can outlive a veth that was removed by other means.
+		n.gcLink(p, "ifb", IFBName(alloc.HostVeth), owner, &p.sum.ifbs)
+		n.gcLink(p, "veth", alloc.HostVeth, owner, &p.sum.veths)
+	}
+
+	fw := n.firewallFor(conf)
+	if fw != nil {
+		n.span("firewall.gc", func() error {
+			p.gcOwners("firewall", conf.Name, live, fw.Owners, fw.DeleteOwned, &p.sum.firewallOwners)
+			return nil
+		})
+	}
+
+	if conf.SpoofCheck && n.newSpoof != nil {
+		if sc, err := n.newSpoof(); err != nil {
+			logging.Logger.Error("spoofcheck_unavailable", "error", err.Error())
+		} else {
+			n.span("spoofcheck.gc", func() error {
+				p.gcOwners("spoofcheck", conf.Name, live, sc.Owners, sc.Delete, &p.sum.spoofcheckOwners)
+				return nil
+			})
+		}
+	}
+
+	n.span("policy.gc", func() error {
+		n.gcPolicies(p, conf)
+		return nil
+	})
+
+	if conf.Bridge != "" {
+		n.span("neighbor.gc", func() error {
+			n.gcNeighbors(p, conf, remaining)
+			return nil
+		})
+		// Whether the bridge is empty cannot be judged without removing
+		// the ports first, so a dry run leaves it out.
+		if !p.dryRun {
+			n.span("bridge.teardown", func() error {
+				if n.teardownBridgeIfEmpty(im, fw, conf) {
+					p.sum.bridges++
+				}
+				return nil
+			})
+		}
+	}
+
+	logging.Logger.Info("gc_summary",
+		"dry_run", p.dryRun,
+		"grace_period_s", grace.Seconds(),
+		"veths", p.sum.veths,
+		"ifbs", p.sum.ifbs,
+		"ips", p.sum.ips,
+		"firewall_owners", p.sum.firewallOwners,
+		"spoofcheck_owners", p.sum.spoofcheckOwners,
+		"policies", p.sum.policies,
+		"neighbors", p.sum.neighbors,
+		"bridges", p.sum.bridges,
+	)
+	return nil
+}
+
+// withoutAllocations returns allocs minus those in drop.
+func withoutAllocations(allocs, drop []ipam.Allocation) []ipam.Allocation {
+	dropped := make(map[string]bool, len(drop))
+	for _, a := range drop {
+		dropped[a.IP+"/"+a.ContainerID] = true
+	}
+	var out []ipam.Allocation
+	for _, a := range allocs {
+		if !dropped[a.IP+"/"+a.ContainerID] {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// gcLink deletes the named link if it exists and belongs to owner. A link
+// whose alias names anyone else is someone else's, even under a name the
+// store recorded. Links without an alias predate ownership tracking and are
+// trusted on the strength of the store's record.
+func (n *Network) gcLink(p *gcPass, resource, name string, owner firewall.Owner, count *int) {
+	link, err := n.netlink.LinkByName(name)
+	if err != nil {
+		if !isLinkNotFound(err) {
+			logging.Logger.Error("gc_remove_failed", "resource", resource, "link", name, "error", err.Error())
+		}
+		return
+	}
+	if alias := link.Attrs().Alias; alias != "" && alias != LinkAlias(owner) {
+		logging.Logger.Warn("gc_link_not_owned", "link", name, "alias", alias, "container_id", owner.ContainerID)
+		return
+	}
+	p.remove(resource, count, func() error {
+		if err := n.netlink.LinkDel(link); err != nil && !isLinkNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+		return nil
+	}, "link", name, "container_id", owner.ContainerID)
+}
+
+// gcOwners deletes the rules of every owner on network whose container is
+// not live.
+func (p *gcPass) gcOwners(resource, network string, live map[string]bool,
+	list func(string) ([]firewall.Owner, error), del func(firewall.Owner) error, count *int) {
+	owners, err := list(network)
+	if err != nil {
+		logging.Logger.Error("gc_list_failed", "resource", resource, "error", err.Error())
+		return
+	}
+	for _, o := range owners {
+		if live[o.ContainerID] {
+			continue
+		}
+		p.remove(resource, count, func() error { return del(o) }, "container_id", o.ContainerID)
+	}
+}
+
+// gcPolicies removes the policy state of host veths that no longer exist.
+// Policy state is keyed by host veth, not container, so a veth that is still
+// present keeps its rules.
+func (n *Network) gcPolicies(p *gcPass, conf *config.NetConf) {
+	if conf.Policy == nil || conf.Policy.DryRun || n.newEnforcer == nil {
+		return
+	}
+	e, err := n.newEnforcer()
+	if err != nil {
+		logging.Logger.Error("policy_unavailable", "error", err.Error())
+		return
+	}
+	veths, err := e.HostVeths()
+	if err != nil {
+		logging.Logger.Error("gc_list_failed", "resource", "policy", "error", err.Error())
+		return
+	}
+	for _, veth := range veths {
+		if _, err := n.netlink.LinkByName(veth); !isLinkNotFound(err) {
+			continue
+		}
+		p.remove("policy", &p.sum.policies, func() error { return e.Remove(veth) }, "host_veth", veth)
+	}
+}
+
+// gcNeighbors flushes the bridge's neighbor entries for pod addresses that
+// are no longer allocated, so a new pod given the address is not sent to the
+// old MAC. Static entries are left alone: the plugin never installs any.
+func (n *Network) gcNeighbors(p *gcPass, conf *config.NetConf, remaining []ipam.Allocation) {
+	subnet := podSubnet(conf.IPAM)
+	if subnet == nil {
+		return
+	}
+	br, err := n.netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		return
+	}
+	inUse := make(map[string]bool, len(remaining))
+	for _, a := range remaining {
+		if ip := net.ParseIP(a.IP); ip != nil {
+			inUse[ip.String()] = true
+		}
+	}
+
+	neighs, err := n.netlink.NeighList(br.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		logging.Logger.Error("gc_list_failed", "resource", "neighbor", "error", err.Error())
+		return
+	}
+	for _, nb := range neighs {
+		if nb.IP == nil || !subnet.Contains(nb.IP) || inUse[nb.IP.String()] {
+			continue
+		}
+		if nb.State&(netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0 {
+			continue
+		}
+		p.remove("neighbor", &p.sum.neighbors, func() error { return n.netlink.NeighDel(&nb) }, "ip", nb.IP.String())
+	}
+}
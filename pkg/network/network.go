@@ -1,77 +1,235 @@
 package network
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/innfi/probable-eureka/pkg/cnierr"
 	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/firewall"
+	"github.com/innfi/probable-eureka/pkg/garp"
 	"github.com/innfi/probable-eureka/pkg/ipam"
-	"github.com/innfi/probable-eureka/pkg/iptableswrapper"
 	"github.com/innfi/probable-eureka/pkg/logging"
 	"github.com/innfi/probable-eureka/pkg/netlinkwrapper"
 	"github.com/innfi/probable-eureka/pkg/nswrapper"
+	"github.com/innfi/probable-eureka/pkg/policy"
 
+	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
-	goiptables "github.com/coreos/go-iptables/iptables"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+const DefaultVethPrefix = "veth"
+
+// HostVethName derives the host-side veth name from a hash of the attachment,
+// so it is stable across retries and unique per (containerID, ifName).
+func HostVethName(prefix, containerID, ifName string) (string, error) {
+	if prefix == "" {
+		prefix = DefaultVethPrefix
+	}
+	hashLen := config.MaxIfNameLen - len(prefix)
+	if hashLen < config.MinVethHashLen {
+		return "", fmt.Errorf("veth prefix %q too long: at most %d characters allowed", prefix, config.MaxVethPrefixLen)
+	}
+
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	return prefix + hex.EncodeToString(sum[:])[:hashLen], nil
+}
+
+// LinkAlias is the alias the plugin sets on the host veth and IFB device
+// it creates for owner. GC deletes a link only when it carries its owner's
+// alias, so links of other software that happen to match a recorded name
+// are left alone.
+func LinkAlias(owner firewall.Owner) string {
+	return "eureka " + owner.Comment()
+}
+
 // ipamIface is the subset of ipam.IPAM used by Network, enabling injection in tests.
 type ipamIface interface {
-	BindNewAddr(link netlink.Link, containerID string) (*netlink.Addr, error)
-	ReleaseAddr(containerID string) error
-	ReleaseStaleAllocations(validContainerIDs map[string]bool) ([]ipam.Allocation, error)
-	CheckStatus() error
+	BindNewAddr(link netlink.Link, containerID, ifName, hostVeth, netns string) (*netlink.Addr, error)
+	ReleaseAddr(containerID, ifName string) ([]ipam.Allocation, error)
+	Allocations() ([]ipam.Allocation, error)
+	ReleaseStaleAllocations(validContainerIDs map[string]bool, gracePeriod time.Duration, dryRun bool) ([]ipam.Allocation, error)
+	ReleaseOrphans(gone func(ipam.Allocation) bool, dryRun bool) ([]ipam.Allocation, error)
+	Lock() (func(), error)
+	CheckStatus(lockTimeout time.Duration) error
 }
 
 type Network struct {
-	netlink netlinkwrapper.NetLink
-	ns      nswrapper.NS
-	ipt     iptableswrapper.IPTablesIface
-	newIPAM func(*config.IPAMConfig) ipamIface
+	netlink     netlinkwrapper.NetLink
+	ns          nswrapper.NS
+	announce    garp.Announcer
+	newIPAM     func(*config.IPAMConfig) ipamIface
+	newFirewall func(backend string) (firewall.Firewall, error)
+	newEnforcer func() (policyEnforcer, error)
+	newSpoof    func() (firewall.SpoofChecker, error)
+	sysctl      func(name string, params ...string) (string, error)
+	// ctx is the trace context of the running command; see span.
+	ctx context.Context
 }
 
 func New() *Network {
-	ipt, _ := iptableswrapper.NewIPTables(goiptables.ProtocolIPv4)
-	return &Network{
-		netlink: netlinkwrapper.NewNetlink(),
-		ns:      nswrapper.NewNS(),
-		ipt:     ipt,
-		newIPAM: func(cfg *config.IPAMConfig) ipamIface {
-			i := ipam.NewIPAM(cfg)
-			return &i
+	n := &Network{
+		netlink:     netlinkwrapper.NewNetlink(),
+		ns:          nswrapper.NewNS(),
+		announce:    garp.NewAnnouncer(),
+		newFirewall: firewall.New,
+		newEnforcer: func() (policyEnforcer, error) {
+			e, err := policy.New()
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
 		},
+		newSpoof: firewall.NewBridgeSpoofChecker,
+		sysctl:   sysctl.Sysctl,
+		ctx:      context.Background(),
+	}
+	n.newIPAM = func(cfg *config.IPAMConfig) ipamIface {
+		i := ipam.NewIPAM(cfg)
+		i.ObserveLock(n.lockSpan)
+		return &i
+	}
+	return n
+}
+
+// firewallFor returns the configured firewall backend, or nil when none is
+// usable (e.g. without root), in which case firewall state is skipped.
+func (n *Network) firewallFor(conf *config.NetConf) firewall.Firewall {
+	if n.newFirewall == nil {
+		return nil
+	}
+	fw, err := n.newFirewall(conf.FirewallBackend)
+	if err != nil {
+		logging.Logger.Error("firewall_unavailable", "backend", conf.FirewallBackend, "error", err.Error())
+		return nil
 	}
+	return fw
 }
 
-func (n *Network) ensureBridge(bridgeName string) (netlink.Link, error) {
+// ensureBridge returns the bridge, creating it if needed, and makes sure it
+// is up and carries the gateway address of every range: pods route off the
+// bridge through it, and STATUS expects the bridge as ADD leaves it.
+func (n *Network) ensureBridge(bridgeName string, ipamConfig *config.IPAMConfig) (netlink.Link, error) {
 	br, err := n.netlink.LinkByName(bridgeName)
-	if err == nil {
-		return br, nil
+	if err != nil {
+		bridge := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{Name: bridgeName},
+		}
+		if err := n.netlink.LinkAdd(bridge); err != nil {
+			return nil, fmt.Errorf("failed to create bridge %s: %w", bridgeName, err)
+		}
+
+		br, err = n.netlink.LinkByName(bridgeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find bridge %s after creation: %w", bridgeName, err)
+		}
+		logging.Logger.Info("bridge_created", "bridge", bridgeName)
+	} else if br.Type() != "bridge" {
+		return nil, fmt.Errorf("%s exists and is a %s, not a bridge", bridgeName, br.Type())
+	}
+
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		if err := n.netlink.LinkSetUp(br); err != nil {
+			return nil, fmt.Errorf("failed to bring up bridge %s: %w", bridgeName, err)
+		}
+	}
+
+	missing, err := n.missingGateways(br, ipamConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, gw := range missing {
+		if err := n.netlink.AddrReplace(br, gw); err != nil {
+			return nil, fmt.Errorf("failed to add gateway address %s to bridge %s: %w", gw.IPNet, bridgeName, err)
+		}
+		logging.Logger.Info("bridge_gateway_added", "bridge", bridgeName, "address", gw.IPNet.String())
+	}
+	return br, nil
+}
+
+// gatewayAddrs returns the configured gateway of every range, with the
+// prefix length of its subnet.
+func gatewayAddrs(ipamConfig *config.IPAMConfig) []*netlink.Addr {
+	if ipamConfig == nil {
+		return nil
 	}
+	var out []*netlink.Addr
+	for _, set := range ipamConfig.Ranges {
+		for _, r := range set {
+			gw := net.ParseIP(r.Gateway)
+			_, subnet, err := net.ParseCIDR(r.Subnet)
+			if gw == nil || err != nil {
+				continue
+			}
+			out = append(out, &netlink.Addr{IPNet: &net.IPNet{IP: gw, Mask: subnet.Mask}})
+		}
+	}
+	return out
+}
 
-	bridge := &netlink.Bridge{
-		LinkAttrs: netlink.LinkAttrs{Name: bridgeName},
+// missingGateways returns the gateway addresses the bridge does not carry.
+func (n *Network) missingGateways(br netlink.Link, ipamConfig *config.IPAMConfig) ([]*netlink.Addr, error) {
+	gws := gatewayAddrs(ipamConfig)
+	if len(gws) == 0 {
+		return nil, nil
 	}
-	if err := n.netlink.LinkAdd(bridge); err != nil {
-		return nil, fmt.Errorf("failed to create bridge %s: %w", bridgeName, err)
+	addrs, err := n.netlink.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of bridge %s: %w", br.Attrs().Name, err)
 	}
+	var missing []*netlink.Addr
+	for _, gw := range gws {
+		if !slices.ContainsFunc(addrs, func(a netlink.Addr) bool { return a.IP.Equal(gw.IP) }) {
+			missing = append(missing, gw)
+		}
+	}
+	return missing, nil
+}
 
-	br, err = n.netlink.LinkByName(bridgeName)
+// attachToBridge enslaves the host veth to the bridge, creating the bridge if
+// needed. It runs under the IPAM lock so it cannot interleave with an empty
+// bridge being torn down by a concurrent DEL.
+func (n *Network) attachToBridge(im ipamIface, hostVeth, bridgeName string, ipamConfig *config.IPAMConfig) error {
+	unlock, err := im.Lock()
 	if err != nil {
-		return nil, fmt.Errorf("failed to find bridge %s after creation: %w", bridgeName, err)
+		return fmt.Errorf("failed to acquire lock: %w", err)
 	}
+	defer unlock()
 
-	if err := n.netlink.LinkSetUp(br); err != nil {
-		return nil, fmt.Errorf("failed to bring up bridge %s: %w", bridgeName, err)
+	br, err := n.ensureBridge(bridgeName, ipamConfig)
+	if err != nil {
+		return err
 	}
 
-	logging.Logger.Info("bridge_created", "bridge", bridgeName)
-	return br, nil
+	hostIface, err := n.netlink.LinkByName(hostVeth)
+	if err != nil {
+		return fmt.Errorf("failed to find host veth %s: %w", hostVeth, err)
+	}
+
+	if err := n.netlink.LinkSetMaster(hostIface, br); err != nil {
+		return fmt.Errorf("failed to attach %s to bridge %s: %w", hostVeth, bridgeName, err)
+	}
+	return nil
 }
 
-func (n *Network) SetupNetwork(netnsPath, hostVeth, containerVeth, containerID, bridgeName string, ipamConfig *config.IPAMConfig) (*netlink.Addr, error) {
+// SetupNetwork wires the container into the network and returns the address
+// and MAC address assigned to the container interface.
+func (n *Network) SetupNetwork(netnsPath, hostVeth, containerVeth, containerID string, conf *config.NetConf) (*netlink.Addr, net.HardwareAddr, error) {
+	bridgeName := conf.Bridge
+	ipamConfig := conf.IPAM
+
 	logging.Logger.Info("SetupNetwork",
 		"host_veth", hostVeth,
 		"container_veth", containerVeth,
@@ -79,89 +237,161 @@ func (n *Network) SetupNetwork(netnsPath, hostVeth, containerVeth, containerID,
 		"bridge", bridgeName,
 	)
 
+	var requestedMac net.HardwareAddr
+	if conf.RuntimeConfig.Mac != "" {
+		mac, err := config.ParseMAC(conf.RuntimeConfig.Mac)
+		if err != nil {
+			return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+		}
+		requestedMac = mac
+	}
+
+	natExclude, snatIPs, err := parseNATConfig(conf)
+	if err != nil {
+		return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+	}
+
+	portMappings, err := parsePortMappings(conf)
+	if err != nil {
+		return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+	}
+
+	if err := conf.RuntimeConfig.Bandwidth.Check(); err != nil {
+		return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+	}
+
+	policies, err := selectPolicies(conf)
+	if err != nil {
+		return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+	}
+
+	if err := validateSysctls(conf); err != nil {
+		return nil, nil, cnierr.Wrap(types.ErrInvalidNetworkConfig, err)
+	}
+
 	netns, err := n.ns.GetNS(netnsPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open netns: %v", err)
+		return nil, nil, cnierr.Errorf(types.ErrInvalidNetNS, "failed to open netns: %v", err)
 	}
 	defer netns.Close()
 
+	alias := LinkAlias(firewall.Owner{Network: conf.Name, ContainerID: containerID})
 	veth := &netlink.Veth{
-		LinkAttrs: netlink.LinkAttrs{Name: hostVeth},
+		LinkAttrs: netlink.LinkAttrs{Name: hostVeth, MTU: conf.MTU, Alias: alias},
 		PeerName:  containerVeth,
 	}
-	if err := n.netlink.LinkAdd(veth); err != nil {
-		return nil, fmt.Errorf("failed to create veth pair: %v", err)
+	if err := n.span("veth.create", func() error { return n.netlink.LinkAdd(veth) }); err != nil {
+		return nil, nil, fmt.Errorf("failed to create veth pair: %v", err)
 	}
 
 	cleanupVeth := func() {
 		if link, err := n.netlink.LinkByName(hostVeth); err == nil {
 			n.netlink.LinkDel(link)
 		}
+		n.deleteLink(IFBName(hostVeth))
 	}
 
+	im := n.newIPAM(ipamConfig)
+
 	if bridgeName != "" {
-		br, err := n.ensureBridge(bridgeName)
-		if err != nil {
+		if err := n.span("bridge.attach", func() error {
+			return n.attachToBridge(im, hostVeth, bridgeName, ipamConfig)
+		}, attribute.String("bridge", bridgeName)); err != nil {
 			cleanupVeth()
-			return nil, err
+			return nil, nil, err
 		}
 
 		hostIface, err := n.netlink.LinkByName(hostVeth)
 		if err != nil {
 			cleanupVeth()
-			return nil, fmt.Errorf("failed to find host veth %s: %w", hostVeth, err)
+			return nil, nil, fmt.Errorf("failed to find host veth %s: %w", hostVeth, err)
 		}
 
-		if err := n.netlink.LinkSetMaster(hostIface, br); err != nil {
+		if err := n.netlink.LinkSetUp(hostIface); err != nil {
 			cleanupVeth()
-			return nil, fmt.Errorf("failed to attach %s to bridge %s: %w", hostVeth, bridgeName, err)
+			return nil, nil, fmt.Errorf("failed to bring up host veth %s: %w", hostVeth, err)
 		}
+	}
 
-		if err := n.netlink.LinkSetUp(hostIface); err != nil {
+	if err := n.span("sysctl.host", func() error {
+		return n.applyHostSysctls(hostVeth, conf.HostSysctl)
+	}); err != nil {
+		cleanupVeth()
+		return nil, nil, err
+	}
+
+	if bw := conf.RuntimeConfig.Bandwidth; bw != nil {
+		if err := n.span("bandwidth.setup", func() error { return n.setupBandwidth(hostVeth, alias, bw) }); err != nil {
 			cleanupVeth()
-			return nil, fmt.Errorf("failed to bring up host veth %s: %w", hostVeth, err)
+			return nil, nil, err
 		}
 	}
 
 	containerIface, err := n.netlink.LinkByName(containerVeth)
 	if err != nil {
 		cleanupVeth()
-		return nil, err
+		return nil, nil, err
 	}
 	if err := n.netlink.LinkSetNsFd(containerIface, int(netns.Fd())); err != nil {
 		cleanupVeth()
-		return nil, err
-	}
-
-	if n.ipt != nil && bridgeName != "" && len(ipamConfig.Ranges) > 0 && len(ipamConfig.Ranges[0]) > 0 {
-		if subnet := ipamConfig.Ranges[0][0].Subnet; subnet != "" {
-			if err := n.ipt.AppendUnique("nat", "POSTROUTING", "-s", subnet, "!", "-o", bridgeName, "-j", "MASQUERADE"); err != nil {
-				logging.Logger.Error("masquerade_rule_failed", "subnet", subnet, "error", err.Error())
-			} else {
-				logging.Logger.Info("masquerade_rule_added", "subnet", subnet, "bridge", bridgeName)
-			}
-		}
+		return nil, nil, err
 	}
 
-	im := n.newIPAM(ipamConfig)
 	var addr *netlink.Addr
+	var mac net.HardwareAddr
 
-	if err := netns.Do(func(_ ns.NetNS) error {
+	configure := func(_ ns.NetNS) error {
 		link, err := n.netlink.LinkByName(containerVeth)
 		if err != nil {
 			return err
 		}
 
+		// Before any address exists, so settings like disable_ipv6 and
+		// accept_ra govern the interface from the start.
+		if err := n.span("sysctl.pod", func() error { return n.applyPodSysctls(conf.Sysctl) }); err != nil {
+			return err
+		}
+
 		// need testing: BindNewAddr has to be called in the goroutine?
-		addr, err = im.BindNewAddr(link, containerID)
-		if err != nil {
+		if err := n.span("ipam.bind_addr", func() error {
+			addr, err = im.BindNewAddr(link, containerID, containerVeth, hostVeth, netnsPath)
+			return err
+		}); err != nil {
 			return err
 		}
 
+		hwAddr := requestedMac
+		if hwAddr == nil && conf.MacFromIP {
+			hwAddr = macFromIPv4(addr.IP)
+		}
+		if hwAddr != nil {
+			if err := n.netlink.LinkSetHardwareAddr(link, hwAddr); err != nil {
+				return fmt.Errorf("failed to set MAC address %s on %s: %w", hwAddr, containerVeth, err)
+			}
+		}
+
 		if err := n.netlink.LinkSetUp(link); err != nil {
 			return err
 		}
 
+		if link, err := n.netlink.LinkByName(containerVeth); err == nil {
+			mac = link.Attrs().HardwareAddr
+		}
+
+		// A recycled IP may still be cached against the previous pod's MAC.
+		count := garp.DefaultCount
+		if conf.GARPCount != nil {
+			count = *conf.GARPCount
+		}
+		if n.announce != nil && mac != nil {
+			if err := n.announce.Announce(link.Attrs().Index, mac, addr.IP, count); err != nil {
+				logging.Logger.Error("address_announce_failed",
+					"ip", addr.IP.String(),
+					"error", err.Error(),
+				)
+			}
+		}
+
 		if len(ipamConfig.Ranges) > 0 && len(ipamConfig.Ranges[0]) > 0 {
 			if gwStr := ipamConfig.Ranges[0][0].Gateway; gwStr != "" {
 				gw := net.ParseIP(gwStr)
@@ -184,28 +414,265 @@ func (n *Network) SetupNetwork(netnsPath, hostVeth, containerVeth, containerID,
 		}
 
 		return nil
-	}); err != nil {
+	}
+
+	if err := n.span("netns.configure", func() error { return netns.Do(configure) }); err != nil {
 		cleanupVeth()
-		return nil, err
+		if addr != nil {
+			if _, relErr := im.ReleaseAddr(containerID, containerVeth); relErr != nil {
+				logging.Logger.Error("ip_release_failed", "container_id", containerID, "error", relErr.Error())
+			}
+		}
+		return nil, nil, err
+	}
+
+	owner := firewall.Owner{Network: conf.Name, ContainerID: containerID}
+	rollback := func() {
+		if n.newEnforcer != nil && conf.Policy != nil {
+			if e, err := n.newEnforcer(); err == nil {
+				e.Remove(hostVeth)
+			}
+		}
+		if n.newSpoof != nil && conf.SpoofCheck {
+			if sc, err := n.newSpoof(); err == nil {
+				sc.Delete(owner)
+			}
+		}
+		if fw := n.firewallFor(conf); fw != nil {
+			fw.DeleteOwned(owner)
+		}
+		if _, relErr := im.ReleaseAddr(containerID, containerVeth); relErr != nil {
+			logging.Logger.Error("ip_release_failed", "container_id", containerID, "error", relErr.Error())
+		}
+		cleanupVeth()
+	}
+
+	if fw := n.firewallFor(conf); fw != nil && bridgeName != "" {
+		if masqEnabled(conf) {
+			src := hostNet(addr.IP)
+			natPolicy := firewall.NATPolicy{Bridge: bridgeName, Exclude: natExclude, SNATIP: snatIPFor(snatIPs, addr.IP)}
+			if err := n.span("firewall.nat", func() error { return fw.AddSourceNAT(owner, src, natPolicy) }); err != nil {
+				logging.Logger.Error("masquerade_rule_failed", "source", src.String(), "error", err.Error())
+			} else {
+				logging.Logger.Info("masquerade_rule_added", "source", src.String(), "bridge", bridgeName)
+			}
+		}
+
+		if subnet := podSubnet(ipamConfig); subnet != nil {
+			if err := n.span("firewall.forward", func() error { return fw.AddForward(bridgeName, subnet) }); err != nil {
+				logging.Logger.Error("forward_rules_failed", "bridge", bridgeName, "error", err.Error())
+				// The backend knows pod traffic would be dropped whatever
+				// it installs, so the pod would start without a network.
+				if cnierr.Code(err) == cnierr.ErrFeatureUnavailable {
+					rollback()
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	// Unlike the NAT and forward rules, the features below fail the ADD when
+	// they cannot be set up: the pod would otherwise start without the ports
+	// or the protection it asked for.
+	if conf.SpoofCheck {
+		if err := n.span("spoofcheck.add", func() error { return n.addSpoofCheck(owner, hostVeth, mac, addr.IP) }); err != nil {
+			rollback()
+			return nil, nil, err
+		}
+	}
+
+	if len(portMappings) > 0 {
+		if err := n.span("portmap.add", func() error {
+			return n.addPortMappings(im, conf, containerID, addr.IP, portMappings)
+		}); err != nil {
+			rollback()
+			return nil, nil, err
+		}
+	}
+
+	if len(policies) > 0 {
+		if err := n.span("policy.apply", func() error { return n.applyPolicy(im, conf, hostVeth, addr.IP, policies) }); err != nil {
+			rollback()
+			return nil, nil, err
+		}
+	}
+
+	return addr, mac, nil
+}
+
+// addSpoofCheck pins the host veth to the pod's MAC and IP.
+func (n *Network) addSpoofCheck(owner firewall.Owner, hostVeth string, mac net.HardwareAddr, podIP net.IP) error {
+	if mac == nil {
+		return fmt.Errorf("spoof check needs the MAC address of the pod interface")
+	}
+	if n.newSpoof == nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "spoof check requires nftables")
+	}
+	sc, err := n.newSpoof()
+	if err != nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "spoof check requires nftables: %w", err)
+	}
+	return sc.Add(owner, hostVeth, mac, []net.IP{podIP})
+}
+
+// addPortMappings installs the pod's host ports. The IPAM lock serializes
+// the conflict check with concurrent ADDs on the node.
+func (n *Network) addPortMappings(im ipamIface, conf *config.NetConf, containerID string, podIP net.IP, mappings []firewall.PortMapping) error {
+	fw := n.firewallFor(conf)
+	if fw == nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "port mappings require a firewall backend")
+	}
+
+	unlock, err := im.Lock()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer unlock()
+
+	owner := firewall.Owner{Network: conf.Name, ContainerID: containerID}
+	if err := fw.AddPortMappings(owner, podIP, mappings); err != nil {
+		return fmt.Errorf("failed to map host ports: %w", err)
+	}
+	logging.Logger.Info("port_mappings_added", "container_id", containerID, "ip", podIP.String(), "count", len(mappings))
+	return nil
+}
+
+// masqEnabled reports whether pod egress is source-NATed; it defaults to on.
+func masqEnabled(conf *config.NetConf) bool {
+	return conf.IPMasq == nil || *conf.IPMasq
+}
+
+func parseNATConfig(conf *config.NetConf) ([]*net.IPNet, []net.IP, error) {
+	var exclude []*net.IPNet
+	for _, c := range conf.NonMasqueradeCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid nonMasqueradeCIDRs entry %q: %v", c, err)
+		}
+		exclude = append(exclude, cidr)
+	}
+
+	var snatIPs []net.IP
+	for _, s := range conf.SNATIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid snatIPs entry %q", s)
+		}
+		snatIPs = append(snatIPs, ip)
 	}
+	return exclude, snatIPs, nil
+}
 
-	return addr, nil
+// parsePortMappings validates the portMappings capability; the protocol
+// defaults to tcp.
+func parsePortMappings(conf *config.NetConf) ([]firewall.PortMapping, error) {
+	var out []firewall.PortMapping
+	for _, pm := range conf.RuntimeConfig.PortMappings {
+		if err := pm.Check(); err != nil {
+			return nil, err
+		}
+		m := firewall.PortMapping{
+			HostPort:      pm.HostPort,
+			ContainerPort: pm.ContainerPort,
+			Protocol:      strings.ToLower(pm.Protocol),
+		}
+		if m.Protocol == "" {
+			m.Protocol = "tcp"
+		}
+		// Runtimes send an empty or unspecified host IP to mean every address.
+		if ip := net.ParseIP(pm.HostIP); ip != nil && !ip.IsUnspecified() {
+			m.HostIP = ip
+		}
+		out = append(out, m)
+	}
+	return out, nil
 }
 
-func (n *Network) CheckNetwork(netnsPath, hostVeth, containerVeth string, expectedIPs []*current.IPConfig) error {
+// snatIPFor picks the configured SNAT address of the same family as podIP,
+// or nil to masquerade.
+func snatIPFor(snatIPs []net.IP, podIP net.IP) net.IP {
+	for _, ip := range snatIPs {
+		if (ip.To4() != nil) == (podIP.To4() != nil) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// podSubnet returns the subnet pod addresses are allocated from, or nil.
+func podSubnet(ipamConfig *config.IPAMConfig) *net.IPNet {
+	if ipamConfig == nil || len(ipamConfig.Ranges) == 0 || len(ipamConfig.Ranges[0]) == 0 {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(ipamConfig.Ranges[0][0].Subnet)
+	if err != nil {
+		return nil
+	}
+	return subnet
+}
+
+// hostNet returns ip as a single-host prefix.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// macFromIPv4 derives a stable, locally administered MAC from an IPv4 address
+// so neighbor caches stay valid when a pod is recreated with the same IP.
+// It returns nil for IPv6 addresses.
+func macFromIPv4(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	return net.HardwareAddr{0x0a, 0x58, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
+
+func (n *Network) CheckNetwork(netnsPath, hostVeth, containerVeth, containerID string, expectedIPs []*current.IPConfig, conf *config.NetConf) error {
 	// Verify host veth exists
 	if _, err := n.netlink.LinkByName(hostVeth); err != nil {
 		return fmt.Errorf("host veth %s not found: %v", hostVeth, err)
 	}
 
+	// Verify bandwidth limits are still applied
+	if bw := conf.RuntimeConfig.Bandwidth; bw != nil {
+		if err := n.span("bandwidth.check", func() error { return n.checkBandwidth(hostVeth, bw) }); err != nil {
+			return err
+		}
+	}
+
+	// Re-create host port rules that may have been flushed since ADD
+	portMappings, err := parsePortMappings(conf)
+	if err != nil {
+		return err
+	}
+	if len(portMappings) > 0 && len(expectedIPs) > 0 {
+		if err := n.span("portmap.add", func() error {
+			return n.addPortMappings(n.newIPAM(conf.IPAM), conf, containerID, expectedIPs[0].Address.IP, portMappings)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Verify forwarding is still allowed for the bridge
+	if subnet := podSubnet(conf.IPAM); conf.Bridge != "" && subnet != nil {
+		if fw := n.firewallFor(conf); fw != nil {
+			if err := n.span("firewall.check_forward", func() error { return fw.CheckForward(conf.Bridge, subnet) }); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Verify container veth and IPs inside netns
 	netns, err := n.ns.GetNS(netnsPath)
 	if err != nil {
-		return fmt.Errorf("failed to open netns: %v", err)
+		return cnierr.Errorf(types.ErrInvalidNetNS, "failed to open netns: %v", err)
 	}
 	defer netns.Close()
 
-	return netns.Do(func(_ ns.NetNS) error {
+	verify := func(_ ns.NetNS) error {
 		link, err := n.netlink.LinkByName(containerVeth)
 		if err != nil {
 			return fmt.Errorf("container veth %s not found: %v", containerVeth, err)
@@ -236,106 +703,175 @@ func (n *Network) CheckNetwork(netnsPath, hostVeth, containerVeth string, expect
 		}
 
 		return nil
-	})
+	}
+
+	return n.span("netns.check", func() error { return netns.Do(verify) })
 }
 
-func (n *Network) TeardownNetwork(hostVeth, bridgeName string, ipamConfig *config.IPAMConfig, containerID string) error {
-	im := n.newIPAM(ipamConfig)
-	if err := im.ReleaseAddr(containerID); err != nil {
-		logging.Logger.Error("ipam_release_failed",
-			"container_id", containerID,
+// TeardownNetwork removes everything ADD created for the attachment. Per the CNI
+// spec DEL must succeed when resources are already gone, so every step is
+// best-effort: missing resources are skipped, and only failures that leave
+// state behind (and so are worth a retry) are returned, joined together.
+func (n *Network) TeardownNetwork(hostVeth, containerID, containerVeth string, conf *config.NetConf) error {
+	var errs []error
+
+	var im ipamIface
+	if conf.IPAM != nil {
+		im = n.newIPAM(conf.IPAM)
+		var released []ipam.Allocation
+		err := n.span("ipam.release_addr", func() error {
+			var err error
+			released, err = im.ReleaseAddr(containerID, containerVeth)
+			return err
+		})
+		if err != nil {
+			logging.Logger.Error("ipam_release_failed",
+				"container_id", containerID,
+				"error", err.Error(),
+			)
+			errs = append(errs, fmt.Errorf("failed to release allocation: %w", err))
+		}
+		// Prefer the name recorded at ADD time over the one derived from the current config.
+		for _, alloc := range released {
+			if alloc.HostVeth != "" {
+				hostVeth = alloc.HostVeth
+				break
+			}
+		}
+	}
+
+	// Deleting the host end also removes the peer and its routes inside the
+	// container netns, so the netns itself never needs to be entered here.
+	if err := n.span("veth.delete", func() error { return n.deleteLink(hostVeth) }); err != nil {
+		logging.Logger.Error("veth_delete_failed",
+			"host_veth", hostVeth,
 			"error", err.Error(),
 		)
+		errs = append(errs, err)
+	}
+	// The veth's qdiscs go with it, but the IFB device for egress shaping does not.
+	if err := n.span("ifb.delete", func() error { return n.deleteLink(IFBName(hostVeth)) }); err != nil {
+		logging.Logger.Error("ifb_delete_failed", "host_veth", hostVeth, "error", err.Error())
+		errs = append(errs, err)
 	}
 
-	link, err := n.netlink.LinkByName(hostVeth)
-	if err != nil {
-		return err
+	if conf.SpoofCheck && n.newSpoof != nil {
+		if sc, err := n.newSpoof(); err != nil {
+			logging.Logger.Error("spoofcheck_unavailable", "error", err.Error())
+		} else if err := n.span("spoofcheck.delete", func() error {
+			return sc.Delete(firewall.Owner{Network: conf.Name, ContainerID: containerID})
+		}); err != nil {
+			logging.Logger.Error("spoofcheck_remove_failed", "container_id", containerID, "error", err.Error())
+			errs = append(errs, err)
+		}
 	}
 
-	if err := n.netlink.LinkDel(link); err != nil {
-		return err
+	if err := n.span("policy.remove", func() error { return n.removePolicy(hostVeth, conf) }); err != nil {
+		logging.Logger.Error("policy_remove_failed", "host_veth", hostVeth, "error", err.Error())
+		errs = append(errs, err)
 	}
 
-	if n.ipt != nil && bridgeName != "" && len(ipamConfig.Ranges) > 0 && len(ipamConfig.Ranges[0]) > 0 {
-		if subnet := ipamConfig.Ranges[0][0].Subnet; subnet != "" {
-			if br, err := n.netlink.LinkByName(bridgeName); err == nil {
-				links, err := n.netlink.LinkList()
-				if err == nil {
-					hasPorts := false
-					for _, l := range links {
-						if l.Attrs().MasterIndex == br.Attrs().Index {
-							hasPorts = true
-							break
-						}
-					}
-					if !hasPorts {
-						if err := n.ipt.Delete("nat", "POSTROUTING", "-s", subnet, "!", "-o", bridgeName, "-j", "MASQUERADE"); err != nil {
-							logging.Logger.Error("masquerade_rule_delete_failed", "subnet", subnet, "error", err.Error())
-						} else {
-							logging.Logger.Info("masquerade_rule_deleted", "subnet", subnet, "bridge", bridgeName)
-						}
-					}
-				}
-			}
+	fw := n.firewallFor(conf)
+	if fw != nil {
+		if err := n.span("firewall.delete", func() error {
+			return fw.DeleteOwned(firewall.Owner{Network: conf.Name, ContainerID: containerID})
+		}); err != nil {
+			logging.Logger.Error("firewall_cleanup_failed", "container_id", containerID, "error", err.Error())
+			errs = append(errs, err)
+		}
+	}
+
+	if conf.Bridge != "" && im != nil {
+		n.span("bridge.teardown", func() error {
+			n.teardownBridgeIfEmpty(im, fw, conf)
+			return nil
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteLink deletes the named link, treating an already missing link as success.
+func (n *Network) deleteLink(name string) error {
+	link, err := n.netlink.LinkByName(name)
+	if err != nil {
+		if isLinkNotFound(err) {
+			logging.Logger.Info("link_already_gone", "link", name)
+			return nil
 		}
+		return fmt.Errorf("failed to look up %s: %w", name, err)
 	}
 
+	if err := n.netlink.LinkDel(link); err != nil && !isLinkNotFound(err) {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
 	return nil
 }
 
-func (n *Network) GarbageCollect(ipamConfig *config.IPAMConfig, validContainerIDs map[string]bool) error {
-	// Clean up orphaned veth pairs
-	links, err := n.netlink.LinkList()
+func isLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound) || errors.Is(err, syscall.ENODEV)
+}
+
+// teardownBridgeIfEmpty removes the bridge-wide state once no ports remain,
+// and reports whether it deleted the bridge. It holds the IPAM lock so a
+// concurrent ADD cannot attach to a bridge that is about to be deleted.
+func (n *Network) teardownBridgeIfEmpty(im ipamIface, fw firewall.Firewall, conf *config.NetConf) bool {
+	bridgeName := conf.Bridge
+	ipamConfig := conf.IPAM
+
+	unlock, err := im.Lock()
 	if err != nil {
-		return fmt.Errorf("failed to list links: %v", err)
+		logging.Logger.Error("bridge_teardown_lock_failed", "bridge", bridgeName, "error", err.Error())
+		return false
 	}
+	defer unlock()
 
-	for _, link := range links {
-		name := link.Attrs().Name
-		if len(name) < 5 || name[:4] != "veth" {
-			continue
-		}
+	br, err := n.netlink.LinkByName(bridgeName)
+	if err != nil {
+		return false
+	}
 
-		containerIDPrefix := name[4:]
-		orphaned := true
-		for id := range validContainerIDs {
-			if len(id) >= 8 && id[:8] == containerIDPrefix {
-				orphaned = false
-				break
-			}
-		}
+	hasPorts, err := n.bridgeHasPorts(br)
+	if err != nil || hasPorts {
+		return false
+	}
 
-		if orphaned {
-			logging.Logger.Info("gc_removing_veth",
-				"veth", name,
-			)
-			if err := n.netlink.LinkDel(link); err != nil {
-				logging.Logger.Error("gc_remove_veth_failed",
-					"veth", name,
-					"error", err.Error(),
-				)
-			}
+	if subnet := podSubnet(ipamConfig); fw != nil && subnet != nil {
+		if err := fw.TeardownBridge(bridgeName, subnet); err != nil {
+			logging.Logger.Error("firewall_bridge_teardown_failed", "bridge", bridgeName, "error", err.Error())
 		}
 	}
 
-	// Clean up stale IP allocations
-	im := n.newIPAM(ipamConfig)
-	released, err := im.ReleaseStaleAllocations(validContainerIDs)
-	if err != nil {
-		return fmt.Errorf("failed to release stale allocations: %v", err)
+	if !conf.DeleteBridgeWhenEmpty {
+		return false
 	}
 
-	for _, alloc := range released {
-		logging.Logger.Info("gc_released_ip",
-			"ip", alloc.IP,
-			"container_id", alloc.ContainerID,
-		)
+	// Addresses go away with the link; list them only so the log shows what was removed.
+	var addrs []string
+	if list, err := n.netlink.AddrList(br, netlink.FAMILY_ALL); err == nil {
+		for _, a := range list {
+			addrs = append(addrs, a.IPNet.String())
+		}
 	}
 
-	return nil
+	if err := n.netlink.LinkDel(br); err != nil {
+		logging.Logger.Error("bridge_delete_failed", "bridge", bridgeName, "error", err.Error())
+		return false
+	}
+	logging.Logger.Info("bridge_deleted", "bridge", bridgeName, "addresses", addrs)
+	return true
 }
 
-func (n *Network) CheckPluginStatus(ipamConfig *config.IPAMConfig) error {
-	return n.newIPAM(ipamConfig).CheckStatus()
+func (n *Network) bridgeHasPorts(br netlink.Link) (bool, error) {
+	links, err := n.netlink.LinkList()
+	if err != nil {
+		return false, err
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex == br.Attrs().Index {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -1,19 +1,33 @@
 package network
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/innfi/probable-eureka/pkg/cnierr"
 	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/firewall"
+	"github.com/innfi/probable-eureka/pkg/garp"
 	"github.com/innfi/probable-eureka/pkg/ipam"
 	"github.com/innfi/probable-eureka/pkg/logging"
+	"github.com/innfi/probable-eureka/pkg/policy"
+	"github.com/innfi/probable-eureka/pkg/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestMain(m *testing.M) {
@@ -25,11 +39,17 @@ func TestMain(m *testing.M) {
 
 // mockLink is a fake netlink.Link with no kernel backing.
 type mockLink struct {
-	attrs netlink.LinkAttrs
+	attrs    netlink.LinkAttrs
+	linkType string
 }
 
 func (m *mockLink) Attrs() *netlink.LinkAttrs { return &m.attrs }
-func (m *mockLink) Type() string              { return "mock" }
+func (m *mockLink) Type() string {
+	if m.linkType == "" {
+		return "mock"
+	}
+	return m.linkType
+}
 
 // mockNetLink is an in-memory netlinkwrapper.NetLink.
 // It stores links in a map, records LinkDel calls, and can be told to fail LinkSetMaster.
@@ -37,11 +57,20 @@ type mockNetLink struct {
 	links        map[string]*mockLink
 	linkDelCalls []string
 	setMasterErr error
+	setHWAddrErr error
+	linkDelErr   error
 	nextIdx      int
+	qdiscs       []netlink.Qdisc
+	filters      []netlink.Filter
+	qdiscErr     error
+
+	neighs        []netlink.Neigh
+	neighDelCalls []string
+	addrs         map[string][]netlink.Addr
 }
 
 func newMockNetLink() *mockNetLink {
-	return &mockNetLink{links: make(map[string]*mockLink)}
+	return &mockNetLink{links: make(map[string]*mockLink), addrs: make(map[string][]netlink.Addr)}
 }
 
 func (m *mockNetLink) bumpIdx() int {
@@ -53,7 +82,7 @@ func (m *mockNetLink) LinkByName(name string) (netlink.Link, error) {
 	if l, ok := m.links[name]; ok {
 		return l, nil
 	}
-	return nil, fmt.Errorf("link not found: %s", name)
+	return nil, fmt.Errorf("link not found: %s: %w", name, syscall.ENODEV)
 }
 
 func (m *mockNetLink) LinkByIndex(_ int) (netlink.Link, error) { return nil, nil }
@@ -61,7 +90,7 @@ func (m *mockNetLink) LinkByIndex(_ int) (netlink.Link, error) { return nil, nil
 // LinkAdd adds the link (and its veth peer, if applicable) to the in-memory store.
 func (m *mockNetLink) LinkAdd(link netlink.Link) error {
 	name := link.Attrs().Name
-	m.links[name] = &mockLink{attrs: netlink.LinkAttrs{Name: name, Index: m.bumpIdx()}}
+	m.links[name] = &mockLink{attrs: netlink.LinkAttrs{Name: name, Index: m.bumpIdx(), Alias: link.Attrs().Alias}, linkType: link.Type()}
 	if veth, ok := link.(*netlink.Veth); ok && veth.PeerName != "" {
 		peer := veth.PeerName
 		m.links[peer] = &mockLink{attrs: netlink.LinkAttrs{Name: peer, Index: m.bumpIdx()}}
@@ -72,6 +101,9 @@ func (m *mockNetLink) LinkAdd(link netlink.Link) error {
 func (m *mockNetLink) LinkDel(link netlink.Link) error {
 	name := link.Attrs().Name
 	m.linkDelCalls = append(m.linkDelCalls, name)
+	if m.linkDelErr != nil {
+		return m.linkDelErr
+	}
 	delete(m.links, name)
 	return nil
 }
@@ -84,36 +116,79 @@ func (m *mockNetLink) LinkList() ([]netlink.Link, error) {
 	return result, nil
 }
 
-func (m *mockNetLink) LinkSetUp(_ netlink.Link) error                            { return nil }
-func (m *mockNetLink) LinkSetDown(_ netlink.Link) error                          { return nil }
-func (m *mockNetLink) LinkSetMaster(_, _ netlink.Link) error                     { return m.setMasterErr }
-func (m *mockNetLink) LinkSetNoMaster(_ netlink.Link) error                      { return nil }
-func (m *mockNetLink) LinkSetNsFd(_ netlink.Link, _ int) error                   { return nil }
-func (m *mockNetLink) LinkSetNsPid(_ netlink.Link, _ int) error                  { return nil }
-func (m *mockNetLink) LinkSetName(_ netlink.Link, _ string) error                { return nil }
-func (m *mockNetLink) LinkSetMTU(_ netlink.Link, _ int) error                    { return nil }
-func (m *mockNetLink) LinkSetHardwareAddr(_ netlink.Link, _ net.HardwareAddr) error { return nil }
-
-func (m *mockNetLink) ParseAddr(s string) (*netlink.Addr, error) { return netlink.ParseAddr(s) }
-func (m *mockNetLink) AddrAdd(_ netlink.Link, _ *netlink.Addr) error             { return nil }
-func (m *mockNetLink) AddrDel(_ netlink.Link, _ *netlink.Addr) error             { return nil }
-func (m *mockNetLink) AddrList(_ netlink.Link, _ int) ([]netlink.Addr, error)    { return nil, nil }
-func (m *mockNetLink) AddrReplace(_ netlink.Link, _ *netlink.Addr) error         { return nil }
-
-func (m *mockNetLink) RouteAdd(_ *netlink.Route) error                              { return nil }
-func (m *mockNetLink) RouteDel(_ *netlink.Route) error                              { return nil }
-func (m *mockNetLink) RouteReplace(_ *netlink.Route) error                          { return nil }
-func (m *mockNetLink) RouteList(_ netlink.Link, _ int) ([]netlink.Route, error)     { return nil, nil }
-func (m *mockNetLink) RouteGet(_ net.IP) ([]netlink.Route, error)                   { return nil, nil }
-
-func (m *mockNetLink) NeighAdd(_ *netlink.Neigh) error                              { return nil }
-func (m *mockNetLink) NeighDel(_ *netlink.Neigh) error                              { return nil }
-func (m *mockNetLink) NeighList(_, _ int) ([]netlink.Neigh, error)                  { return nil, nil }
-func (m *mockNetLink) NeighSet(_ *netlink.Neigh) error                              { return nil }
-
-func (m *mockNetLink) RuleAdd(_ *netlink.Rule) error                                { return nil }
-func (m *mockNetLink) RuleDel(_ *netlink.Rule) error                                { return nil }
-func (m *mockNetLink) RuleList(_ int) ([]netlink.Rule, error)                       { return nil, nil }
+func (m *mockNetLink) LinkSetUp(link netlink.Link) error {
+	if l, ok := m.links[link.Attrs().Name]; ok {
+		l.attrs.Flags |= net.FlagUp
+	}
+	return nil
+}
+func (m *mockNetLink) LinkSetDown(_ netlink.Link) error { return nil }
+func (m *mockNetLink) LinkSetMaster(link, master netlink.Link) error {
+	if m.setMasterErr != nil {
+		return m.setMasterErr
+	}
+	if l, ok := m.links[link.Attrs().Name]; ok {
+		l.attrs.MasterIndex = master.Attrs().Index
+	}
+	return nil
+}
+func (m *mockNetLink) LinkSetNoMaster(_ netlink.Link) error       { return nil }
+func (m *mockNetLink) LinkSetNsFd(_ netlink.Link, _ int) error    { return nil }
+func (m *mockNetLink) LinkSetNsPid(_ netlink.Link, _ int) error   { return nil }
+func (m *mockNetLink) LinkSetName(_ netlink.Link, _ string) error { return nil }
+func (m *mockNetLink) LinkSetMTU(_ netlink.Link, _ int) error     { return nil }
+func (m *mockNetLink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	if m.setHWAddrErr != nil {
+		return m.setHWAddrErr
+	}
+	if l, ok := m.links[link.Attrs().Name]; ok {
+		l.attrs.HardwareAddr = hwaddr
+	}
+	return nil
+}
+
+func (m *mockNetLink) ParseAddr(s string) (*netlink.Addr, error)     { return netlink.ParseAddr(s) }
+func (m *mockNetLink) AddrAdd(_ netlink.Link, _ *netlink.Addr) error { return nil }
+func (m *mockNetLink) AddrDel(_ netlink.Link, _ *netlink.Addr) error { return nil }
+func (m *mockNetLink) AddrList(link netlink.Link, _ int) ([]netlink.Addr, error) {
+	return m.addrs[link.Attrs().Name], nil
+}
+func (m *mockNetLink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	m.addrs[name] = append(m.addrs[name], *addr)
+	return nil
+}
+
+func (m *mockNetLink) RouteAdd(_ *netlink.Route) error                          { return nil }
+func (m *mockNetLink) RouteDel(_ *netlink.Route) error                          { return nil }
+func (m *mockNetLink) RouteReplace(_ *netlink.Route) error                      { return nil }
+func (m *mockNetLink) RouteList(_ netlink.Link, _ int) ([]netlink.Route, error) { return nil, nil }
+func (m *mockNetLink) RouteGet(_ net.IP) ([]netlink.Route, error)               { return nil, nil }
+
+func (m *mockNetLink) NeighAdd(_ *netlink.Neigh) error { return nil }
+func (m *mockNetLink) NeighDel(neigh *netlink.Neigh) error {
+	m.neighDelCalls = append(m.neighDelCalls, neigh.IP.String())
+	return nil
+}
+func (m *mockNetLink) NeighList(_, _ int) ([]netlink.Neigh, error) { return m.neighs, nil }
+func (m *mockNetLink) NeighSet(_ *netlink.Neigh) error             { return nil }
+
+func (m *mockNetLink) RuleAdd(_ *netlink.Rule) error          { return nil }
+func (m *mockNetLink) RuleDel(_ *netlink.Rule) error          { return nil }
+func (m *mockNetLink) RuleList(_ int) ([]netlink.Rule, error) { return nil, nil }
+
+func (m *mockNetLink) QdiscAdd(qdisc netlink.Qdisc) error {
+	if m.qdiscErr != nil {
+		return m.qdiscErr
+	}
+	m.qdiscs = append(m.qdiscs, qdisc)
+	return nil
+}
+func (m *mockNetLink) QdiscList(_ netlink.Link) ([]netlink.Qdisc, error) { return m.qdiscs, nil }
+func (m *mockNetLink) FilterAdd(filter netlink.Filter) error {
+	m.filters = append(m.filters, filter)
+	return nil
+}
 
 // mockNetNS runs Do callbacks in the same goroutine without entering a real netns.
 type mockNetNS struct{}
@@ -125,35 +200,214 @@ func (m *mockNetNS) Fd() uintptr                         { return 0 }
 func (m *mockNetNS) Close() error                        { return nil }
 
 // mockNSWrapper wraps a mockNetNS as a nswrapper.NS.
-type mockNSWrapper struct{ netns *mockNetNS }
+type mockNSWrapper struct {
+	netns    *mockNetNS
+	getNSErr error
+}
 
 func (m *mockNSWrapper) WithNetNSPath(_ string, toRun func(ns.NetNS) error) error {
 	return toRun(m.netns)
 }
-func (m *mockNSWrapper) CurrentNS() (ns.NetNS, error)    { return m.netns, nil }
-func (m *mockNSWrapper) GetNS(_ string) (ns.NetNS, error) { return m.netns, nil }
+func (m *mockNSWrapper) CurrentNS() (ns.NetNS, error) { return m.netns, nil }
+func (m *mockNSWrapper) GetNS(_ string) (ns.NetNS, error) {
+	if m.getNSErr != nil {
+		return nil, m.getNSErr
+	}
+	return m.netns, nil
+}
 
 // mockIPAM is a preset ipamIface for tests.
 type mockIPAM struct {
-	bindResult *netlink.Addr
-	bindErr    error
-	releaseErr error
+	bindResult   *netlink.Addr
+	bindErr      error
+	released     []ipam.Allocation
+	releaseErr   error
+	allocations  []ipam.Allocation
+	statusErr    error
+	lockCalls    int
+	releaseCalls int
+	bindCalls    int
 }
 
-func (m *mockIPAM) BindNewAddr(_ netlink.Link, _ string) (*netlink.Addr, error) {
+func (m *mockIPAM) BindNewAddr(_ netlink.Link, _, _, _, _ string) (*netlink.Addr, error) {
+	m.bindCalls++
 	return m.bindResult, m.bindErr
 }
-func (m *mockIPAM) ReleaseAddr(_ string) error { return m.releaseErr }
-func (m *mockIPAM) ReleaseStaleAllocations(_ map[string]bool) ([]ipam.Allocation, error) {
-	return nil, nil
+func (m *mockIPAM) ReleaseAddr(_, _ string) ([]ipam.Allocation, error) {
+	m.releaseCalls++
+	return m.released, m.releaseErr
+}
+func (m *mockIPAM) Allocations() ([]ipam.Allocation, error) { return m.allocations, nil }
+func (m *mockIPAM) ReleaseStaleAllocations(valid map[string]bool, _ time.Duration, dryRun bool) ([]ipam.Allocation, error) {
+	var kept, released []ipam.Allocation
+	for _, a := range m.allocations {
+		if valid[a.ContainerID] {
+			kept = append(kept, a)
+		} else {
+			released = append(released, a)
+		}
+	}
+	if !dryRun {
+		m.allocations = kept
+	}
+	return released, nil
+}
+func (m *mockIPAM) ReleaseOrphans(gone func(ipam.Allocation) bool, _ bool) ([]ipam.Allocation, error) {
+	var orphans []ipam.Allocation
+	for _, a := range m.allocations {
+		if gone(a) {
+			orphans = append(orphans, a)
+		}
+	}
+	return orphans, nil
+}
+func (m *mockIPAM) CheckStatus(_ time.Duration) error { return m.statusErr }
+func (m *mockIPAM) Lock() (func(), error) {
+	m.lockCalls++
+	return func() {}, nil
+}
+
+// mockAnnouncer records Announce calls.
+type mockAnnouncer struct {
+	calls []announceCall
+}
+
+type announceCall struct {
+	mac   string
+	ip    string
+	count int
+}
+
+func (m *mockAnnouncer) Announce(_ int, mac net.HardwareAddr, ip net.IP, count int) error {
+	m.calls = append(m.calls, announceCall{mac: mac.String(), ip: ip.String(), count: count})
+	return nil
+}
+
+// mockFirewall records the owners it was asked to add and delete rules for.
+type mockFirewall struct {
+	masquerades     []string
+	deleted         []firewall.Owner
+	forwards        []string
+	bridgeTeardowns []string
+	portMappings    []string
+	portMappingErr  error
+	forwardErr      error
+	deleteOwnedErr  error
+	owners          []firewall.Owner
+}
+
+func (m *mockFirewall) AddSourceNAT(owner firewall.Owner, src *net.IPNet, policy firewall.NATPolicy) error {
+	entry := owner.Comment() + " " + src.String() + " " + policy.Bridge
+	for _, dst := range policy.Exclude {
+		entry += " !" + dst.String()
+	}
+	if policy.SNATIP != nil {
+		entry += " snat:" + policy.SNATIP.String()
+	}
+	m.masquerades = append(m.masquerades, entry)
+	return nil
+}
+func (m *mockFirewall) AddPortMappings(owner firewall.Owner, podIP net.IP, mappings []firewall.PortMapping) error {
+	if m.portMappingErr != nil {
+		return m.portMappingErr
+	}
+	for _, pm := range mappings {
+		entry := fmt.Sprintf("%s %s/%d->%s:%d", owner.Comment(), pm.Protocol, pm.HostPort, podIP, pm.ContainerPort)
+		if pm.HostIP != nil {
+			entry += " on " + pm.HostIP.String()
+		}
+		m.portMappings = append(m.portMappings, entry)
+	}
+	return nil
+}
+func (m *mockFirewall) DeleteOwned(owner firewall.Owner) error {
+	if m.deleteOwnedErr != nil {
+		return m.deleteOwnedErr
+	}
+	m.deleted = append(m.deleted, owner)
+	return nil
+}
+func (m *mockFirewall) Owners(network string) ([]firewall.Owner, error) {
+	var out []firewall.Owner
+	for _, o := range m.owners {
+		if o.Network == network {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+func (m *mockFirewall) AddForward(bridge string, subnet *net.IPNet) error {
+	if m.forwardErr != nil {
+		return m.forwardErr
+	}
+	m.forwards = append(m.forwards, bridge+" "+subnet.String())
+	return nil
+}
+func (m *mockFirewall) CheckForward(bridge string, subnet *net.IPNet) error {
+	for _, f := range m.forwards {
+		if f == bridge+" "+subnet.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("forward rules for %s missing", bridge)
+}
+func (m *mockFirewall) TeardownBridge(bridge string, subnet *net.IPNet) error {
+	m.bridgeTeardowns = append(m.bridgeTeardowns, bridge+" "+subnet.String())
+	return nil
 }
-func (m *mockIPAM) CheckStatus() error { return nil }
+
+// mockEnforcer records the plans it applied and the veths it cleaned up.
+type mockEnforcer struct {
+	applied   []*policy.Plan
+	removed   []string
+	applyErr  error
+	hostVeths []string
+}
+
+func (m *mockEnforcer) Apply(plan *policy.Plan) error {
+	if m.applyErr != nil {
+		return m.applyErr
+	}
+	m.applied = append(m.applied, plan)
+	return nil
+}
+func (m *mockEnforcer) Remove(hostVeth string) error {
+	m.removed = append(m.removed, hostVeth)
+	return nil
+}
+func (m *mockEnforcer) HostVeths() ([]string, error) { return m.hostVeths, nil }
+
+// mockSpoofChecker records the ports it pinned and the owners it released.
+type mockSpoofChecker struct {
+	added   []string
+	deleted []firewall.Owner
+	owners  []firewall.Owner
+}
+
+func (m *mockSpoofChecker) Add(owner firewall.Owner, hostVeth string, mac net.HardwareAddr, ips []net.IP) error {
+	m.added = append(m.added, fmt.Sprintf("%s %s %s %v", owner.Comment(), hostVeth, mac, ips))
+	return nil
+}
+func (m *mockSpoofChecker) Delete(owner firewall.Owner) error {
+	m.deleted = append(m.deleted, owner)
+	return nil
+}
+func (m *mockSpoofChecker) Owners(_ string) ([]firewall.Owner, error) { return m.owners, nil }
 
 // Compile-time interface checks.
 var _ ipamIface = (*mockIPAM)(nil)
+var _ garp.Announcer = (*mockAnnouncer)(nil)
+var _ firewall.Firewall = (*mockFirewall)(nil)
+var _ policyEnforcer = (*mockEnforcer)(nil)
+var _ firewall.SpoofChecker = (*mockSpoofChecker)(nil)
 
 // ---- helpers ----
 
+func makeNetConf(t *testing.T, bridge string) *config.NetConf {
+	t.Helper()
+	return &config.NetConf{Bridge: bridge, IPAM: makeIPAMConfig(t)}
+}
+
 func makeIPAMConfig(t *testing.T) *config.IPAMConfig {
 	t.Helper()
 	return &config.IPAMConfig{
@@ -173,7 +427,7 @@ func newTestNetwork(nl *mockNetLink, nsw *mockNSWrapper, makeIPAM func(*config.I
 	return &Network{
 		netlink: nl,
 		ns:      nsw,
-		ipt:     nil, // no iptables calls; avoids root requirement
+		// newFirewall left nil: no iptables/nftables calls, avoids root requirement
 		newIPAM: makeIPAM,
 	}
 }
@@ -190,11 +444,71 @@ func TestSetupNetwork_HappyPath(t *testing.T) {
 
 	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
 
-	addr, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", "cni0", makeIPAMConfig(t))
+	addr, mac, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", makeNetConf(t, "cni0"))
 
 	require.NoError(t, err)
 	require.NotNil(t, addr)
 	assert.Equal(t, "10.0.0.2", addr.IP.String())
+	assert.Nil(t, mac, "MAC is left to the kernel unless configured")
+	assert.Equal(t, LinkAlias(firewall.Owner{ContainerID: "ctr1"}), nl.links["veth-host"].attrs.Alias,
+		"the host veth is tagged with its owner for GC")
+}
+
+func TestSetupNetwork_MacAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		mac       string
+		macFromIP bool
+		wantMac   string
+		wantErr   bool
+	}{
+		{name: "requested MAC is applied", mac: "02:42:ac:11:00:02", wantMac: "02:42:ac:11:00:02"},
+		{name: "derived from IPv4", macFromIP: true, wantMac: "0a:58:0a:00:00:02"},
+		{name: "requested MAC wins over derived", mac: "02:42:ac:11:00:02", macFromIP: true, wantMac: "02:42:ac:11:00:02"},
+		{name: "invalid MAC is rejected", mac: "not-a-mac", wantErr: true},
+		{name: "EUI-64 MAC is rejected", mac: "02:42:ac:11:00:02:00:01", wantErr: true},
+		{name: "multicast MAC is rejected", mac: "01:00:5e:00:00:01", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nsw := &mockNSWrapper{netns: &mockNetNS{}}
+			wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+			mipm := &mockIPAM{bindResult: wantAddr}
+			n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+			conf := makeNetConf(t, "cni0")
+			conf.MacFromIP = tc.macFromIP
+			conf.RuntimeConfig.Mac = tc.mac
+
+			_, mac, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+
+			if tc.wantErr {
+				require.Error(t, err)
+				assert.Empty(t, nl.links, "no veth should be created for an invalid MAC")
+				assert.Zero(t, mipm.bindCalls, "no address should be allocated for an invalid MAC")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMac, mac.String())
+		})
+	}
+}
+
+func TestSetupNetwork_ReleasesAddrWhenConfigureFails(t *testing.T) {
+	nl := newMockNetLink()
+	nl.setHWAddrErr = errors.New("cannot assign requested address")
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	mipm := &mockIPAM{bindResult: wantAddr}
+	n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	conf := makeNetConf(t, "cni0")
+	conf.RuntimeConfig.Mac = "02:42:ac:11:00:02"
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+
+	require.ErrorContains(t, err, "cannot assign requested address")
+	assert.Equal(t, 1, mipm.releaseCalls, "the address bound inside the netns must not leak")
+	assert.NotContains(t, nl.links, "veth-host")
 }
 
 func TestSetupNetwork_RollsBackVethOnBridgeAttachFail(t *testing.T) {
@@ -207,13 +521,48 @@ func TestSetupNetwork_RollsBackVethOnBridgeAttachFail(t *testing.T) {
 
 	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
 
-	addr, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", "cni0", makeIPAMConfig(t))
+	addr, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", makeNetConf(t, "cni0"))
 
 	require.Error(t, err)
 	assert.Nil(t, addr)
 	assert.Contains(t, nl.linkDelCalls, "veth-host", "host veth should be deleted on rollback")
 }
 
+func TestSetupNetwork_AnnouncesAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		garpCount *int
+		wantCount int
+	}{
+		{name: "default count", wantCount: garp.DefaultCount},
+		{name: "configured count", garpCount: intPtr(3), wantCount: 3},
+		{name: "disabled", garpCount: intPtr(0), wantCount: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nsw := &mockNSWrapper{netns: &mockNetNS{}}
+			wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+			mipm := &mockIPAM{bindResult: wantAddr}
+			ann := &mockAnnouncer{}
+			n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+			n.announce = ann
+
+			conf := makeNetConf(t, "cni0")
+			conf.MacFromIP = true
+			conf.GARPCount = tc.garpCount
+
+			_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+
+			require.NoError(t, err)
+			require.Len(t, ann.calls, 1)
+			assert.Equal(t, announceCall{mac: "0a:58:0a:00:00:02", ip: "10.0.0.2", count: tc.wantCount}, ann.calls[0])
+		})
+	}
+}
+
+func intPtr(v int) *int { return &v }
+
 func TestTeardownNetwork_CallsLinkDel(t *testing.T) {
 	nl := newMockNetLink()
 	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 1}}
@@ -222,20 +571,1005 @@ func TestTeardownNetwork_CallsLinkDel(t *testing.T) {
 
 	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
 
-	err := n.TeardownNetwork("veth-host", "", makeIPAMConfig(t), "ctr1")
+	err := n.TeardownNetwork("veth-host", "ctr1", "eth0", makeNetConf(t, ""))
 
 	require.NoError(t, err)
 	assert.Contains(t, nl.linkDelCalls, "veth-host")
 }
 
+func TestTeardownNetwork_PrefersRecordedHostVeth(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["veth-recorded"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-recorded", Index: 1}}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{released: []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "ctr1", IfName: "eth0", HostVeth: "veth-recorded"},
+	}}
+
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+	err := n.TeardownNetwork("veth-derived", "ctr1", "eth0", makeNetConf(t, ""))
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"veth-recorded"}, nl.linkDelCalls)
+}
+
+func TestTeardownNetwork_ToleratesMissingResources(t *testing.T) {
+	nl := newMockNetLink() // host veth already gone, e.g. after a reboot
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+	err := n.TeardownNetwork("veth-host", "ctr1", "eth0", makeNetConf(t, "cni0"))
+
+	require.NoError(t, err)
+	assert.Empty(t, nl.linkDelCalls)
+}
+
+func TestTeardownNetwork_ToleratesMissingIPAMConfig(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 1}}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	n := newTestNetwork(nl, nsw, nil)
+
+	err := n.TeardownNetwork("veth-host", "ctr1", "eth0", &config.NetConf{})
+
+	require.NoError(t, err)
+	assert.Contains(t, nl.linkDelCalls, "veth-host")
+}
+
+func TestTeardownNetwork_AggregatesRetryableFailures(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 1}}
+	nl.linkDelErr = errors.New("device busy")
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{releaseErr: errors.New("disk full")}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+	err := n.TeardownNetwork("veth-host", "ctr1", "eth0", makeNetConf(t, ""))
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "disk full")
+	assert.Contains(t, err.Error(), "device busy")
+}
+
+func TestTeardownNetwork_ReportsFirewallFailure(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 1}}
+	mipm := &mockIPAM{}
+	n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	fw := &mockFirewall{deleteOwnedErr: errors.New("xtables lock held")}
+	n.newFirewall = func(string) (firewall.Firewall, error) { return fw, nil }
+
+	err := n.TeardownNetwork("veth-host", "ctr1", "eth0", makeNetConf(t, ""))
+
+	require.Error(t, err, "DEL must fail so the runtime retries the rule cleanup")
+	assert.ErrorContains(t, err, "xtables lock held")
+	assert.NotContains(t, nl.links, "veth-host", "the other steps still run")
+}
+
+func TestFirewall_MasqueradeAddedAndRemovedPerAttachment(t *testing.T) {
+	nl := newMockNetLink()
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	mipm := &mockIPAM{bindResult: wantAddr}
+	fw := &mockFirewall{}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+
+	conf := makeNetConf(t, "cni0")
+	conf.Name = "eureka"
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"name=eureka,id=ctr1 10.0.0.2/32 cni0"}, fw.masquerades)
+
+	require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+	assert.Equal(t, []firewall.Owner{{Network: "eureka", ContainerID: "ctr1"}}, fw.deleted)
+}
+
+func TestFirewall_NATPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*config.NetConf)
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "ipMasq disabled installs nothing",
+			mutate: func(c *config.NetConf) { c.IPMasq = boolPtr(false) },
+			want:   nil,
+		},
+		{
+			name: "exclusions and SNAT IP of the pod's family",
+			mutate: func(c *config.NetConf) {
+				c.NonMasqueradeCIDRs = []string{"10.244.0.0/16", "fd00::/8"}
+				c.SNATIPs = []string{"2001:db8::1", "192.0.2.10"}
+			},
+			want: []string{"name=eureka,id=ctr1 10.0.0.2/32 cni0 !10.244.0.0/16 !fd00::/8 snat:192.0.2.10"},
+		},
+		{
+			name:    "malformed CIDR is rejected",
+			mutate:  func(c *config.NetConf) { c.NonMasqueradeCIDRs = []string{"10.0.0.0/33"} },
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nsw := &mockNSWrapper{netns: &mockNetNS{}}
+			wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+			mipm := &mockIPAM{bindResult: wantAddr}
+			fw := &mockFirewall{}
+			n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+			n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+
+			conf := makeNetConf(t, "cni0")
+			conf.Name = "eureka"
+			tc.mutate(conf)
+
+			_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, fw.masquerades)
+		})
+	}
+}
+
+func boolPtr(v bool) *bool { return &v }
+
+func TestFirewall_ForwardRulesLifecycle(t *testing.T) {
+	nl := newMockNetLink()
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	mipm := &mockIPAM{bindResult: wantAddr}
+	fw := &mockFirewall{}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+	conf := makeNetConf(t, "cni0")
+
+	// CHECK fails until ADD has installed the rules.
+	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host"}}
+	require.Error(t, n.CheckNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", nil, conf))
+	delete(nl.links, "veth-host")
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cni0 10.0.0.0/24"}, fw.forwards)
+
+	require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+	assert.Equal(t, []string{"cni0 10.0.0.0/24"}, fw.bridgeTeardowns, "rules go with the last pod")
+}
+
+func TestFirewall_PortMappings(t *testing.T) {
+	newNet := func(fw *mockFirewall, mipm *mockIPAM) *Network {
+		n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+		n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+		return n
+	}
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	conf := makeNetConf(t, "cni0")
+	conf.Name = "eureka"
+	conf.RuntimeConfig.PortMappings = []config.PortMapping{
+		{HostPort: 8080, ContainerPort: 80},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "UDP", HostIP: "192.0.2.1"},
+		{HostPort: 9090, ContainerPort: 90, HostIP: "0.0.0.0"},
+	}
+	want := []string{
+		"name=eureka,id=ctr1 tcp/8080->10.0.0.2:80",
+		"name=eureka,id=ctr1 udp/5353->10.0.0.2:53 on 192.0.2.1",
+		"name=eureka,id=ctr1 tcp/9090->10.0.0.2:90",
+	}
+
+	t.Run("installed on ADD under the IPAM lock", func(t *testing.T) {
+		fw := &mockFirewall{}
+		mipm := &mockIPAM{bindResult: wantAddr}
+		_, _, err := newNet(fw, mipm).SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.NoError(t, err)
+		assert.Equal(t, want, fw.portMappings)
+		assert.Equal(t, 2, mipm.lockCalls, "bridge attach and port mappings")
+	})
+
+	t.Run("conflict fails ADD and rolls back", func(t *testing.T) {
+		fw := &mockFirewall{portMappingErr: errors.New("host port tcp/8080 is already mapped")}
+		mipm := &mockIPAM{bindResult: wantAddr}
+		n := newNet(fw, mipm)
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.ErrorContains(t, err, "already mapped")
+		assert.Equal(t, 1, mipm.releaseCalls)
+		assert.Equal(t, []firewall.Owner{{Network: "eureka", ContainerID: "ctr1"}}, fw.deleted)
+		assert.NotContains(t, n.netlink.(*mockNetLink).links, "veth-host")
+	})
+
+	t.Run("re-created on CHECK", func(t *testing.T) {
+		fw := &mockFirewall{}
+		n := newNet(fw, &mockIPAM{})
+		n.netlink.(*mockNetLink).links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host"}}
+		ips := []*current.IPConfig{{Address: *wantAddr.IPNet}}
+		// The container side is not mocked, so CHECK still fails after restoring the mappings.
+		require.Error(t, n.CheckNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", ips, conf))
+		assert.Equal(t, want, fw.portMappings)
+	})
+
+	t.Run("invalid protocol is rejected", func(t *testing.T) {
+		bad := *conf
+		bad.RuntimeConfig.PortMappings = []config.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}}
+		_, _, err := newNet(&mockFirewall{}, &mockIPAM{bindResult: wantAddr}).SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", &bad)
+		require.Error(t, err)
+	})
+}
+
+func TestFirewall_UnavailableBackendIsSkipped(t *testing.T) {
+	nl := newMockNetLink()
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	mipm := &mockIPAM{bindResult: wantAddr}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newFirewall = func(_ string) (firewall.Firewall, error) { return nil, errors.New("no iptables or nft") }
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", makeNetConf(t, "cni0"))
+
+	require.NoError(t, err)
+}
+
+func TestSetupNetwork_Bandwidth(t *testing.T) {
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	setup := func(nl *mockNetLink, bw *config.BandwidthEntry) error {
+		n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface {
+			return &mockIPAM{bindResult: wantAddr}
+		})
+		conf := makeNetConf(t, "cni0")
+		conf.RuntimeConfig.Bandwidth = bw
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		return err
+	}
+
+	t.Run("ingress is shaped on the host veth", func(t *testing.T) {
+		nl := newMockNetLink()
+		require.NoError(t, setup(nl, &config.BandwidthEntry{IngressRate: 8_000_000, IngressBurst: 80_000}))
+
+		require.Len(t, nl.qdiscs, 1)
+		tbf, ok := nl.qdiscs[0].(*netlink.Tbf)
+		require.True(t, ok)
+		assert.Equal(t, nl.links["veth-host"].Attrs().Index, tbf.LinkIndex)
+		assert.Equal(t, uint64(1_000_000), tbf.Rate, "rate is converted to bytes")
+		assert.NotContains(t, nl.links, IFBName("veth-host"))
+
+		n := newTestNetwork(nl, nil, nil)
+		assert.NoError(t, n.checkBandwidth("veth-host", &config.BandwidthEntry{IngressRate: 8_000_000}))
+		assert.Error(t, n.checkBandwidth("veth-host", &config.BandwidthEntry{EgressRate: 8_000_000}))
+	})
+
+	t.Run("egress is redirected through an IFB device", func(t *testing.T) {
+		nl := newMockNetLink()
+		require.NoError(t, setup(nl, &config.BandwidthEntry{EgressRate: 8_000_000, EgressBurst: 80_000}))
+
+		ifb, ok := nl.links[IFBName("veth-host")]
+		require.True(t, ok)
+		require.Len(t, nl.qdiscs, 2)
+		assert.Equal(t, ifb.Attrs().Index, nl.qdiscs[0].Attrs().LinkIndex)
+		assert.IsType(t, &netlink.Ingress{}, nl.qdiscs[1])
+		require.Len(t, nl.filters, 1)
+		u32 := nl.filters[0].(*netlink.U32)
+		assert.Equal(t, nl.links["veth-host"].Attrs().Index, u32.LinkIndex)
+		assert.Equal(t, ifb.Attrs().Index, u32.RedirIndex)
+	})
+
+	t.Run("qdisc failure rolls back", func(t *testing.T) {
+		nl := newMockNetLink()
+		nl.qdiscErr = errors.New("operation not supported")
+		require.Error(t, setup(nl, &config.BandwidthEntry{EgressRate: 8_000_000, EgressBurst: 80_000}))
+		assert.NotContains(t, nl.links, "veth-host")
+		assert.NotContains(t, nl.links, IFBName("veth-host"))
+	})
+
+	t.Run("rate without burst is rejected", func(t *testing.T) {
+		nl := newMockNetLink()
+		require.Error(t, setup(nl, &config.BandwidthEntry{IngressRate: 8_000_000}))
+		assert.Empty(t, nl.links)
+	})
+}
+
+func TestTeardownNetwork_DeletesIFB(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 1}}
+	nl.links[IFBName("veth-host")] = &mockLink{attrs: netlink.LinkAttrs{Name: IFBName("veth-host"), Index: 2}}
+	n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return &mockIPAM{} })
+
+	require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", makeNetConf(t, "")))
+
+	assert.Empty(t, nl.links)
+}
+
+func TestPolicy_Lifecycle(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyFile, []byte(`{"policies": [
+		{"name": "web", "podSelector": {"app": "web"}, "ingress": [{"cidrs": ["10.244.0.0/16"], "ports": [{"port": 80}]}]},
+		{"name": "db", "podSelector": {"app": "db"}, "egress": []}
+	]}`), 0o644))
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+
+	newNet := func(e *mockEnforcer, mipm *mockIPAM) *Network {
+		n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+		n.newEnforcer = func() (policyEnforcer, error) { return e, nil }
+		return n
+	}
+	newConf := func(labels map[string]string, dryRun bool) *config.NetConf {
+		conf := makeNetConf(t, "cni0")
+		conf.Policy = &config.PolicyConfig{File: policyFile, DryRun: dryRun}
+		conf.PodLabels = labels
+		return conf
+	}
+
+	t.Run("selected policies are applied on ADD and removed on DEL", func(t *testing.T) {
+		e := &mockEnforcer{}
+		n := newNet(e, &mockIPAM{bindResult: wantAddr})
+		conf := newConf(map[string]string{"app": "web"}, false)
+		conf.PodPolicy = "out:10.0.0.0/8"
+
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.NoError(t, err)
+		require.Len(t, e.applied, 1)
+		var chains []string
+		for _, c := range e.applied[0].Chains {
+			chains = append(chains, c.Name)
+		}
+		assert.Equal(t, []string{"EUREKA-PI-veth-host", "EUREKA-PE-veth-host"}, chains)
+
+		require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+		assert.Equal(t, []string{"veth-host"}, e.removed)
+	})
+
+	t.Run("unselected pod gets no policy", func(t *testing.T) {
+		e := &mockEnforcer{}
+		_, _, err := newNet(e, &mockIPAM{bindResult: wantAddr}).SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", newConf(map[string]string{"app": "cache"}, false))
+		require.NoError(t, err)
+		assert.Empty(t, e.applied)
+	})
+
+	t.Run("dry run installs nothing", func(t *testing.T) {
+		e := &mockEnforcer{}
+		n := newNet(e, &mockIPAM{bindResult: wantAddr})
+		conf := newConf(map[string]string{"app": "db"}, true)
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.NoError(t, err)
+		assert.Empty(t, e.applied)
+
+		require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+		assert.Empty(t, e.removed)
+	})
+
+	t.Run("failure to apply fails ADD and rolls back", func(t *testing.T) {
+		e := &mockEnforcer{applyErr: errors.New("ipset: command not found")}
+		mipm := &mockIPAM{bindResult: wantAddr}
+		n := newNet(e, mipm)
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", newConf(map[string]string{"app": "web"}, false))
+		require.Error(t, err)
+		assert.Equal(t, 1, mipm.releaseCalls)
+		assert.Equal(t, []string{"veth-host"}, e.removed)
+		assert.NotContains(t, n.netlink.(*mockNetLink).links, "veth-host")
+	})
+
+	t.Run("bridge netfilter disabled fails ADD", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			sysctl  func(string, ...string) (string, error)
+			wantMsg string
+		}{
+			{
+				name:    "sysctl off",
+				sysctl:  func(string, ...string) (string, error) { return "0\n", nil },
+				wantMsg: "network policy requires net.bridge.bridge-nf-call-iptables=1",
+			},
+			{
+				name: "module not loaded",
+				sysctl: func(string, ...string) (string, error) {
+					return "", os.ErrNotExist
+				},
+				wantMsg: "network policy requires the br_netfilter module",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				e := &mockEnforcer{}
+				mipm := &mockIPAM{bindResult: wantAddr}
+				n := newNet(e, mipm)
+				var keys []string
+				n.sysctl = func(name string, params ...string) (string, error) {
+					keys = append(keys, name)
+					if name == "net.bridge.bridge-nf-call-iptables" {
+						return tc.sysctl(name, params...)
+					}
+					return "1", nil
+				}
+
+				_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", newConf(map[string]string{"app": "web"}, false))
+				require.Error(t, err)
+				assert.Equal(t, cnierr.ErrFeatureUnavailable, cnierr.Code(err))
+				assert.ErrorContains(t, err, tc.wantMsg)
+				assert.Contains(t, keys, "net.bridge.bridge-nf-call-iptables")
+				assert.Empty(t, e.applied)
+				assert.Equal(t, 1, mipm.releaseCalls)
+			})
+		}
+	})
+
+	t.Run("unreadable policy file fails before any change", func(t *testing.T) {
+		nl := newMockNetLink()
+		n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, nil)
+		conf := newConf(nil, false)
+		conf.Policy.File = filepath.Join(t.TempDir(), "missing.json")
+		_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.Error(t, err)
+		assert.Empty(t, nl.links)
+	})
+}
+
+func TestSpoofCheck_Lifecycle(t *testing.T) {
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	sc := &mockSpoofChecker{}
+	n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface {
+		return &mockIPAM{bindResult: wantAddr}
+	})
+	n.newSpoof = func() (firewall.SpoofChecker, error) { return sc, nil }
+	conf := makeNetConf(t, "cni0")
+	conf.Name = "eureka"
+	conf.SpoofCheck = true
+	conf.MacFromIP = true
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"name=eureka,id=ctr1 veth-host 0a:58:0a:00:00:02 [10.0.0.2]"}, sc.added)
+
+	require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+	assert.Equal(t, []firewall.Owner{{Network: "eureka", ContainerID: "ctr1"}}, sc.deleted)
+}
+
+func TestSpoofCheck_UnavailableFailsAdd(t *testing.T) {
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	mipm := &mockIPAM{bindResult: wantAddr}
+	nl := newMockNetLink()
+	n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newSpoof = func() (firewall.SpoofChecker, error) { return nil, errors.New("nft not found") }
+	conf := makeNetConf(t, "cni0")
+	conf.SpoofCheck = true
+	conf.MacFromIP = true
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+
+	require.ErrorContains(t, err, "nft not found")
+	assert.Equal(t, cnierr.ErrFeatureUnavailable, cnierr.Code(err))
+	assert.Equal(t, 1, mipm.releaseCalls)
+	assert.NotContains(t, nl.links, "veth-host")
+}
+
+func TestHostVethName(t *testing.T) {
+	a, err := HostVethName("", "abcdef0123456789", "eth0")
+	require.NoError(t, err)
+	assert.Len(t, a, config.MaxIfNameLen)
+	assert.Equal(t, DefaultVethPrefix, a[:len(DefaultVethPrefix)])
+
+	again, err := HostVethName("", "abcdef0123456789", "eth0")
+	require.NoError(t, err)
+	assert.Equal(t, a, again, "name must be deterministic")
+
+	otherIf, err := HostVethName("", "abcdef0123456789", "net1")
+	require.NoError(t, err)
+	assert.NotEqual(t, a, otherIf, "interfaces of one container must not collide")
+
+	samePrefix, err := HostVethName("", "abcdef01zzzzzzzz", "eth0")
+	require.NoError(t, err)
+	assert.NotEqual(t, a, samePrefix, "containers sharing an ID prefix must not collide")
+
+	assert.Len(t, IFBName(a), config.MaxIfNameLen)
+	assert.NotEqual(t, IFBName(a), IFBName(otherIf))
+
+	short, err := HostVethName("eur", "c1", "eth0")
+	require.NoError(t, err)
+	assert.Len(t, short, config.MaxIfNameLen)
+	assert.Equal(t, "eur", short[:3])
+
+	_, err = HostVethName("waytoolongprefix", "c1", "eth0")
+	assert.Error(t, err)
+}
+
+func TestGarbageCollect_OnlyRemovesRecordedVeths(t *testing.T) {
+	nl := newMockNetLink()
+	for i, name := range []string{"veth-orphan", "veth-live", "veth-docker"} {
+		nl.links[name] = &mockLink{attrs: netlink.LinkAttrs{Name: name, Index: i + 1}}
+	}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{allocations: []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "gone", IfName: "eth0", HostVeth: "veth-orphan"},
+		{IP: "10.0.0.3", ContainerID: "live", IfName: "eth0", HostVeth: "veth-live"},
+	}}
+
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+	err := n.GarbageCollect(makeNetConf(t, ""), map[string]bool{"live": true})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"veth-orphan"}, nl.linkDelCalls)
+}
+
+func TestGarbageCollect_RemovesOrphanedState(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["cni0"] = &mockLink{attrs: netlink.LinkAttrs{Name: "cni0", Index: 10}}
+	nl.links["veth-live"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-live", Index: 11, MasterIndex: 10}}
+	nl.neighs = []netlink.Neigh{
+		{IP: net.ParseIP("10.0.0.2"), State: netlink.NUD_STALE},
+		{IP: net.ParseIP("10.0.0.3"), State: netlink.NUD_REACHABLE},
+		{IP: net.ParseIP("10.0.0.9"), State: netlink.NUD_PERMANENT},
+		{IP: net.ParseIP("192.168.1.1"), State: netlink.NUD_STALE},
+	}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{allocations: []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "gone", IfName: "eth0", HostVeth: "veth-orphan"},
+		{IP: "10.0.0.3", ContainerID: "live", IfName: "eth0", HostVeth: "veth-live"},
+	}}
+	fw := &mockFirewall{owners: []firewall.Owner{
+		{Network: "net1", ContainerID: "gone"},
+		{Network: "net1", ContainerID: "live"},
+		{Network: "other", ContainerID: "gone"},
+	}}
+	sc := &mockSpoofChecker{owners: []firewall.Owner{
+		{Network: "net1", ContainerID: "gone"},
+		{Network: "net1", ContainerID: "live"},
+	}}
+	e := &mockEnforcer{hostVeths: []string{"veth-orphan", "veth-live"}}
+
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+	n.newSpoof = func() (firewall.SpoofChecker, error) { return sc, nil }
+	n.newEnforcer = func() (policyEnforcer, error) { return e, nil }
+
+	conf := makeNetConf(t, "cni0")
+	conf.Name = "net1"
+	conf.SpoofCheck = true
+	conf.Policy = &config.PolicyConfig{}
+
+	err := n.GarbageCollect(conf, map[string]bool{"live": true})
+
+	require.NoError(t, err)
+	assert.Equal(t, []firewall.Owner{{Network: "net1", ContainerID: "gone"}}, fw.deleted)
+	assert.Equal(t, []firewall.Owner{{Network: "net1", ContainerID: "gone"}}, sc.deleted)
+	assert.Equal(t, []string{"veth-orphan"}, e.removed)
+	assert.Equal(t, []string{"10.0.0.2"}, nl.neighDelCalls,
+		"only learned entries of freed pod addresses are flushed")
+	assert.Contains(t, nl.links, "cni0", "a bridge with ports is kept")
+}
+
+func TestGarbageCollect_SkipsLinksOwnedByOthers(t *testing.T) {
+	nl := newMockNetLink()
+	mine := LinkAlias(firewall.Owner{Network: "net1", ContainerID: "gone1"})
+	nl.links["veth-mine"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-mine", Index: 1, Alias: mine}}
+	nl.links["veth-legacy"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-legacy", Index: 2}}
+	nl.links["veth-foreign"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-foreign", Index: 3, Alias: "docker0 port"}}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{allocations: []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "gone1", HostVeth: "veth-mine"},
+		{IP: "10.0.0.3", ContainerID: "gone2", HostVeth: "veth-legacy"},
+		{IP: "10.0.0.4", ContainerID: "gone3", HostVeth: "veth-foreign"},
+	}}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+	conf := makeNetConf(t, "")
+	conf.Name = "net1"
+	require.NoError(t, n.GarbageCollect(conf, map[string]bool{}))
+
+	assert.ElementsMatch(t, []string{"veth-mine", "veth-legacy"}, nl.linkDelCalls)
+	assert.Contains(t, nl.links, "veth-foreign")
+	assert.Empty(t, mipm.allocations, "addresses are freed even when the link is not ours")
+}
+
+func TestGarbageCollect_DryRun(t *testing.T) {
+	nl := newMockNetLink()
+	nl.links["cni0"] = &mockLink{attrs: netlink.LinkAttrs{Name: "cni0", Index: 10}}
+	nl.links["veth-orphan"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-orphan", Index: 11, MasterIndex: 10}}
+	nl.neighs = []netlink.Neigh{{IP: net.ParseIP("10.0.0.2"), State: netlink.NUD_STALE}}
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	mipm := &mockIPAM{allocations: []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "gone", HostVeth: "veth-orphan"},
+	}}
+	fw := &mockFirewall{owners: []firewall.Owner{{Network: "net1", ContainerID: "gone"}}}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.newFirewall = func(_ string) (firewall.Firewall, error) { return fw, nil }
+
+	conf := makeNetConf(t, "cni0")
+	conf.Name = "net1"
+	conf.DeleteBridgeWhenEmpty = true
+	conf.GC = &config.GCConfig{DryRun: true}
+	require.NoError(t, n.GarbageCollect(conf, map[string]bool{}))
+
+	assert.Empty(t, nl.linkDelCalls)
+	assert.Empty(t, nl.neighDelCalls)
+	assert.Empty(t, fw.deleted)
+	assert.Empty(t, fw.bridgeTeardowns)
+	assert.Len(t, mipm.allocations, 1)
+}
+
+func TestTeardownNetwork_DeleteBridgeWhenEmpty(t *testing.T) {
+	tests := []struct {
+		name       string
+		optIn      bool
+		otherPort  bool
+		wantBridge bool
+	}{
+		{name: "kept by default", optIn: false, wantBridge: true},
+		{name: "deleted when opted in and empty", optIn: true, wantBridge: false},
+		{name: "kept while other ports remain", optIn: true, otherPort: true, wantBridge: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nl.links["cni0"] = &mockLink{attrs: netlink.LinkAttrs{Name: "cni0", Index: 10}}
+			nl.links["veth-host"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-host", Index: 11, MasterIndex: 10}}
+			if tc.otherPort {
+				nl.links["veth-other"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-other", Index: 12, MasterIndex: 10}}
+			}
+			nsw := &mockNSWrapper{netns: &mockNetNS{}}
+			mipm := &mockIPAM{}
+			n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+			conf := makeNetConf(t, "cni0")
+			conf.DeleteBridgeWhenEmpty = tc.optIn
+
+			require.NoError(t, n.TeardownNetwork("veth-host", "ctr1", "eth0", conf))
+
+			_, exists := nl.links["cni0"]
+			assert.Equal(t, tc.wantBridge, exists)
+			assert.Equal(t, 1, mipm.lockCalls, "bridge check must run under the IPAM lock")
+		})
+	}
+}
+
 func TestCheckNetwork_ErrorWhenHostVethMissing(t *testing.T) {
 	nl := newMockNetLink() // empty — "veth-host" does not exist
 	nsw := &mockNSWrapper{netns: &mockNetNS{}}
 
 	n := newTestNetwork(nl, nsw, nil) // IPAM not used by CheckNetwork
 
-	err := n.CheckNetwork("/proc/1/ns/net", "veth-host", "eth0", nil)
+	err := n.CheckNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", nil, makeNetConf(t, ""))
 
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "veth-host")
 }
+
+func TestSetupNetwork_Sysctls(t *testing.T) {
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	newNetwork := func(set map[string]string) *Network {
+		n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface {
+			return &mockIPAM{bindResult: wantAddr}
+		})
+		n.sysctl = func(name string, params ...string) (string, error) {
+			set[name] = params[0]
+			return params[0], nil
+		}
+		return n
+	}
+
+	t.Run("applies pod and host sysctls", func(t *testing.T) {
+		set := map[string]string{}
+		conf := makeNetConf(t, "cni0")
+		conf.Sysctl = map[string]string{
+			"net.core.somaxconn":                  "1024",
+			"net.ipv4.ip_local_port_range":        "20000 30000",
+			"net.ipv6.conf.eth0.accept_ra":        "0",
+			"net.ipv6.conf.all.disable_ipv6":      "1",
+			"net.ipv4.ip_unprivileged_port_start": "80",
+		}
+		conf.HostSysctl = map[string]string{"proxy_arp": "1", "accept_ra": "0"}
+
+		_, _, err := newNetwork(set).SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"net.core.somaxconn":                  "1024",
+			"net.ipv4.ip_local_port_range":        "20000 30000",
+			"net.ipv6.conf.eth0.accept_ra":        "0",
+			"net.ipv6.conf.all.disable_ipv6":      "1",
+			"net.ipv4.ip_unprivileged_port_start": "80",
+			"net.ipv4.conf.veth-host.proxy_arp":   "1",
+			"net.ipv6.conf.veth-host.accept_ra":   "0",
+		}, set)
+	})
+
+	for _, tc := range []struct {
+		name string
+		pod  map[string]string
+		host map[string]string
+	}{
+		{"host-wide pod key", map[string]string{"net.ipv4.ip_forward": "1"}, nil},
+		{"wildcard depth", map[string]string{"net.ipv6.conf.eth0.extra.accept_ra": "0"}, nil},
+		{"unknown host key", nil, map[string]string{"forwarding": "1"}},
+	} {
+		t.Run("rejects "+tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			set := map[string]string{}
+			n := newNetwork(set)
+			n.netlink = nl
+			conf := makeNetConf(t, "cni0")
+			conf.Sysctl, conf.HostSysctl = tc.pod, tc.host
+
+			_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+			require.ErrorContains(t, err, "is not allowed")
+			assert.Empty(t, set)
+			assert.Empty(t, nl.links, "nothing may be created before validation")
+		})
+	}
+}
+
+func TestSetupNetwork_TracesSteps(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface {
+		return &mockIPAM{bindResult: wantAddr}
+	})
+	ctx, root := tracing.Start(context.Background(), "cni.add")
+	n.WithContext(ctx)
+
+	_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", makeNetConf(t, "cni0"))
+	require.NoError(t, err)
+	root.End()
+
+	parents := make(map[string]string)
+	ids := make(map[string]string)
+	for _, s := range rec.Ended() {
+		ids[s.SpanContext().SpanID().String()] = s.Name()
+	}
+	for _, s := range rec.Ended() {
+		parents[s.Name()] = ids[s.Parent().SpanID().String()]
+	}
+	assert.Equal(t, "cni.add", parents["veth.create"])
+	assert.Equal(t, "cni.add", parents["bridge.attach"])
+	assert.Equal(t, "cni.add", parents["netns.configure"])
+	assert.Equal(t, "netns.configure", parents["ipam.bind_addr"])
+	assert.Equal(t, ctx, n.ctx, "the command context is restored after each step")
+}
+
+func TestErrorCodes(t *testing.T) {
+	wantAddr, _ := netlink.ParseAddr("10.0.0.2/24")
+	tests := []struct {
+		name     string
+		setup    func(n *Network, nsw *mockNSWrapper, mipm *mockIPAM, conf *config.NetConf)
+		wantCode uint
+	}{
+		{
+			name: "invalid MAC",
+			setup: func(_ *Network, _ *mockNSWrapper, _ *mockIPAM, conf *config.NetConf) {
+				conf.RuntimeConfig.Mac = "not-a-mac"
+			},
+			wantCode: types.ErrInvalidNetworkConfig,
+		},
+		{
+			name: "invalid port mapping",
+			setup: func(_ *Network, _ *mockNSWrapper, _ *mockIPAM, conf *config.NetConf) {
+				conf.RuntimeConfig.PortMappings = []config.PortMapping{{HostPort: 0, ContainerPort: 80}}
+			},
+			wantCode: types.ErrInvalidNetworkConfig,
+		},
+		{
+			name: "netns gone",
+			setup: func(_ *Network, nsw *mockNSWrapper, _ *mockIPAM, _ *config.NetConf) {
+				nsw.getNSErr = ns.NSPathNotExistErr{}
+			},
+			wantCode: types.ErrInvalidNetNS,
+		},
+		{
+			name: "pool exhausted",
+			setup: func(_ *Network, _ *mockNSWrapper, mipm *mockIPAM, _ *config.NetConf) {
+				mipm.bindErr = cnierr.Errorf(cnierr.ErrPoolExhausted, "no available IP addresses in range")
+			},
+			wantCode: cnierr.ErrPoolExhausted,
+		},
+		{
+			name: "host port conflict",
+			setup: func(n *Network, _ *mockNSWrapper, _ *mockIPAM, conf *config.NetConf) {
+				fw := &mockFirewall{portMappingErr: cnierr.Errorf(cnierr.ErrPortConflict, "host port tcp/8080 is already mapped")}
+				n.newFirewall = func(string) (firewall.Firewall, error) { return fw, nil }
+				conf.RuntimeConfig.PortMappings = []config.PortMapping{{HostPort: 8080, ContainerPort: 80}}
+			},
+			wantCode: cnierr.ErrPortConflict,
+		},
+		{
+			name: "forward rules cannot take effect",
+			setup: func(n *Network, _ *mockNSWrapper, _ *mockIPAM, _ *config.NetConf) {
+				fw := &mockFirewall{forwardErr: cnierr.Errorf(cnierr.ErrFeatureUnavailable, "the iptables FORWARD policy is DROP")}
+				n.newFirewall = func(string) (firewall.Firewall, error) { return fw, nil }
+			},
+			wantCode: cnierr.ErrFeatureUnavailable,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nsw := &mockNSWrapper{netns: &mockNetNS{}}
+			mipm := &mockIPAM{bindResult: wantAddr}
+			n := newTestNetwork(newMockNetLink(), nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+			conf := makeNetConf(t, "cni0")
+			tc.setup(n, nsw, mipm, conf)
+
+			_, _, err := n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantCode, cnierr.Code(err))
+		})
+	}
+
+	t.Run("status", func(t *testing.T) {
+		mipm := &mockIPAM{statusErr: cnierr.Errorf(cnierr.ErrPoolExhausted, "no available IP addresses in configured range")}
+		n := newTestNetwork(newMockNetLink(), &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+		err := n.CheckPluginStatus(makeNetConf(t, ""))
+		assert.Equal(t, cnierr.ErrPluginNotAvailable, cnierr.Code(err))
+
+		mipm.statusErr = nil
+		assert.NoError(t, n.CheckPluginStatus(makeNetConf(t, "")))
+	})
+}
+
+func TestCheckPluginStatus(t *testing.T) {
+	gateway, err := netlink.ParseAddr("10.0.0.1/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		setup    func(n *Network, nl *mockNetLink, mipm *mockIPAM, sysctls map[string]string)
+		wantCode uint
+		wantMsgs []string
+	}{
+		{name: "ready", setup: func(*Network, *mockNetLink, *mockIPAM, map[string]string) {}},
+		{
+			name: "bridge not created yet",
+			setup: func(_ *Network, nl *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				delete(nl.links, "cni0")
+				delete(nl.links, "veth-pod")
+			},
+		},
+		{
+			name: "empty bridge is repaired by the next ADD",
+			setup: func(_ *Network, nl *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				delete(nl.links, "veth-pod")
+				nl.links["cni0"].attrs.Flags = 0
+				delete(nl.addrs, "cni0")
+			},
+		},
+		{
+			name: "name taken by another link",
+			setup: func(_ *Network, nl *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				nl.links["cni0"].linkType = "dummy"
+			},
+			wantCode: cnierr.ErrPluginNotAvailable,
+			wantMsgs: []string{"cni0 exists and is a dummy, not a bridge"},
+		},
+		{
+			name: "bridge with pods down",
+			setup: func(_ *Network, nl *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				nl.links["cni0"].attrs.Flags = 0
+			},
+			wantCode: cnierr.ErrLimitedConnectivity,
+			wantMsgs: []string{"bridge cni0 is down"},
+		},
+		{
+			name: "bridge with pods lacks gateway",
+			setup: func(_ *Network, nl *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				delete(nl.addrs, "cni0")
+			},
+			wantCode: cnierr.ErrLimitedConnectivity,
+			wantMsgs: []string{"bridge cni0 lacks gateway address 10.0.0.1"},
+		},
+		{
+			name: "forwarding disabled",
+			setup: func(_ *Network, _ *mockNetLink, _ *mockIPAM, sysctls map[string]string) {
+				sysctls["net.ipv4.ip_forward"] = "0"
+			},
+			wantCode: cnierr.ErrLimitedConnectivity,
+			wantMsgs: []string{"IP forwarding is disabled (net.ipv4.ip_forward)"},
+		},
+		{
+			name: "firewall unusable",
+			setup: func(n *Network, _ *mockNetLink, _ *mockIPAM, _ map[string]string) {
+				n.newFirewall = func(string) (firewall.Firewall, error) { return nil, errors.New("no iptables or nft") }
+			},
+			wantCode: cnierr.ErrLimitedConnectivity,
+			wantMsgs: []string{"firewall backend not usable: no iptables or nft"},
+		},
+		{
+			name: "IPAM failure outranks connectivity",
+			setup: func(_ *Network, _ *mockNetLink, mipm *mockIPAM, sysctls map[string]string) {
+				mipm.statusErr = cnierr.Errorf(types.ErrTryAgainLater, "lock not acquired within 5s")
+				sysctls["net.ipv4.ip_forward"] = "0"
+			},
+			wantCode: cnierr.ErrPluginNotAvailable,
+			wantMsgs: []string{"lock not acquired within 5s", "IP forwarding is disabled"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nl.links["cni0"] = &mockLink{attrs: netlink.LinkAttrs{Name: "cni0", Index: 10, Flags: net.FlagUp}, linkType: "bridge"}
+			nl.links["veth-pod"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-pod", Index: 11, MasterIndex: 10}}
+			nl.addrs["cni0"] = []netlink.Addr{*gateway}
+			mipm := &mockIPAM{}
+			n := newTestNetwork(nl, &mockNSWrapper{netns: &mockNetNS{}}, func(_ *config.IPAMConfig) ipamIface { return mipm })
+			n.newFirewall = func(string) (firewall.Firewall, error) { return &mockFirewall{}, nil }
+			sysctls := map[string]string{"net.ipv4.ip_forward": "1\n"}
+			n.sysctl = func(name string, _ ...string) (string, error) { return sysctls[name], nil }
+			tc.setup(n, nl, mipm, sysctls)
+
+			err := n.CheckPluginStatus(makeNetConf(t, "cni0"))
+
+			if tc.wantCode == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tc.wantCode, cnierr.Code(err))
+			for _, msg := range tc.wantMsgs {
+				assert.ErrorContains(t, err, msg)
+			}
+		})
+	}
+}
+
+func TestCheckPluginStatus_AfterAdd(t *testing.T) {
+	nl := newMockNetLink()
+	nsw := &mockNSWrapper{netns: &mockNetNS{}}
+	addr, err := netlink.ParseAddr("10.0.0.2/24")
+	require.NoError(t, err)
+	mipm := &mockIPAM{bindResult: addr}
+	n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+	n.sysctl = func(string, ...string) (string, error) { return "1", nil }
+	conf := makeNetConf(t, "cni0")
+
+	require.NoError(t, n.CheckPluginStatus(conf), "a fresh node is ready")
+
+	_, _, err = n.SetupNetwork("/proc/1/ns/net", "veth-host", "eth0", "ctr1", conf)
+	require.NoError(t, err)
+
+	assert.Equal(t, "10.0.0.1/24", nl.addrs["cni0"][0].IPNet.String(), "ADD addresses the bridge it creates")
+	assert.NoError(t, n.CheckPluginStatus(conf), "the bridge as ADD leaves it is ready")
+
+	_, _, err = n.SetupNetwork("/proc/1/ns/net", "veth-host2", "eth0", "ctr2", conf)
+	require.NoError(t, err)
+	assert.Len(t, nl.addrs["cni0"], 1, "the gateway is added once")
+}
+
+func TestReconcile(t *testing.T) {
+	allocs := []ipam.Allocation{
+		{IP: "10.0.0.2", ContainerID: "veth-up", HostVeth: "veth-live", Netns: "/var/run/netns/a"},
+		{IP: "10.0.0.3", ContainerID: "both-gone", HostVeth: "veth-gone", Netns: "/var/run/netns/b"},
+		{IP: "10.0.0.4", ContainerID: "legacy", HostVeth: "veth-gone2"},
+		{IP: "10.0.0.5", ContainerID: "unnamed"},
+	}
+	tests := []struct {
+		name     string
+		getNSErr error
+		want     []string
+	}{
+		{name: "netns gone", getNSErr: ns.NSPathNotExistErr{}, want: []string{"both-gone", "legacy"}},
+		{name: "netns no longer a netns", getNSErr: ns.NSPathNotNSErr{}, want: []string{"both-gone", "legacy"}},
+		{name: "netns still there", want: []string{"legacy"}},
+		{name: "netns lookup fails", getNSErr: errors.New("permission denied"), want: []string{"legacy"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := newMockNetLink()
+			nl.links["veth-live"] = &mockLink{attrs: netlink.LinkAttrs{Name: "veth-live"}}
+			mipm := &mockIPAM{allocations: allocs}
+			nsw := &mockNSWrapper{netns: &mockNetNS{}, getNSErr: tc.getNSErr}
+			n := newTestNetwork(nl, nsw, func(_ *config.IPAMConfig) ipamIface { return mipm })
+
+			orphans, err := n.Reconcile(makeIPAMConfig(t), false)
+
+			require.NoError(t, err)
+			var got []string
+			for _, a := range orphans {
+				got = append(got, a.ContainerID)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
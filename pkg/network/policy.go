@@ -0,0 +1,118 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/logging"
+	"github.com/innfi/probable-eureka/pkg/policy"
+)
+
+// policyEnforcer installs compiled network policies on the host.
+type policyEnforcer interface {
+	Apply(plan *policy.Plan) error
+	Remove(hostVeth string) error
+	// HostVeths lists the host veths that have policy state installed.
+	HostVeths() ([]string, error)
+}
+
+// selectPolicies returns the policies that apply to the pod: those of the
+// policy file selecting its labels, plus its inline policy. It returns
+// nothing unless the policy block is configured.
+func selectPolicies(conf *config.NetConf) ([]policy.Policy, error) {
+	if conf.Policy == nil {
+		return nil, nil
+	}
+	var policies []policy.Policy
+	if conf.Policy.File != "" {
+		f, err := policy.Load(conf.Policy.File)
+		if err != nil {
+			return nil, err
+		}
+		policies = f.Select(conf.PodLabels)
+	}
+	if conf.PodPolicy != "" {
+		p, err := policy.ParseInline(conf.PodPolicy)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// applyPolicy compiles the pod's policies and installs them, or only logs
+// the generated rules in dry-run mode.
+func (n *Network) applyPolicy(im ipamIface, conf *config.NetConf, hostVeth string, podIP net.IP, policies []policy.Policy) error {
+	plan, err := policy.Compile(policy.Pod{HostVeth: hostVeth, IP: podIP}, policies)
+	if err != nil {
+		return err
+	}
+
+	if conf.Policy.DryRun {
+		for _, line := range plan.Lines() {
+			logging.Logger.Info("policy_dry_run", "host_veth", hostVeth, "rule", line)
+		}
+		return nil
+	}
+
+	if n.newEnforcer == nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "network policy requires iptables and ipset")
+	}
+	e, err := n.newEnforcer()
+	if err != nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "network policy requires iptables and ipset: %w", err)
+	}
+	if conf.Bridge != "" {
+		if err := n.checkBridgeNetfilter(podIP); err != nil {
+			return err
+		}
+	}
+
+	// The dispatch chain is shared, so hooking it in is serialized with other ADDs.
+	unlock, err := im.Lock()
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer unlock()
+
+	if err := e.Apply(plan); err != nil {
+		return fmt.Errorf("failed to apply network policy: %w", err)
+	}
+	return nil
+}
+
+// checkBridgeNetfilter fails unless bridged traffic of podIP's family goes
+// through iptables. Without it, pods on the bridge reach each other past
+// every policy, which is worse than failing the ADD.
+func (n *Network) checkBridgeNetfilter(podIP net.IP) error {
+	if n.sysctl == nil {
+		return nil
+	}
+	key := policy.BridgeNetfilterSysctl(podIP)
+	value, err := n.sysctl(key)
+	if err != nil {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "network policy requires the br_netfilter module: %w", err)
+	}
+	if strings.TrimSpace(value) != "1" {
+		return cnierr.Errorf(cnierr.ErrFeatureUnavailable, "network policy requires %s=1", key)
+	}
+	return nil
+}
+
+// removePolicy deletes the pod's policy state. The pod's labels may be gone
+// by DEL, so everything created for hostVeth is removed regardless.
+func (n *Network) removePolicy(hostVeth string, conf *config.NetConf) error {
+	if conf.Policy == nil || conf.Policy.DryRun || n.newEnforcer == nil {
+		return nil
+	}
+	e, err := n.newEnforcer()
+	if err != nil {
+		logging.Logger.Error("policy_unavailable", "error", err.Error())
+		return nil
+	}
+	return e.Remove(hostVeth)
+}
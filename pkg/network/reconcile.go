@@ -0,0 +1,72 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/ipam"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Reconcile frees the allocations whose pod is gone from the node: both its
+// host veth and its netns have disappeared. Unlike GarbageCollect it needs
+// no attachment list from the runtime, so it also covers runtimes that
+// never send GC. With dryRun the orphans are only reported.
+func (n *Network) Reconcile(ipamConfig *config.IPAMConfig, dryRun bool) ([]ipam.Allocation, error) {
+	im := n.newIPAM(ipamConfig)
+
+	var orphans []ipam.Allocation
+	err := n.span("ipam.reconcile", func() error {
+		var err error
+		orphans, err = im.ReleaseOrphans(n.attachmentGone, dryRun)
+		return err
+	}, attribute.Bool("dry_run", dryRun))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile allocations: %w", err)
+	}
+
+	event := "reconcile_released_ip"
+	if dryRun {
+		event = "reconcile_orphan_found"
+	}
+	for _, alloc := range orphans {
+		logging.Logger.Info(event,
+			"ip", alloc.IP,
+			"container_id", alloc.ContainerID,
+			"host_veth", alloc.HostVeth,
+			"netns", alloc.Netns,
+		)
+	}
+	return orphans, nil
+}
+
+// attachmentGone reports whether the pod of alloc no longer exists. Records
+// that do not name their host veth cannot be judged and are kept; records
+// written before the netns was tracked are judged by the veth alone, which
+// the kernel removes together with the netns. Any lookup error other than
+// "not found" keeps the record.
+func (n *Network) attachmentGone(alloc ipam.Allocation) bool {
+	if alloc.HostVeth == "" {
+		return false
+	}
+	if _, err := n.netlink.LinkByName(alloc.HostVeth); !isLinkNotFound(err) {
+		return false
+	}
+	if alloc.Netns == "" {
+		return true
+	}
+
+	netns, err := n.ns.GetNS(alloc.Netns)
+	if err == nil {
+		netns.Close()
+		return false
+	}
+	// A leftover bind-mount target that is no longer a netns counts as gone.
+	var notExist ns.NSPathNotExistErr
+	var notNS ns.NSPathNotNSErr
+	return errors.As(err, &notExist) || errors.As(err, &notNS)
+}
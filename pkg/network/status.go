@@ -0,0 +1,143 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/innfi/probable-eureka/pkg/cnierr"
+	"github.com/innfi/probable-eureka/pkg/config"
+)
+
+// StatusLockTimeout bounds how long STATUS waits for the IPAM lock. A lock
+// held longer than this would stall ADDs as well.
+const StatusLockTimeout = 5 * time.Second
+
+// CheckPluginStatus reports whether the node is ready for pods. Failures that
+// make ADD fail carry the STATUS code for "plugin not available"; failures
+// that let ADD succeed but leave pods without full connectivity carry
+// "limited connectivity". Every check runs, and the error lists each
+// failure, under the code of the worst.
+func (n *Network) CheckPluginStatus(conf *config.NetConf) error {
+	var unavailable, limited []string
+
+	if err := n.span("ipam.check_status", func() error {
+		return n.newIPAM(conf.IPAM).CheckStatus(StatusLockTimeout)
+	}); err != nil {
+		unavailable = append(unavailable, err.Error())
+	}
+	n.span("bridge.check_status", func() error {
+		notReady, degraded := n.checkBridgeStatus(conf)
+		if notReady != nil {
+			unavailable = append(unavailable, notReady.Error())
+		}
+		if degraded != nil {
+			limited = append(limited, degraded.Error())
+		}
+		return errors.Join(notReady, degraded)
+	})
+	if err := n.span("sysctl.check_forwarding", func() error { return n.checkForwarding(conf.IPAM) }); err != nil {
+		limited = append(limited, err.Error())
+	}
+	if n.newFirewall != nil {
+		if err := n.span("firewall.check_status", func() error {
+			_, err := n.newFirewall(conf.FirewallBackend)
+			return err
+		}); err != nil {
+			limited = append(limited, fmt.Sprintf("firewall backend not usable: %v", err))
+		}
+	}
+
+	if len(unavailable) > 0 {
+		return cnierr.Errorf(cnierr.ErrPluginNotAvailable, "%s", strings.Join(append(unavailable, limited...), "; "))
+	}
+	if len(limited) > 0 {
+		return cnierr.Errorf(cnierr.ErrLimitedConnectivity, "%s", strings.Join(limited, "; "))
+	}
+	return nil
+}
+
+// checkBridgeStatus checks the bridge against what ADD sets up. A missing
+// bridge is fine: the first ADD creates it, up and with its gateway
+// addresses. A link of that name that is no bridge makes every ADD fail. A
+// bridge that is down or lacks a gateway is repaired by the next ADD, so it
+// only matters while pods are attached to it.
+func (n *Network) checkBridgeStatus(conf *config.NetConf) (unavailable, limited error) {
+	if conf.Bridge == "" {
+		return nil, nil
+	}
+	br, err := n.netlink.LinkByName(conf.Bridge)
+	if err != nil {
+		if isLinkNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to look up bridge %s: %w", conf.Bridge, err)
+	}
+	if br.Type() != "bridge" {
+		return fmt.Errorf("%s exists and is a %s, not a bridge", conf.Bridge, br.Type()), nil
+	}
+
+	hasPorts, err := n.bridgeHasPorts(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports of bridge %s: %w", conf.Bridge, err)
+	}
+	if !hasPorts {
+		return nil, nil
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("bridge %s is down", conf.Bridge)
+	}
+	missing, err := n.missingGateways(br, conf.IPAM)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		var ips []string
+		for _, gw := range missing {
+			ips = append(ips, gw.IP.String())
+		}
+		return nil, fmt.Errorf("bridge %s lacks gateway address %s", conf.Bridge, strings.Join(ips, ", "))
+	}
+	return nil, nil
+}
+
+// checkForwarding verifies that the host forwards the address families of
+// the ranges; without it pods reach nothing beyond the node.
+func (n *Network) checkForwarding(ipamConfig *config.IPAMConfig) error {
+	if n.sysctl == nil || ipamConfig == nil {
+		return nil
+	}
+	var v4, v6 bool
+	for _, set := range ipamConfig.Ranges {
+		for _, r := range set {
+			if _, subnet, err := net.ParseCIDR(r.Subnet); err == nil {
+				v4 = v4 || subnet.IP.To4() != nil
+				v6 = v6 || subnet.IP.To4() == nil
+			}
+		}
+	}
+	var keys []string
+	if v4 {
+		keys = append(keys, "net.ipv4.ip_forward")
+	}
+	if v6 {
+		keys = append(keys, "net.ipv6.conf.all.forwarding")
+	}
+
+	var off []string
+	for _, key := range keys {
+		value, err := n.sysctl(key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if strings.TrimSpace(value) != "1" {
+			off = append(off, key)
+		}
+	}
+	if len(off) > 0 {
+		return fmt.Errorf("IP forwarding is disabled (%s)", strings.Join(off, ", "))
+	}
+	return nil
+}
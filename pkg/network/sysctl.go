@@ -0,0 +1,57 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/innfi/probable-eureka/pkg/config"
+	"github.com/innfi/probable-eureka/pkg/logging"
+)
+
+// validateSysctls rejects keys outside the allow-lists before anything is created.
+func validateSysctls(conf *config.NetConf) error {
+	for _, key := range sortedKeys(conf.Sysctl) {
+		if err := config.CheckSysctl(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedKeys(conf.HostSysctl) {
+		if err := config.CheckHostSysctl(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPodSysctls sets the sysctl map; it must run inside the pod netns.
+func (n *Network) applyPodSysctls(values map[string]string) error {
+	for _, key := range sortedKeys(values) {
+		if _, err := n.sysctl(key, values[key]); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %w", key, err)
+		}
+		logging.Logger.Info("sysctl_set", "key", key, "value", values[key])
+	}
+	return nil
+}
+
+// applyHostSysctls sets the hostSysctl map on the host veth.
+func (n *Network) applyHostSysctls(hostVeth string, values map[string]string) error {
+	for _, key := range sortedKeys(values) {
+		name := fmt.Sprintf(config.HostVethSysctls[key], hostVeth)
+		if _, err := n.sysctl(name, values[key]); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %w", name, err)
+		}
+		logging.Logger.Info("sysctl_set", "key", name, "value", values[key])
+	}
+	return nil
+}
+
+// sortedKeys makes the order sysctls are written in deterministic.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
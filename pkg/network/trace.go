@@ -0,0 +1,42 @@
+package network
+
+import (
+	"context"
+
+	"github.com/innfi/probable-eureka/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// WithContext sets the context the steps of the next command are traced
+// under, normally the command's own span.
+func (n *Network) WithContext(ctx context.Context) *Network {
+	n.ctx = ctx
+	return n
+}
+
+// span runs one step of a command in a child span. Steps nested in fn become
+// children of this span; a Network runs one command at a time, so the
+// current span can live on the Network rather than be passed around.
+func (n *Network) span(name string, fn func() error, attrs ...attribute.KeyValue) error {
+	parent := n.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, sp := tracing.Start(parent, name, attrs...)
+	n.ctx = ctx
+	err := fn()
+	n.ctx = parent
+	tracing.End(sp, err)
+	return err
+}
+
+// lockSpan times a wait for the IPAM flock; see ipam.IPAM.ObserveLock.
+func (n *Network) lockSpan() func() {
+	parent := n.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	_, sp := tracing.Start(parent, "ipam.lock_wait")
+	return func() { sp.End() }
+}
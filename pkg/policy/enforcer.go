@@ -0,0 +1,263 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/ipsetwrapper"
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper"
+	"github.com/innfi/probable-eureka/pkg/logging"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+)
+
+// acceptChain is the firewall package's chain that accepts all bridged
+// traffic; the dispatch chain must be consulted before it.
+const acceptChain = "EUREKA-FORWARD"
+
+// Enforcer installs and removes compiled plans.
+type Enforcer struct {
+	ipt4  iptableswrapper.IPTablesIface
+	ipt6  iptableswrapper.IPTablesIface
+	ipset ipsetwrapper.IPSetIface
+}
+
+// NewEnforcer returns an Enforcer over the given handles. ipt6 may be nil
+// when ip6tables is unavailable.
+func NewEnforcer(ipt4, ipt6 iptableswrapper.IPTablesIface, ipset ipsetwrapper.IPSetIface) *Enforcer {
+	return &Enforcer{ipt4: ipt4, ipt6: ipt6, ipset: ipset}
+}
+
+// New returns an Enforcer for the host's iptables and ipset binaries.
+func New() (*Enforcer, error) {
+	ipt4, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+	ipt6, err := iptableswrapper.NewIPTables(goiptables.ProtocolIPv6)
+	if err != nil {
+		ipt6 = nil
+	}
+	ipset, err := ipsetwrapper.NewIPSet()
+	if err != nil {
+		return nil, err
+	}
+	return NewEnforcer(ipt4, ipt6, ipset), nil
+}
+
+func (e *Enforcer) handles() []iptableswrapper.IPTablesIface {
+	var out []iptableswrapper.IPTablesIface
+	for _, ipt := range []iptableswrapper.IPTablesIface{e.ipt4, e.ipt6} {
+		if ipt != nil {
+			out = append(out, ipt)
+		}
+	}
+	return out
+}
+
+// Apply installs the plan, replacing whatever the pod had before.
+func (e *Enforcer) Apply(plan *Plan) error {
+	ipt := e.ipt4
+	if plan.Pod.IP.To4() == nil {
+		ipt = e.ipt6
+	}
+	if ipt == nil {
+		return fmt.Errorf("ip6tables is not available for IPv6")
+	}
+
+	if err := e.Remove(plan.Pod.HostVeth); err != nil {
+		return err
+	}
+	if err := ensureDispatch(ipt); err != nil {
+		return err
+	}
+
+	for _, s := range plan.Sets {
+		if err := e.ipset.Create(s.Name, "hash:net", s.Family); err != nil {
+			return err
+		}
+		for _, entry := range s.Entries {
+			if err := e.ipset.Add(s.Name, entry); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range plan.Chains {
+		if err := ipt.NewChain(filterTable, c.Name); err != nil {
+			return fmt.Errorf("failed to create chain %s: %w", c.Name, err)
+		}
+		for _, r := range c.Rules {
+			if err := ipt.Append(filterTable, c.Name, r...); err != nil {
+				return fmt.Errorf("failed to add rule to %s: %w", c.Name, err)
+			}
+		}
+	}
+	// Jumps go last so the pod is never sent to a half-built chain.
+	for _, j := range plan.Jumps {
+		if err := ipt.Append(filterTable, dispatchChain, j...); err != nil {
+			return fmt.Errorf("failed to add policy jump: %w", err)
+		}
+	}
+	logging.Logger.Info("policy_applied",
+		"host_veth", plan.Pod.HostVeth,
+		"chains", len(plan.Chains),
+		"sets", len(plan.Sets),
+	)
+	return nil
+}
+
+// Remove deletes the chains, jumps and sets of the pod behind hostVeth.
+// Missing state is not an error.
+func (e *Enforcer) Remove(hostVeth string) error {
+	var errs []error
+	for _, ipt := range e.handles() {
+		if err := deleteJumps(ipt, jumpComment(hostVeth)); err != nil {
+			errs = append(errs, err)
+		}
+		for _, chain := range []string{ingressPrefix + hostVeth, egressPrefix + hostVeth} {
+			exists, err := ipt.ChainExists(filterTable, chain)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !exists {
+				continue
+			}
+			if err := ipt.ClearAndDeleteChain(filterTable, chain); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete chain %s: %w", chain, err))
+			}
+		}
+	}
+
+	// Sets can only be destroyed once no rule references them.
+	if len(errs) == 0 {
+		names, err := e.ipset.ListNames()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, setNamePrefix(hostVeth)) {
+				continue
+			}
+			if err := e.ipset.Destroy(name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HostVeths lists the host veths of the pods that have policy state
+// installed, from their chains and sets, so GC can find the state of pods
+// that are gone.
+func (e *Enforcer) HostVeths() ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(veth string) {
+		if veth != "" && !seen[veth] {
+			seen[veth] = true
+			out = append(out, veth)
+		}
+	}
+
+	for _, ipt := range e.handles() {
+		chains, err := ipt.ListChains(filterTable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chains: %w", err)
+		}
+		for _, chain := range chains {
+			if veth, ok := strings.CutPrefix(chain, ingressPrefix); ok {
+				add(veth)
+			} else if veth, ok := strings.CutPrefix(chain, egressPrefix); ok {
+				add(veth)
+			}
+		}
+	}
+
+	names, err := e.ipset.ListNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		// Set names are setNamePrefix(hostVeth) plus a suffix without dashes.
+		rest, ok := strings.CutPrefix(name, setPrefix)
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(rest, "-"); i > 0 {
+			add(rest[:i])
+		}
+	}
+	return out, nil
+}
+
+// ensureDispatch creates the dispatch chain and makes FORWARD jump to it
+// ahead of the chain that accepts bridged traffic, moving the jump if the
+// accept chain was hooked in first.
+func ensureDispatch(ipt iptableswrapper.IPTablesIface) error {
+	exists, err := ipt.ChainExists(filterTable, dispatchChain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := ipt.NewChain(filterTable, dispatchChain); err != nil {
+			if exists, _ := ipt.ChainExists(filterTable, dispatchChain); !exists {
+				return fmt.Errorf("failed to create chain %s: %w", dispatchChain, err)
+			}
+		}
+	}
+
+	rules, err := ipt.List(filterTable, forwardChain)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", forwardChain, err)
+	}
+	// The stale jump is deleted by its rulespec rather than its position,
+	// which a concurrent insert at the head of FORWARD would shift.
+	dispatchRule, acceptSeen := "", false
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(rule, "-j "+dispatchChain) && dispatchRule == "":
+			if !acceptSeen {
+				return nil
+			}
+			dispatchRule = rule
+		case strings.HasSuffix(rule, "-j "+acceptChain):
+			acceptSeen = true
+		}
+	}
+	if dispatchRule != "" {
+		if err := iptableswrapper.DeleteRule(ipt, filterTable, dispatchRule); err != nil {
+			return fmt.Errorf("failed to move %s jump: %w", dispatchChain, err)
+		}
+	}
+	jump := []string{"-m", "comment", "--comment", "eureka", "-j", dispatchChain}
+	if err := ipt.Insert(filterTable, forwardChain, 1, jump...); err != nil {
+		return fmt.Errorf("failed to add %s jump: %w", dispatchChain, err)
+	}
+	return nil
+}
+
+// deleteJumps removes the pod's rules from the dispatch chain.
+func deleteJumps(ipt iptableswrapper.IPTablesIface, comment string) error {
+	exists, err := ipt.ChainExists(filterTable, dispatchChain)
+	if err != nil || !exists {
+		return err
+	}
+	rules, err := ipt.List(filterTable, dispatchChain)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", dispatchChain, err)
+	}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "-A ") || !strings.Contains(rule, "--comment "+comment+" ") {
+			continue
+		}
+		if err := iptableswrapper.DeleteRule(ipt, filterTable, rule); err != nil {
+			return fmt.Errorf("failed to delete policy jump: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/innfi/probable-eureka/pkg/ipsetwrapper"
+	"github.com/innfi/probable-eureka/pkg/iptableswrapper/iptablestest"
+	"github.com/innfi/probable-eureka/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	logging.InitStderr()
+	os.Exit(m.Run())
+}
+
+// mockIPSet is an in-memory ipsetwrapper.IPSetIface.
+type mockIPSet struct {
+	sets map[string][]string
+}
+
+func (m *mockIPSet) Create(name, _, _ string) error {
+	if _, ok := m.sets[name]; !ok {
+		m.sets[name] = nil
+	}
+	return nil
+}
+func (m *mockIPSet) Add(name, entry string) error {
+	m.sets[name] = append(m.sets[name], entry)
+	return nil
+}
+func (m *mockIPSet) Flush(name string) error {
+	m.sets[name] = nil
+	return nil
+}
+func (m *mockIPSet) Destroy(name string) error {
+	delete(m.sets, name)
+	return nil
+}
+func (m *mockIPSet) ListNames() ([]string, error) {
+	var out []string
+	for name := range m.sets {
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+var _ ipsetwrapper.IPSetIface = (*mockIPSet)(nil)
+
+func TestEnforcer_ApplyAndRemove(t *testing.T) {
+	ipt := iptablestest.New()
+	ipt.Rules["filter/FORWARD"] = []string{"-m comment --comment eureka -j EUREKA-FORWARD"}
+	ipset := &mockIPSet{sets: map[string][]string{"KUBE-other": {"10.96.0.0/12"}}}
+	e := NewEnforcer(ipt, nil, ipset)
+
+	pod := Pod{HostVeth: "veth0123456789a", IP: net.ParseIP("10.0.0.2")}
+	plan, err := Compile(pod, []Policy{{Ingress: []Rule{{CIDRs: []string{"10.244.0.0/16"}, Ports: []Port{{Port: 80}}}}}})
+	require.NoError(t, err)
+
+	require.NoError(t, e.Apply(plan))
+	// Re-applying replaces the pod's state instead of duplicating it.
+	require.NoError(t, e.Apply(plan))
+
+	assert.Equal(t, []string{
+		"-m comment --comment eureka -j EUREKA-POLICY",
+		"-m comment --comment eureka -j EUREKA-FORWARD",
+	}, ipt.Rules["filter/FORWARD"], "policy must be consulted before the bridge accept rules")
+	assert.Equal(t, []string{
+		"-d 10.0.0.2/32 -m comment --comment policy=veth0123456789a -j EUREKA-PI-veth0123456789a",
+	}, ipt.Rules["filter/EUREKA-POLICY"])
+	assert.Len(t, ipt.Rules["filter/EUREKA-PI-veth0123456789a"], 3)
+	assert.Equal(t, []string{"10.244.0.0/16"}, ipset.sets["eureka-veth0123456789a-i0"])
+
+	veths, err := e.HostVeths()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"veth0123456789a"}, veths)
+
+	require.NoError(t, e.Remove("veth0123456789a"))
+	// Removing twice is fine: DEL must tolerate missing state.
+	require.NoError(t, e.Remove("veth0123456789a"))
+
+	assert.Empty(t, ipt.Rules["filter/EUREKA-POLICY"])
+	assert.False(t, ipt.Chains["filter/EUREKA-PI-veth0123456789a"])
+	assert.Equal(t, map[string][]string{"KUBE-other": {"10.96.0.0/12"}}, ipset.sets)
+	veths, err = e.HostVeths()
+	require.NoError(t, err)
+	assert.Empty(t, veths)
+}
+
+func TestEnforcer_MovesDispatchAheadOfAcceptChain(t *testing.T) {
+	ipt := iptablestest.New()
+	ipt.Chains["filter/EUREKA-POLICY"] = true
+	ipt.Rules["filter/FORWARD"] = []string{
+		"-m comment --comment eureka -j EUREKA-FORWARD",
+		"-m comment --comment eureka -j EUREKA-POLICY",
+	}
+
+	require.NoError(t, ensureDispatch(ipt))
+
+	assert.Equal(t, []string{
+		"-m comment --comment eureka -j EUREKA-POLICY",
+		"-m comment --comment eureka -j EUREKA-FORWARD",
+	}, ipt.Rules["filter/FORWARD"])
+}
+
+func TestEnforcer_IPv6WithoutIP6Tables(t *testing.T) {
+	e := NewEnforcer(iptablestest.New(), nil, &mockIPSet{sets: map[string][]string{}})
+	plan, err := Compile(Pod{HostVeth: "veth0", IP: net.ParseIP("fd00::2")}, []Policy{{Ingress: []Rule{}}})
+	require.NoError(t, err)
+
+	assert.Error(t, e.Apply(plan))
+}
@@ -0,0 +1,328 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/innfi/probable-eureka/pkg/ipsetwrapper"
+)
+
+// File is the policy file referenced by the policy.file config key.
+type File struct {
+	Policies []Policy `json:"policies"`
+}
+
+// Policy allows traffic to and from the pods whose labels match PodSelector.
+// A policy isolates only the directions it lists: a present but empty
+// ingress or egress list denies all new connections in that direction.
+type Policy struct {
+	Name        string            `json:"name"`
+	PodSelector map[string]string `json:"podSelector"`
+	Ingress     []Rule            `json:"ingress,omitempty"`
+	Egress      []Rule            `json:"egress,omitempty"`
+}
+
+// Rule allows traffic from (ingress) or to (egress) the peer CIDRs on the
+// given ports. No CIDRs means any peer and no ports means any port.
+type Rule struct {
+	CIDRs []string `json:"cidrs,omitempty"`
+	Ports []Port   `json:"ports,omitempty"`
+}
+
+// Port is a destination port; the protocol defaults to tcp.
+type Port struct {
+	Protocol string `json:"protocol,omitempty"`
+	Port     int    `json:"port"`
+}
+
+// Load reads and parses a policy file.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	f := &File{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Select returns the policies whose selector matches labels. An empty
+// selector matches every pod.
+func (f *File) Select(labels map[string]string) []Policy {
+	var out []Policy
+	for _, p := range f.Policies {
+		matches := true
+		for k, v := range p.PodSelector {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ParseInline parses the compact policy passed in the POD_POLICY CNI arg:
+// comma-separated rules of the form
+//
+//	in|out:[cidr[+cidr...]][@proto/port[+proto/port...]]
+//
+// for example "in:10.244.0.0/16@tcp/80+tcp/443,out:10.0.0.0/8". CNI_ARGS
+// values cannot contain '=' or ';', hence the custom syntax.
+func ParseInline(s string) (Policy, error) {
+	p := Policy{Name: "inline"}
+	for _, spec := range strings.Split(s, ",") {
+		dir, rest, ok := strings.Cut(spec, ":")
+		if !ok {
+			return Policy{}, fmt.Errorf("invalid inline policy rule %q", spec)
+		}
+		cidrs, ports, _ := strings.Cut(rest, "@")
+
+		var r Rule
+		if cidrs != "" {
+			r.CIDRs = strings.Split(cidrs, "+")
+		}
+		if ports != "" {
+			for _, pp := range strings.Split(ports, "+") {
+				proto, num, ok := strings.Cut(pp, "/")
+				if !ok {
+					return Policy{}, fmt.Errorf("invalid inline policy port %q", pp)
+				}
+				port, err := strconv.Atoi(num)
+				if err != nil {
+					return Policy{}, fmt.Errorf("invalid inline policy port %q", pp)
+				}
+				r.Ports = append(r.Ports, Port{Protocol: proto, Port: port})
+			}
+		}
+
+		switch dir {
+		case "in":
+			p.Ingress = append(p.Ingress, r)
+		case "out":
+			p.Egress = append(p.Egress, r)
+		default:
+			return Policy{}, fmt.Errorf("invalid inline policy direction %q", dir)
+		}
+	}
+	return p, nil
+}
+
+// Pod identifies the attachment a plan is compiled for.
+type Pod struct {
+	HostVeth string
+	IP       net.IP
+}
+
+// Set is an ipset holding the peer CIDRs of one rule.
+type Set struct {
+	Name    string
+	Family  string
+	Entries []string
+}
+
+// Chain is a per-pod filter chain and its rules, in order.
+type Chain struct {
+	Name  string
+	Rules [][]string
+}
+
+// Plan is the ipset and iptables state that enforces the policies of one pod.
+type Plan struct {
+	Pod    Pod
+	Sets   []Set
+	Chains []Chain
+	// Jumps are the rules in the dispatch chain that send the pod's traffic
+	// to its chains.
+	Jumps [][]string
+}
+
+const (
+	filterTable    = "filter"
+	forwardChain   = "FORWARD"
+	dispatchChain  = "EUREKA-POLICY"
+	ingressPrefix  = "EUREKA-PI-"
+	egressPrefix   = "EUREKA-PE-"
+	setPrefix      = "eureka-"
+	ruleCommentKey = "policy="
+)
+
+// setNamePrefix is shared by every set of the pod, so DEL can find them
+// without the policy that created them.
+func setNamePrefix(hostVeth string) string {
+	return setPrefix + hostVeth + "-"
+}
+
+func jumpComment(hostVeth string) string {
+	return ruleCommentKey + hostVeth
+}
+
+// BridgeNetfilterSysctl names the sysctl that must be 1 for bridged traffic
+// of ip's family to traverse filter FORWARD, where a plan's jumps hang. It
+// exists only while the br_netfilter module is loaded.
+func BridgeNetfilterSysctl(ip net.IP) string {
+	if ip.To4() == nil {
+		return "net.bridge.bridge-nf-call-ip6tables"
+	}
+	return "net.bridge.bridge-nf-call-iptables"
+}
+
+// Compile turns the policies selecting a pod into a Plan. Rules whose peers
+// are all of the other address family are dropped, since they cannot match.
+// Traffic between pods on one bridge only reaches the plan's chains when
+// BridgeNetfilterSysctl is on.
+func Compile(pod Pod, policies []Policy) (*Plan, error) {
+	plan := &Plan{Pod: pod}
+	var ingress, egress []Rule
+	var ingressIsolated, egressIsolated bool
+	for _, p := range policies {
+		if p.Ingress != nil {
+			ingressIsolated = true
+			ingress = append(ingress, p.Ingress...)
+		}
+		if p.Egress != nil {
+			egressIsolated = true
+			egress = append(egress, p.Egress...)
+		}
+	}
+
+	podNet := hostNet(pod.IP)
+	directions := []struct {
+		isolated bool
+		rules    []Rule
+		chain    string
+		tag      string
+		peer     string
+		selector string
+	}{
+		{ingressIsolated, ingress, ingressPrefix + pod.HostVeth, "i", "src", "-d"},
+		{egressIsolated, egress, egressPrefix + pod.HostVeth, "e", "dst", "-s"},
+	}
+	for _, d := range directions {
+		if !d.isolated {
+			continue
+		}
+		chain := Chain{Name: d.chain}
+		chain.Rules = append(chain.Rules, []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"})
+		for i, r := range d.rules {
+			match, set, ok, err := peerMatch(pod, r, fmt.Sprintf("%s%s%d", setNamePrefix(pod.HostVeth), d.tag, i), d.peer)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if set != nil {
+				plan.Sets = append(plan.Sets, *set)
+			}
+			if len(r.Ports) == 0 {
+				chain.Rules = append(chain.Rules, append(match, "-j", "RETURN"))
+				continue
+			}
+			for _, p := range r.Ports {
+				proto, err := protocol(p)
+				if err != nil {
+					return nil, err
+				}
+				rule := append(append([]string{}, match...), "-p", proto, "--dport", strconv.Itoa(p.Port), "-j", "RETURN")
+				chain.Rules = append(chain.Rules, rule)
+			}
+		}
+		chain.Rules = append(chain.Rules, []string{"-j", "DROP"})
+		plan.Chains = append(plan.Chains, chain)
+		plan.Jumps = append(plan.Jumps, []string{
+			d.selector, podNet.String(), "-m", "comment", "--comment", jumpComment(pod.HostVeth), "-j", d.chain,
+		})
+	}
+	return plan, nil
+}
+
+// peerMatch returns the match for a rule's peers and the set backing it.
+// ok is false if none of the peers is of the pod's address family.
+func peerMatch(pod Pod, r Rule, setName, dir string) (match []string, set *Set, ok bool, err error) {
+	if len(r.CIDRs) == 0 {
+		return nil, nil, true, nil
+	}
+	var entries []string
+	for _, c := range r.CIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("invalid policy CIDR %q: %w", c, err)
+		}
+		if (cidr.IP.To4() != nil) != (pod.IP.To4() != nil) {
+			continue
+		}
+		// hash:net cannot hold a zero-length prefix; it matches any peer anyway.
+		if ones, _ := cidr.Mask.Size(); ones == 0 {
+			return nil, nil, true, nil
+		}
+		entries = append(entries, cidr.String())
+	}
+	if len(entries) == 0 {
+		return nil, nil, false, nil
+	}
+	family := ipsetwrapper.FamilyIPv4
+	if pod.IP.To4() == nil {
+		family = ipsetwrapper.FamilyIPv6
+	}
+	set = &Set{Name: setName, Family: family, Entries: entries}
+	return []string{"-m", "set", "--match-set", setName, dir}, set, true, nil
+}
+
+func protocol(p Port) (string, error) {
+	proto := strings.ToLower(p.Protocol)
+	if proto == "" {
+		proto = "tcp"
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("invalid policy protocol %q", p.Protocol)
+	}
+	if p.Port < 1 || p.Port > 65535 {
+		return "", fmt.Errorf("invalid policy port %d", p.Port)
+	}
+	return proto, nil
+}
+
+// Lines renders the plan as the commands that would create it, for dry runs.
+func (p *Plan) Lines() []string {
+	ipt := "iptables"
+	if p.Pod.IP.To4() == nil {
+		ipt = "ip6tables"
+	}
+	var out []string
+	for _, s := range p.Sets {
+		out = append(out, fmt.Sprintf("ipset create %s hash:net family %s", s.Name, s.Family))
+		for _, e := range s.Entries {
+			out = append(out, fmt.Sprintf("ipset add %s %s", s.Name, e))
+		}
+	}
+	for _, c := range p.Chains {
+		out = append(out, fmt.Sprintf("%s -t %s -N %s", ipt, filterTable, c.Name))
+		for _, r := range c.Rules {
+			out = append(out, fmt.Sprintf("%s -t %s -A %s %s", ipt, filterTable, c.Name, strings.Join(r, " ")))
+		}
+	}
+	for _, j := range p.Jumps {
+		out = append(out, fmt.Sprintf("%s -t %s -A %s %s", ipt, filterTable, dispatchChain, strings.Join(j, " ")))
+	}
+	return out
+}
+
+// hostNet returns ip as a single-address network.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
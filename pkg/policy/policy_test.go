@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelect(t *testing.T) {
+	f := &File{Policies: []Policy{
+		{Name: "all"},
+		{Name: "web", PodSelector: map[string]string{"app": "web"}},
+		{Name: "web-prod", PodSelector: map[string]string{"app": "web", "env": "prod"}},
+	}}
+
+	var names []string
+	for _, p := range f.Select(map[string]string{"app": "web", "env": "dev"}) {
+		names = append(names, p.Name)
+	}
+
+	assert.Equal(t, []string{"all", "web"}, names)
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"policies": [
+		{"name": "db", "podSelector": {"app": "db"}, "ingress": [{"cidrs": ["10.244.1.0/24"], "ports": [{"port": 5432}]}], "egress": []}
+	]}`), 0o644))
+
+	f, err := Load(path)
+
+	require.NoError(t, err)
+	require.Len(t, f.Policies, 1)
+	assert.NotNil(t, f.Policies[0].Egress, "an empty egress list still isolates")
+	assert.Equal(t, []Port{{Port: 5432}}, f.Policies[0].Ingress[0].Ports)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestParseInline(t *testing.T) {
+	p, err := ParseInline("in:10.244.0.0/16+fd00::/8@tcp/80+udp/53,out:")
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{{
+		CIDRs: []string{"10.244.0.0/16", "fd00::/8"},
+		Ports: []Port{{Protocol: "tcp", Port: 80}, {Protocol: "udp", Port: 53}},
+	}}, p.Ingress)
+	assert.Equal(t, []Rule{{}}, p.Egress)
+
+	for _, bad := range []string{"in", "sideways:10.0.0.0/8", "in:@tcp", "in:@tcp/http"} {
+		_, err := ParseInline(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	pod := Pod{HostVeth: "veth0123456789a", IP: net.ParseIP("10.0.0.2")}
+	policies := []Policy{
+		{Ingress: []Rule{
+			{CIDRs: []string{"10.244.0.0/16", "fd00::/8"}, Ports: []Port{{Port: 80}, {Protocol: "UDP", Port: 53}}},
+			{CIDRs: []string{"fd00::/8"}},
+		}},
+		{Egress: []Rule{{CIDRs: []string{"0.0.0.0/0"}, Ports: []Port{{Port: 443}}}}},
+	}
+
+	plan, err := Compile(pod, policies)
+
+	require.NoError(t, err)
+	assert.Equal(t, []Set{{Name: "eureka-veth0123456789a-i0", Family: "inet", Entries: []string{"10.244.0.0/16"}}}, plan.Sets)
+	assert.Equal(t, []string{
+		"ipset create eureka-veth0123456789a-i0 hash:net family inet",
+		"ipset add eureka-veth0123456789a-i0 10.244.0.0/16",
+		"iptables -t filter -N EUREKA-PI-veth0123456789a",
+		"iptables -t filter -A EUREKA-PI-veth0123456789a -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"iptables -t filter -A EUREKA-PI-veth0123456789a -m set --match-set eureka-veth0123456789a-i0 src -p tcp --dport 80 -j RETURN",
+		"iptables -t filter -A EUREKA-PI-veth0123456789a -m set --match-set eureka-veth0123456789a-i0 src -p udp --dport 53 -j RETURN",
+		"iptables -t filter -A EUREKA-PI-veth0123456789a -j DROP",
+		"iptables -t filter -N EUREKA-PE-veth0123456789a",
+		"iptables -t filter -A EUREKA-PE-veth0123456789a -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+		"iptables -t filter -A EUREKA-PE-veth0123456789a -p tcp --dport 443 -j RETURN",
+		"iptables -t filter -A EUREKA-PE-veth0123456789a -j DROP",
+		"iptables -t filter -A EUREKA-POLICY -d 10.0.0.2/32 -m comment --comment policy=veth0123456789a -j EUREKA-PI-veth0123456789a",
+		"iptables -t filter -A EUREKA-POLICY -s 10.0.0.2/32 -m comment --comment policy=veth0123456789a -j EUREKA-PE-veth0123456789a",
+	}, plan.Lines())
+}
+
+func TestCompile_OnlyListedDirectionsAreIsolated(t *testing.T) {
+	pod := Pod{HostVeth: "veth0", IP: net.ParseIP("fd00::2")}
+
+	plan, err := Compile(pod, []Policy{{Egress: []Rule{}}})
+
+	require.NoError(t, err)
+	require.Len(t, plan.Chains, 1)
+	assert.Equal(t, "EUREKA-PE-veth0", plan.Chains[0].Name)
+	assert.Equal(t, []string{"-j", "DROP"}, plan.Chains[0].Rules[len(plan.Chains[0].Rules)-1])
+	assert.Contains(t, plan.Lines()[0], "ip6tables")
+}
+
+func TestCompile_RejectsInvalidRules(t *testing.T) {
+	pod := Pod{HostVeth: "veth0", IP: net.ParseIP("10.0.0.2")}
+	for _, r := range []Rule{
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{Ports: []Port{{Protocol: "icmp", Port: 1}}},
+		{Ports: []Port{{Port: 70000}}},
+	} {
+		_, err := Compile(pod, []Policy{{Ingress: []Rule{r}}})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package tracing sets up OpenTelemetry tracing for one plugin invocation.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/innfi/probable-eureka"
+
+// Options selects where spans go. With neither set tracing is a no-op.
+type Options struct {
+	// Endpoint is an OTLP/HTTP collector, as host:port or a URL.
+	Endpoint string
+	// Insecure sends to Endpoint over plain HTTP.
+	Insecure bool
+	// File appends spans as JSON lines for offline analysis.
+	File string
+	// ServiceName defaults to the binary name.
+	ServiceName string
+}
+
+// Init installs the global tracer provider and returns a function that
+// flushes it; the plugin exits right after the command, so the flush must
+// run before then.
+func Init(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	noop := func(context.Context) error { return nil }
+	if opts.Endpoint == "" && opts.File == "" {
+		return noop, nil
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = filepath.Base(os.Args[0])
+	}
+
+	var tpOpts []sdktrace.TracerProviderOption
+	var closers []func() error
+	if opts.Endpoint != "" {
+		clientOpts := []otlptracehttp.Option{}
+		if isURL(opts.Endpoint) {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+		} else {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, clientOpts...)
+		if err != nil {
+			return noop, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		tpOpts = append(tpOpts, sdktrace.WithBatcher(exp))
+	}
+	if opts.File != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.File), 0755); err != nil {
+			return noop, err
+		}
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return noop, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return noop, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		tpOpts = append(tpOpts, sdktrace.WithSyncer(exp))
+		closers = append(closers, f.Close)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(opts.ServiceName))
+	tp := sdktrace.NewTracerProvider(append(tpOpts, sdktrace.WithResource(res))...)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		for _, c := range closers {
+			c()
+		}
+		return err
+	}, nil
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// Extract returns ctx carrying the remote parent described by a W3C
+// traceparent and tracestate, if they are valid.
+func Extract(ctx context.Context, traceparent, tracestate string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	if tracestate != "" {
+		carrier["tracestate"] = tracestate
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// Start starts a span from the global tracer provider.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
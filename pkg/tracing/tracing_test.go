@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInit_FileExporterKeepsRemoteParent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Init(context.Background(), Options{File: path, ServiceName: "eureka"})
+	require.NoError(t, err)
+
+	ctx := Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	ctx, root := Start(ctx, "cni.add")
+	_, step := Start(ctx, "veth.create")
+	End(step, errors.New("exists"))
+	End(root, nil)
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	type span struct {
+		Name        string
+		SpanContext struct{ TraceID, SpanID string }
+		Parent      struct{ SpanID string }
+		Status      struct{ Code string }
+	}
+	var spans []span
+	for dec.More() {
+		var s span
+		require.NoError(t, dec.Decode(&s))
+		spans = append(spans, s)
+	}
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "veth.create", spans[0].Name)
+	assert.Equal(t, "Error", spans[0].Status.Code)
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].Parent.SpanID)
+	assert.Equal(t, "cni.add", spans[1].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[1].SpanContext.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", spans[1].Parent.SpanID)
+}
+
+func TestInit_DisabledIsNoop(t *testing.T) {
+	shutdown, err := Init(context.Background(), Options{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+}